@@ -0,0 +1,469 @@
+package kothawoc
+
+import (
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kothawoc/go-nntp"
+	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+/*
+# HTTP API
+
+A JSON API for front-ends on "HTTPAddress", next to /events. Every request
+needs the token from APIToken, as "Authorization: Bearer <token>" or, for
+browsers opening a WebSocket, "?token=<token>", or the web UI's cookie.
+
+	GET    /api/groups                       list groups
+	POST   /api/groups                       {"name", "description", "ephemeral", "ttl", "size",
+	                                         "subjectonly", "policy", "moderated", "moderators"}
+	DELETE /api/groups/{name}                rmgroup one of our groups
+	GET    /api/groups/{name}/articles       ?from=&to=
+	GET    /api/groups/{name}/threads        ?page=, latest activity first
+	GET    /api/timeline                     ?before=<unix time>&beforeid=<number>&limit=, newest
+	                                         first, page with the last article's date and number
+	GET    /api/articles/{id}                one article by message id
+	GET    /api/articles/{id}/parts/{part}   an attached file, decoded
+	GET    /api/articles/{id}/objects/{part} a large object, with Range support
+	POST   /api/objects                      ?name=&type=&newsgroups=, the body is the
+	                                         file, returns the manifest for "objects"
+	POST   /api/countersign                  ?role=, the body is a signed article to countersign
+	                                         and post, as moderator by default
+	POST   /api/articles/{id}/reactions      {"reaction"}
+	DELETE /api/articles/{id}/reactions/{reaction}
+	GET    /api/threads/{id}                 the thread an article is in, as a tree
+	POST   /api/articles                     {"newsgroups", "subject", "text", "references", "files", "objects"}
+	GET    /api/peers                        peer connection status
+	GET    /api/stats                        compression in the store and to peers
+	POST   /api/fsck                         ?repair=true, checks the article store, and repairs it
+	POST   /api/peers                        {"torid", "name", "note"} sends a peer request
+	DELETE /api/peers/{torid}                stop peering
+	GET    /api/requests                     pending peer requests
+	POST   /api/requests/{torid}/{action}    accept, reject or block, accept takes {"name"}
+	POST   /api/invites                      {"expiry", "perms"} returns {"token"}
+	POST   /api/invites/accept               {"token"}
+	GET    /api/config                       the editable config
+	PUT    /api/config/{key}                 {"value"}
+*/
+
+// apiConfig is the config the API can edit, and whether it's a number. The
+// device key and API token are never exposed.
+var apiConfig = map[string]bool{
+	"vcard":          false,
+	"ListenAddress":  false,
+	"HTTPAddress":    false,
+	"MaxArticleSize": true,
+
+	// "zstd", "gzip" or "none", and "false" to stop offering peers
+	// compression from the next start.
+	"StoreCompression": false,
+	"WireCompression":  false,
+}
+
+// APIToken returns the token for the HTTP API, it's made on first use.
+func (c *Client) APIToken() (string, error) {
+	token, err := c.be.DBs.ConfigGetString("APIToken")
+	if err == nil && token != "" {
+		return token, nil
+	}
+
+	secret := make([]byte, 32)
+	if _, err := crand.Read(secret); err != nil {
+		return "", serr.New(err)
+	}
+	token = hex.EncodeToString(secret)
+	return token, serr.New(c.be.DBs.ConfigSet("APIToken", token))
+}
+
+// tokenCookie holds the token for the web UI.
+const tokenCookie = "kothawoc-token"
+
+func validToken(got, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// requireToken only lets requests carrying the API token through.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if got == "" {
+			got = r.URL.Query().Get("token")
+		}
+		if cookie, err := r.Cookie(tokenCookie); got == "" && err == nil {
+			got = cookie.Value
+		}
+		if !validToken(got, token) {
+			writeError(w, http.StatusUnauthorized, serr.Errorf("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Info("API write error", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpload)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// maxUpload is the most a request may send, files are attached in it, and
+// maxObjectUpload the most for large objects, which are streamed.
+const (
+	maxUpload       = 32 << 20
+	maxObjectUpload = 4 << 30
+)
+
+// webMedia are shown inline, any other file is only downloaded.
+var webMedia = []string{
+	"image/png", "image/jpeg", "image/gif",
+	"video/mp4", "video/webm", "video/ogg",
+	"audio/mpeg", "audio/ogg", "audio/webm", "audio/wav",
+}
+
+// mediaHeaders sets how a file is sent, media we show is inline, everything
+// else only downloads.
+func mediaHeaders(w http.ResponseWriter, mediaType, name string) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	if slices.Contains(webMedia, mediaType) {
+		w.Header().Set("Content-Type", mediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+}
+
+// serveAttachment sends one part of an article, decoded.
+func (c *Client) serveAttachment(w http.ResponseWriter, messageId, part string) {
+	n, err := strconv.Atoi(part)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p, err := c.ArticlePart(messageId, n)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	mediaType, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	name := params["name"]
+	if _, dparams, err := mime.ParseMediaType(p.Header.Get("Content-Disposition")); err == nil && dparams["filename"] != "" {
+		name = dparams["filename"]
+	}
+	mediaHeaders(w, mediaType, name)
+	io.Copy(w, p.Open())
+}
+
+// serveObject streams a large object, with Range requests so media players
+// can seek.
+func (c *Client) serveObject(w http.ResponseWriter, r *http.Request, messageId, part string) {
+	n, err := strconv.Atoi(part)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	object, manifest, err := c.OpenObject(messageId, n)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	mediaHeaders(w, manifest.Type, manifest.Name)
+	w.Header().Set("ETag", `"`+manifest.Sha256+`"`)
+	http.ServeContent(w, r, manifest.Name, time.Time{}, object)
+}
+
+// apiHandler routes the API, reply is called with the result of each call.
+func (c *Client) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	reply := func(w http.ResponseWriter, v interface{}, err error) {
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if v == nil {
+			v = map[string]string{}
+		}
+		writeJSON(w, v)
+	}
+
+	mux.HandleFunc("GET /api/groups", func(w http.ResponseWriter, r *http.Request) {
+		groups, err := c.Groups()
+		reply(w, groups, err)
+	})
+	mux.HandleFunc("POST /api/groups", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			Ephemeral   bool   `json:"ephemeral"`
+			TTL         int64  `json:"ttl"`
+			Size        int    `json:"size"`
+			SubjectOnly bool   `json:"subjectonly"`
+
+			Policy *messages.ContentPolicy `json:"policy"`
+
+			Moderated  bool     `json:"moderated"`
+			Moderators []string `json:"moderators"`
+		}{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Moderated {
+			reply(w, nil, c.CreateModeratedGroup(req.Name, req.Description, req.Moderators))
+			return
+		}
+		if req.Ephemeral {
+			reply(w, nil, c.CreateEphemeralGroup(req.Name, req.Description, time.Duration(req.TTL)*time.Second, req.Size, req.SubjectOnly))
+			return
+		}
+		if req.Policy != nil {
+			reply(w, nil, c.CreateGroupWithPolicy(req.Name, req.Description, *req.Policy))
+			return
+		}
+		reply(w, nil, c.CreateNewGroup(req.Name, req.Description, nntp.PostingPermitted))
+	})
+	mux.HandleFunc("DELETE /api/groups/{name}", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, nil, c.RemoveGroup(r.PathValue("name")))
+	})
+	mux.HandleFunc("GET /api/groups/{name}/articles", func(w http.ResponseWriter, r *http.Request) {
+		from, _ := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+		to, err := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+		if err != nil {
+			to = math.MaxInt64
+		}
+		articles, err := c.Articles(r.PathValue("name"), from, to)
+		reply(w, articles, err)
+	})
+
+	mux.HandleFunc("GET /api/groups/{name}/threads", func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		threads, err := c.GroupThreads(r.PathValue("name"), page)
+		reply(w, threads, err)
+	})
+
+	mux.HandleFunc("GET /api/timeline", func(w http.ResponseWriter, r *http.Request) {
+		since := time.Time{}
+		if before, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64); err == nil {
+			since = time.Unix(before, 0)
+		}
+		sinceId, _ := strconv.ParseInt(r.URL.Query().Get("beforeid"), 10, 64)
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = webTimelineSize
+		}
+		timeline, err := c.Timeline(since, sinceId, limit)
+		reply(w, timeline, err)
+	})
+	mux.HandleFunc("GET /api/articles/{id}", func(w http.ResponseWriter, r *http.Request) {
+		article, err := c.Article(r.PathValue("id"))
+		reply(w, article, err)
+	})
+	mux.HandleFunc("GET /api/articles/{id}/parts/{part}", func(w http.ResponseWriter, r *http.Request) {
+		c.serveAttachment(w, r.PathValue("id"), r.PathValue("part"))
+	})
+	mux.HandleFunc("GET /api/articles/{id}/objects/{part}", func(w http.ResponseWriter, r *http.Request) {
+		c.serveObject(w, r, r.PathValue("id"), r.PathValue("part"))
+	})
+	mux.HandleFunc("POST /api/objects", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		newsgroups := strings.Split(q.Get("newsgroups"), ",")
+		if q.Get("newsgroups") == "" || q.Get("name") == "" {
+			reply(w, nil, serr.Errorf("an object needs a name and newsgroups"))
+			return
+		}
+		manifest, err := c.UploadObject(newsgroups, q.Get("name"), q.Get("type"), http.MaxBytesReader(w, r.Body, maxObjectUpload))
+		reply(w, manifest, err)
+	})
+	// the body is a whole signed article, as sent to a moderator.
+	mux.HandleFunc("POST /api/countersign", func(w http.ResponseWriter, r *http.Request) {
+		role := r.URL.Query().Get("role")
+		if role == "" {
+			role = messages.RoleModerator
+		}
+		reply(w, nil, c.Countersign(http.MaxBytesReader(w, r.Body, maxUpload), role))
+	})
+	mux.HandleFunc("POST /api/articles/{id}/reactions", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Reaction string `json:"reaction"`
+		}{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		reply(w, nil, c.React(r.PathValue("id"), req.Reaction))
+	})
+	mux.HandleFunc("DELETE /api/articles/{id}/reactions/{reaction}", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, nil, c.Unreact(r.PathValue("id"), r.PathValue("reaction")))
+	})
+	mux.HandleFunc("GET /api/threads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		thread, err := c.Thread(r.PathValue("id"))
+		reply(w, thread, err)
+	})
+	mux.HandleFunc("POST /api/articles", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Newsgroups []string `json:"newsgroups"`
+			Subject    string   `json:"subject"`
+			Text       string   `json:"text"`
+			References []string `json:"references"`
+			Files      []File   `json:"files"`
+
+			Objects []messages.Manifest `json:"objects"`
+		}{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if len(req.Newsgroups) == 0 {
+			reply(w, nil, serr.Errorf("no newsgroups"))
+			return
+		}
+		id, err := c.PostFiles(req.Newsgroups, req.Subject, req.Text, req.References, req.Files, req.Objects)
+		reply(w, map[string]string{"messageid": id}, err)
+	})
+
+	mux.HandleFunc("GET /api/peers", func(w http.ResponseWriter, r *http.Request) {
+		status, err := c.PeerStatus()
+		reply(w, status, err)
+	})
+	mux.HandleFunc("GET /api/stats", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, c.CompressionStats(), nil)
+	})
+	mux.HandleFunc("POST /api/fsck", func(w http.ResponseWriter, r *http.Request) {
+		report, err := c.Fsck(r.URL.Query().Get("repair") == "true")
+		reply(w, report, err)
+	})
+	mux.HandleFunc("POST /api/peers", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			TorId string `json:"torid"`
+			Name  string `json:"name"`
+			Note  string `json:"note"`
+		}{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		reply(w, nil, c.RequestPeer(req.TorId, req.Name, req.Note))
+	})
+	mux.HandleFunc("DELETE /api/peers/{torid}", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, nil, c.RemovePeer(r.PathValue("torid")))
+	})
+
+	mux.HandleFunc("GET /api/requests", func(w http.ResponseWriter, r *http.Request) {
+		requests, err := c.PeerRequests()
+		reply(w, requests, err)
+	})
+	mux.HandleFunc("POST /api/requests/{torid}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		torId := r.PathValue("torid")
+		switch r.PathValue("action") {
+		case "accept":
+			req := struct {
+				Name string `json:"name"`
+			}{}
+			if !readJSON(w, r, &req) {
+				return
+			}
+			reply(w, nil, c.AcceptPeerRequest(torId, req.Name))
+		case "reject":
+			reply(w, nil, c.RejectPeerRequest(torId))
+		case "block":
+			reply(w, nil, c.BlockPeerRequest(torId))
+		default:
+			writeError(w, http.StatusNotFound, serr.Errorf("unknown action %s", r.PathValue("action")))
+		}
+	})
+
+	mux.HandleFunc("POST /api/invites", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Expiry string                      `json:"expiry"`
+			Perms  databases.PermissionsGroupT `json:"perms"`
+		}{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		expiry, err := time.ParseDuration(req.Expiry)
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		token, err := c.CreateInvite(expiry, req.Perms)
+		reply(w, map[string]string{"token": token}, err)
+	})
+	mux.HandleFunc("POST /api/invites/accept", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Token string `json:"token"`
+		}{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		invite, err := c.AcceptInvite(req.Token)
+		reply(w, invite, err)
+	})
+
+	mux.HandleFunc("GET /api/config", func(w http.ResponseWriter, r *http.Request) {
+		config := map[string]interface{}{}
+		for key, number := range apiConfig {
+			if number {
+				config[key], _ = c.be.DBs.ConfigGetInt64(key)
+			} else {
+				config[key], _ = c.be.DBs.ConfigGetString(key)
+			}
+		}
+		reply(w, config, nil)
+	})
+	mux.HandleFunc("PUT /api/config/{key}", func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		number, ok := apiConfig[key]
+		if !ok {
+			writeError(w, http.StatusForbidden, serr.Errorf("config %s can't be edited", key))
+			return
+		}
+		req := struct {
+			Value json.RawMessage `json:"value"`
+		}{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if number {
+			var val int64
+			if err := json.Unmarshal(req.Value, &val); err != nil {
+				reply(w, nil, err)
+				return
+			}
+			reply(w, nil, c.ConfigSet(key, val))
+			return
+		}
+		var val string
+		if err := json.Unmarshal(req.Value, &val); err != nil {
+			reply(w, nil, err)
+			return
+		}
+		reply(w, nil, c.ConfigSet(key, val))
+	})
+
+	return mux
+}
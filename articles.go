@@ -0,0 +1,314 @@
+package kothawoc
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/kothawoc/go-nntp"
+	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/internal/nntpbackend"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// Article is an article as front-ends show it.
+type Article struct {
+	Number     int64     `json:"number,omitempty"`
+	MessageId  string    `json:"messageid"`
+	From       string    `json:"from"`
+	Newsgroups []string  `json:"newsgroups"`
+	Subject    string    `json:"subject"`
+	Date       time.Time `json:"date"`
+	References []string  `json:"references,omitempty"`
+	Control    string    `json:"control,omitempty"`
+	Text       string    `json:"text"`
+
+	Reactions   map[string]int64      `json:"reactions,omitempty"`
+	Attachments []messages.Attachment `json:"attachments,omitempty"`
+	Objects     []messages.Manifest   `json:"objects,omitempty"`
+	// Countersigners are the valid signatures added over the author's.
+	Countersigners []messages.Signer `json:"countersigners,omitempty"`
+}
+
+func newArticle(num int64, article *nntp.Article) Article {
+	msg := messages.NewMessageToolFromArticle(article)
+	date, _ := mail.ParseDate(article.Header.Get("Date"))
+	var countersigners []messages.Signer
+	if article.Header.Get(messages.CountersignatureHeader) != "" {
+		if signers := msg.Signers(); len(signers) > 1 {
+			countersigners = signers[1:]
+		}
+	}
+	return Article{
+		Number:      num,
+		MessageId:   article.Header.Get("Message-Id"),
+		From:        article.Header.Get("From"),
+		Newsgroups:  strings.Split(article.Header.Get("Newsgroups"), ","),
+		Subject:     article.Header.Get("Subject"),
+		Date:        date,
+		References:  msg.References(),
+		Control:     article.Header.Get("Control"),
+		Text:        msg.Text(),
+		Attachments: msg.Attachments(),
+		Objects:     msg.Objects(),
+
+		Countersigners: countersigners,
+	}
+}
+
+// localSession is the session of the node owner, as used by Dial.
+func (c *Client) localSession() map[string]string {
+	pubkey, _ := c.deviceKey.TorPubKey()
+	return map[string]string{
+		"Id":       c.deviceId,
+		"PubKey":   fmt.Sprintf("%x", pubkey),
+		"ConnMode": nntpbackend.ConnModeLocal,
+	}
+}
+
+// Groups lists every group on the node.
+func (c *Client) Groups() ([]*nntp.Group, error) {
+	list, err := c.be.ListGroups(c.localSession())
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	groups := []*nntp.Group{}
+	for g := range list {
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// Articles returns the articles numbered from to to in a group.
+func (c *Client) Articles(group string, from, to int64) ([]Article, error) {
+	session := c.localSession()
+	g, err := c.be.GetGroup(session, group)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	list, err := c.be.GetArticles(session, g, from, to)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	ret := []Article{}
+	for a := range list {
+		article := newArticle(a.Num, a.Article)
+		article.Reactions, _ = c.be.DBs.GetReactions(article.MessageId)
+		ret = append(ret, article)
+	}
+	return ret, nil
+}
+
+// Article finds an article by message id.
+func (c *Client) Article(messageId string) (*Article, error) {
+	a, err := c.be.GetArticleWithNoGroup(c.localSession(), messageId)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	ret := newArticle(0, a)
+	ret.Reactions, _ = c.be.DBs.GetReactions(ret.MessageId)
+	return &ret, nil
+}
+
+// ThreadArticle is an article with the replies to it, Missing when it's
+// referenced but we don't have it.
+type ThreadArticle struct {
+	Article
+	Missing bool             `json:"missing,omitempty"`
+	Replies []*ThreadArticle `json:"replies,omitempty"`
+}
+
+func (c *Client) threadArticles(node *databases.ThreadNode) *ThreadArticle {
+	t := &ThreadArticle{Article: Article{MessageId: node.MessageId}, Missing: node.Placeholder}
+	if !node.Placeholder {
+		if a, err := c.Article(node.MessageId); err == nil {
+			t.Article = *a
+			t.Number = node.Id
+		} else {
+			t.Missing = true
+		}
+	}
+	for _, child := range node.Children {
+		t.Replies = append(t.Replies, c.threadArticles(child))
+	}
+	return t
+}
+
+// Thread returns the whole thread an article is in, from its root.
+func (c *Client) Thread(messageId string) (*ThreadArticle, error) {
+	node, err := c.be.DBs.Thread(messageId)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	return c.threadArticles(node), nil
+}
+
+// GroupThreads returns a page of a group's threads, latest activity first.
+func (c *Client) GroupThreads(group string, page int) ([]*ThreadArticle, error) {
+	nodes, err := c.be.DBs.GroupThreads(group, page)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	threads := []*ThreadArticle{}
+	for _, node := range nodes {
+		threads = append(threads, c.threadArticles(node))
+	}
+	return threads, nil
+}
+
+// feedGroup is a group that shows up in the timeline, rather than the node's
+// own plumbing of peering and read state groups.
+func feedGroup(name string) bool {
+	return !strings.Contains(name, ".peers.") && !strings.HasSuffix(name, ".newsrc")
+}
+
+// Timeline returns the latest articles of every group, newest first, as a
+// social feed, going back from since, zero for now. Page through it with the
+// Date and Number of the last article.
+func (c *Client) Timeline(since time.Time, sinceId int64, limit int) ([]Article, error) {
+	groups, err := c.Groups()
+	if err != nil {
+		return nil, err
+	}
+	feed := []string{}
+	for _, g := range groups {
+		if feedGroup(g.Name) {
+			feed = append(feed, g.Name)
+		}
+	}
+	if len(feed) == 0 {
+		return []Article{}, nil
+	}
+
+	entries, err := c.be.DBs.Timeline(c.localSession(), since, sinceId, limit, feed)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	timeline := []Article{}
+	for _, e := range entries {
+		a := Article{
+			Number:     e.Id,
+			MessageId:  e.MessageId,
+			From:       e.From,
+			Newsgroups: e.Newsgroups,
+			Subject:    e.Subject,
+			Date:       e.Date,
+			References: e.References,
+		}
+		// the overview is enough to page on, the body is shown if we can
+		// read it.
+		if article, err := c.be.DBs.GetArticleById(e.MessageId); err == nil {
+			full := newArticle(e.Id, article)
+			a.Text = full.Text
+			a.Attachments = full.Attachments
+			a.Objects = full.Objects
+			a.Countersigners = full.Countersigners
+		}
+		a.Reactions, _ = c.be.DBs.GetReactions(e.MessageId)
+		timeline = append(timeline, a)
+	}
+	return timeline, nil
+}
+
+// PostText signs and posts a plain text article, returning its message id.
+func (c *Client) PostText(newsgroups []string, subject, body string, references []string) (string, error) {
+	msg := messages.NewTextPost(newsgroups, subject, body, references)
+	if err := c.Post(msg); err != nil {
+		return "", err
+	}
+	return msg.Article.Header.Get("Message-Id"), nil
+}
+
+// File is a file to attach to a post, Content is base64 in JSON.
+type File struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content []byte `json:"content"`
+}
+
+// PostFiles signs and posts an article with files attached, images get
+// thumbnails, returning its message id. Files over MaxAttachmentSize are sent
+// as large objects, as are the objects already uploaded with UploadObject.
+func (c *Client) PostFiles(newsgroups []string, subject, body string, references []string, files []File, objects []messages.Manifest) (string, error) {
+	msg := messages.NewTextPost(newsgroups, subject, body, references)
+	for _, f := range files {
+		if len(f.Content) > messages.MaxAttachmentSize {
+			manifest, err := c.UploadObject(newsgroups, f.Name, f.Type, bytes.NewReader(f.Content))
+			if err != nil {
+				return "", err
+			}
+			msg.AddObject(manifest)
+			continue
+		}
+		if err := msg.AddAttachment(f.Name, f.Type, bytes.NewReader(f.Content)); err != nil {
+			return "", err
+		}
+	}
+	for _, manifest := range objects {
+		for _, hash := range manifest.Chunks {
+			if _, err := c.be.DBs.GetArticleById(messages.ChunkMessageId(hash)); err != nil {
+				return "", serr.Errorf("object %s is missing chunk %s", manifest.Name, hash)
+			}
+		}
+		msg.AddObject(manifest)
+	}
+	if err := c.Post(msg); err != nil {
+		return "", err
+	}
+	return msg.Article.Header.Get("Message-Id"), nil
+}
+
+// ArticlePart returns one part of an article, such as an attached file.
+func (c *Client) ArticlePart(messageId string, part int) (*messages.MimePart, error) {
+	a, err := c.be.GetArticleWithNoGroup(c.localSession(), messageId)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	msg := messages.NewMessageToolFromArticle(a)
+	if part < 0 || part >= len(msg.Parts) {
+		return nil, serr.Errorf("no part %d in %s", part, messageId)
+	}
+	return &msg.Parts[part], nil
+}
+
+// RemoveGroup removes one of our groups, here and on every node carrying it.
+func (c *Client) RemoveGroup(name string) error {
+	mail, err := messages.CreateRmGroupMail(c.deviceKey, idGen, name)
+	if err != nil {
+		return serr.New(err)
+	}
+	return serr.New(c.postRaw(mail))
+}
+
+// React reacts to an article, with an emoji or a "+1" or "-1" vote.
+func (c *Client) React(messageId, reaction string) error {
+	article, err := c.Article(messageId)
+	if err != nil {
+		return err
+	}
+	mail, err := messages.CreateReaction(c.deviceKey, idGen, strings.TrimSpace(article.Newsgroups[0]), messageId, reaction)
+	if err != nil {
+		return serr.New(err)
+	}
+	return serr.New(c.postRaw(mail))
+}
+
+// Unreact takes back our reaction to an article, by cancelling it.
+func (c *Client) Unreact(messageId, reaction string) error {
+	reactionId, err := c.be.DBs.GetMyReaction(c.deviceId, messageId, reaction)
+	if err != nil {
+		return serr.New(err)
+	}
+	article, err := c.be.GetArticleWithNoGroup(c.localSession(), reactionId)
+	if err != nil {
+		return serr.New(err)
+	}
+	mail, err := messages.CreateCancelMail(c.deviceKey, idGen, reactionId, strings.Split(article.Header.Get("Newsgroups"), ","))
+	if err != nil {
+		return serr.New(err)
+	}
+	return serr.New(c.postRaw(mail))
+}
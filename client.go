@@ -1,24 +1,33 @@
 package kothawoc
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
 	"math/rand"
 	"net"
+	"net/mail"
+	"net/textproto"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/emersion/go-vcard"
 
 	"github.com/kothawoc/go-nntp"
 	nntpclient "github.com/kothawoc/go-nntp/client"
 	nntpserver "github.com/kothawoc/go-nntp/server"
 	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/internal/events"
 	"github.com/kothawoc/kothawoc/internal/nntpbackend"
+	"github.com/kothawoc/kothawoc/internal/peering"
 	"github.com/kothawoc/kothawoc/internal/torutils"
 	"github.com/kothawoc/kothawoc/pkg/keytool"
 	"github.com/kothawoc/kothawoc/pkg/messages"
@@ -26,7 +35,10 @@ import (
 )
 
 type Client struct {
+	// NNTPclient is our own session with the server, posts go through
+	// postRaw as the API handlers post concurrently.
 	NNTPclient *nntpclient.Client
+	postLock   sync.Mutex
 	Server     *nntpserver.Server
 	be         *nntpbackend.NntpBackend
 	//deviceKey  ed25519.PrivateKey
@@ -80,6 +92,19 @@ func NewClient(path string, port int) (*Client, error) {
 	}
 	//log.Fatal("Started with:", torId, myKey)
 
+	// offered to peers in the handshake, 0 is unlimited.
+	if tc != nil {
+		maxSize, err := dbs.ConfigGetInt64("MaxArticleSize")
+		if err != nil {
+			maxSize = messages.DefaultMaxArticleSize
+		}
+		tc.Options.MaxArticleSize = maxSize
+	}
+	// compression is offered unless it's turned off.
+	if compress, _ := dbs.ConfigGetString("WireCompression"); compress != "false" && tc != nil {
+		tc.Options.Features = append(tc.Options.Features, torutils.FeatureCompression)
+	}
+
 	nntpBackend, _ := nntpbackend.NewNNTPBackend(path, tc, dbs)
 
 	client := &Client{
@@ -91,6 +116,7 @@ func NewClient(path string, port int) (*Client, error) {
 	}
 
 	idGen.NodeName = client.deviceId
+	client.be.IdGen = idGen
 
 	//	client.deviceKey = ed25519.PrivateKey(deviceKey)
 	//myKey.SetTorPrivateKey(ed25519.PrivateKey(tmpKey))
@@ -102,6 +128,7 @@ func NewClient(path string, port int) (*Client, error) {
 	client.Server = s
 
 	go client.tcpServer(s, port)
+	go client.httpServer()
 	go client.torServer(tc, s)
 
 	//go func() {
@@ -148,7 +175,72 @@ func (c *Client) CreateNewGroup(name, description string, posting nntp.PostingSt
 		return serr.New(err)
 	}
 
-	return serr.New(c.NNTPclient.Post(strings.NewReader(mail)))
+	return serr.New(c.postRaw(mail))
+}
+
+// CreateEphemeralGroup creates a chat group, its articles are only kept in
+// RAM for ttl, at most size of them, zero values use the defaults. With
+// subjectOnly the articles can't have a body.
+func (c *Client) CreateEphemeralGroup(name, description string, ttl time.Duration, size int, subjectOnly bool) error {
+	card := vcard.Card{}
+	messages.SetEphemeral(card, ttl, size, subjectOnly)
+	vcard.ToV4(card)
+
+	mail, err := messages.CreateNewsGroupMail(c.deviceKey, idGen, name, description, card, nntp.PostingPermitted)
+	if err != nil {
+		return serr.New(err)
+	}
+
+	return serr.New(c.postRaw(mail))
+}
+
+// CreateGroupWithPolicy creates a group limiting what can be attached in it,
+// to some media types and sizes.
+func (c *Client) CreateGroupWithPolicy(name, description string, policy messages.ContentPolicy) error {
+	card := vcard.Card{}
+	messages.SetContentPolicy(card, policy)
+	vcard.ToV4(card)
+
+	mail, err := messages.CreateNewsGroupMail(c.deviceKey, idGen, name, description, card, nntp.PostingPermitted)
+	if err != nil {
+		return serr.New(err)
+	}
+
+	return serr.New(c.postRaw(mail))
+}
+
+// CreateModeratedGroup creates a group whose articles must be approved by
+// us or one of the moderators.
+func (c *Client) CreateModeratedGroup(name, description string, moderators []string) error {
+	card := vcard.Card{}
+	messages.SetModerated(card, moderators)
+	vcard.ToV4(card)
+
+	mail, err := messages.CreateNewsGroupMail(c.deviceKey, idGen, name, description, card, nntp.PostingPermitted)
+	if err != nil {
+		return serr.New(err)
+	}
+
+	return serr.New(c.postRaw(mail))
+}
+
+// Countersign adds our signature in role to a signed article, such as one
+// sent to us for approval, and posts it.
+func (c *Client) Countersign(article io.Reader, role string) error {
+	m, err := mail.ReadMessage(article)
+	if err != nil {
+		return serr.New(err)
+	}
+	msg := messages.NewMessageToolFromArticle(&nntp.Article{Header: textproto.MIMEHeader(m.Header), Body: m.Body})
+	if !msg.Verify() {
+		return serr.Errorf("article %s doesn't verify", msg.Article.Header.Get("Message-Id"))
+	}
+	raw, err := msg.Countersign(c.deviceKey, role)
+	if err != nil {
+		return err
+	}
+
+	return serr.New(c.postRaw(raw))
 }
 
 // TODO: *** WARNING *** THIS CAUSES A PANIC ON THE FIRST STARTUP BEFORE THE DEVICE KEY HSA BEEN SET.
@@ -161,7 +253,241 @@ func (c *Client) AddPeer(torId, myname string) error {
 		return serr.New(err)
 	}
 
-	return serr.New(c.NNTPclient.Post(strings.NewReader(mail)))
+	return serr.New(c.postRaw(mail))
+}
+
+// Introduce recommends torId, one of our peers, to the peer peerId. It will
+// show up as a friend suggestion on their node.
+func (c *Client) Introduce(peerId, torId, name string) error {
+	peers, err := c.be.DBs.GetPeerList()
+	if err != nil {
+		return serr.New(err)
+	}
+	if !slices.Contains(peers, peerId) || !slices.Contains(peers, torId) {
+		return serr.Errorf("can only introduce peers to each other peerId=%s torId=%s", peerId, torId)
+	}
+
+	// pass on who introduced them to us, if anyone did.
+	chain := []string{}
+	if suggestion, err := c.be.DBs.GetSuggestion(torId); err == nil {
+		chain = suggestion.Chain
+	}
+
+	mail, err := messages.CreateIntroduction(c.deviceKey, idGen, peerId, torId, name, chain)
+	if err != nil {
+		return serr.New(err)
+	}
+
+	if err := c.be.DBs.AddIntroduction(torId, peerId, name); err != nil {
+		return serr.New(err)
+	}
+
+	return serr.New(c.postRaw(mail))
+}
+
+func (c *Client) Suggestions() ([]databases.Suggestion, error) {
+	return c.be.DBs.GetSuggestions()
+}
+
+// AcceptSuggestion peers with a suggested torid, and tells the introducer so
+// the other side peers back with us.
+func (c *Client) AcceptSuggestion(torId string) error {
+	suggestion, err := c.be.DBs.GetSuggestion(torId)
+	if err != nil {
+		return serr.New(err)
+	}
+
+	if err := c.AddPeer(torId, suggestion.Name); err != nil {
+		return serr.New(err)
+	}
+
+	mail, err := messages.CreateIntroAccept(c.deviceKey, idGen, suggestion.Introducer, torId, c.displayName())
+	if err != nil {
+		return serr.New(err)
+	}
+
+	if err := c.postRaw(mail); err != nil {
+		return serr.New(err)
+	}
+
+	return serr.New(c.be.DBs.SetSuggestionStatus(torId, databases.SuggestionAccepted))
+}
+
+func (c *Client) RejectSuggestion(torId string) error {
+	return serr.New(c.be.DBs.SetSuggestionStatus(torId, databases.SuggestionRejected))
+}
+
+// RequestPeer peers with torId sending note with every connection attempt,
+// so an unknown node sees who we are in its pending requests.
+func (c *Client) RequestPeer(torId, name, note string) error {
+	// set before peering, so the first connection attempt has it.
+	if err := c.be.DBs.ConfigSet("IntroNote."+torId, note); err != nil {
+		return serr.New(err)
+	}
+	return serr.New(c.AddPeer(torId, name))
+}
+
+// PeerRequests lists the unknown nodes that tried to connect to us.
+func (c *Client) PeerRequests() ([]databases.PeerRequest, error) {
+	return c.be.DBs.GetPeerRequests()
+}
+
+func (c *Client) AcceptPeerRequest(torId, name string) error {
+	if _, err := c.be.DBs.GetPeerRequest(torId); err != nil {
+		return serr.New(err)
+	}
+	if err := c.AddPeer(torId, name); err != nil {
+		return serr.New(err)
+	}
+	return serr.New(c.be.DBs.SetPeerRequestStatus(torId, databases.PeerRequestAccepted))
+}
+
+func (c *Client) RejectPeerRequest(torId string) error {
+	return serr.New(c.be.DBs.SetPeerRequestStatus(torId, databases.PeerRequestRejected))
+}
+
+// BlockPeerRequest refuses every future connection from torId.
+func (c *Client) BlockPeerRequest(torId string) error {
+	return serr.New(c.be.DBs.SetPeerRequestStatus(torId, databases.PeerRequestBlocked))
+}
+
+// Block refuses connections and articles from torId, including articles
+// relayed through it. With advertise it's published to our blocklist group
+// for friends following it.
+func (c *Client) Block(torId, reason string, advertise bool) error {
+	if torId == c.deviceId {
+		return serr.Errorf("can't block ourselves")
+	}
+
+	if err := c.be.DBs.Block(torId, databases.BlockSourceLocal, reason); err != nil {
+		return serr.New(err)
+	}
+	c.be.Peers.RemovePeer(torId)
+
+	if !advertise {
+		return nil
+	}
+
+	if err := c.ensureBlocklistGroup(); err != nil {
+		return serr.New(err)
+	}
+	mail, err := messages.CreateBlockAdvisory(c.deviceKey, idGen, torId, reason)
+	if err != nil {
+		return serr.New(err)
+	}
+	return serr.New(c.postRaw(mail))
+}
+
+func (c *Client) Unblock(torId string, advertise bool) error {
+	if err := c.be.DBs.Unblock(torId, databases.BlockSourceLocal); err != nil {
+		return serr.New(err)
+	}
+
+	if !advertise {
+		return nil
+	}
+
+	if err := c.ensureBlocklistGroup(); err != nil {
+		return serr.New(err)
+	}
+	mail, err := messages.CreateUnblockAdvisory(c.deviceKey, idGen, torId)
+	if err != nil {
+		return serr.New(err)
+	}
+	return serr.New(c.postRaw(mail))
+}
+
+func (c *Client) Blocklist() ([]databases.BlockEntry, error) {
+	return c.be.DBs.GetBlocklist()
+}
+
+// FollowBlocklist applies the block advisories torId publishes to our own
+// blocklist, unfollowing removes them again.
+func (c *Client) FollowBlocklist(torId string, follow bool) error {
+	return serr.New(c.be.DBs.FollowBlocklist(torId, follow))
+}
+
+func (c *Client) ensureBlocklistGroup() error {
+	session := map[string]string{
+		"Id":       c.deviceId,
+		"ConnMode": nntpbackend.ConnModeLocal,
+	}
+	group := messages.BlocklistGroup(c.deviceId)
+	if _, err := c.be.DBs.GetGroup(session, group); err == nil {
+		return nil
+	}
+	return c.CreateNewGroup(group, "Block advisories", nntp.PostingPermitted)
+}
+
+// CreateInvite returns a signed invite token to hand to someone out of band,
+// when they accept it we peer with them granting perms, until expiry.
+func (c *Client) CreateInvite(expiry time.Duration, perms databases.PermissionsGroupT) (string, error) {
+	secret := make([]byte, 16)
+	if _, err := crand.Read(secret); err != nil {
+		return "", serr.New(err)
+	}
+
+	invite := messages.Invite{
+		TorId:   c.deviceId,
+		Name:    c.displayName(),
+		Secret:  hex.EncodeToString(secret),
+		Expires: time.Now().Add(expiry),
+	}
+
+	if err := c.be.DBs.AddInvite(invite.Secret, invite.Expires, perms); err != nil {
+		return "", serr.New(err)
+	}
+
+	return messages.CreateInviteToken(c.deviceKey, invite)
+}
+
+// AcceptInvite peers with the node that created token, and tells them so they
+// peer back with us.
+func (c *Client) AcceptInvite(token string) (*messages.Invite, error) {
+	invite, err := messages.ParseInviteToken(token)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+
+	if time.Now().After(invite.Expires) {
+		return nil, serr.Errorf("invite from %s expired at %s", invite.TorId, invite.Expires)
+	}
+	if invite.TorId == c.deviceId {
+		return nil, serr.Errorf("can't accept our own invite")
+	}
+
+	if err := c.be.DBs.ConfigSet("IntroNote."+invite.TorId, messages.InviteNote(invite.Secret)); err != nil {
+		return nil, serr.New(err)
+	}
+	if err := c.AddPeer(invite.TorId, invite.Name); err != nil {
+		return nil, serr.New(err)
+	}
+
+	mail, err := messages.CreateInviteAccept(c.deviceKey, idGen, invite.TorId, invite.Secret)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+
+	return invite, serr.New(c.postRaw(mail))
+}
+
+// displayName is the name from our vcard, stored as "vcard" in the config.
+func (c *Client) displayName() string {
+	raw, err := c.be.DBs.ConfigGetString("vcard")
+	if err != nil || raw == "" {
+		return ""
+	}
+
+	card, err := vcard.NewDecoder(strings.NewReader(raw)).Decode()
+	if err != nil {
+		slog.Info("failed to decode our vcard", "error", err)
+		return ""
+	}
+
+	if name := card.PreferredValue(vcard.FieldFormattedName); name != "" {
+		return name
+	}
+	return card.PreferredValue(vcard.FieldNickname)
 }
 
 // func CreatePeeringMail(key ed25519.PrivateKey, idgen nntpserver.IdGenerator, name string) (string, error) {
@@ -173,7 +499,62 @@ func (c *Client) Post(mail *messages.MessageTool) error {
 		return serr.New(err)
 	}
 
-	return serr.New(c.NNTPclient.Post(strings.NewReader(signedMail)))
+	return serr.New(c.postRaw(signedMail))
+}
+
+// PeerStatus lists every peer with its connection state and transfer
+// statistics, for showing online indicators in a friends list.
+func (c *Client) PeerStatus() ([]peering.PeerStatus, error) {
+	return c.be.Peers.Status()
+}
+
+// CompressionStats are the bytes before and after compression, in the
+// article store and over compressed peer sessions, and the ratio achieved.
+type CompressionStats struct {
+	StoreRaw         int64   `json:"storeraw"`
+	StoreStored      int64   `json:"storestored"`
+	StoreRatio       float64 `json:"storeratio"`
+	WireRaw          int64   `json:"wireraw"`
+	WireCompressed   int64   `json:"wirecompressed"`
+	WireRatio        float64 `json:"wireratio"`
+	StoreCompression string  `json:"storecompression"`
+}
+
+func ratio(raw, compressed int64) float64 {
+	if compressed == 0 {
+		return 0
+	}
+	return float64(raw) / float64(compressed)
+}
+
+// CompressionStats returns how well articles compress, in the store since it
+// was made and over the wire since we started.
+func (c *Client) CompressionStats() CompressionStats {
+	stats := CompressionStats{StoreCompression: databases.DefaultStoreCompression}
+	stats.StoreRaw, _ = c.be.DBs.ConfigGetInt64("StoreBytesRaw")
+	stats.StoreStored, _ = c.be.DBs.ConfigGetInt64("StoreBytesStored")
+	stats.StoreRatio = ratio(stats.StoreRaw, stats.StoreStored)
+	stats.WireRaw, stats.WireCompressed = torutils.CompressionStats()
+	stats.WireRatio = ratio(stats.WireRaw, stats.WireCompressed)
+	if compression, err := c.be.DBs.ConfigGetString("StoreCompression"); err == nil && compression != "" {
+		stats.StoreCompression = compression
+	}
+	return stats
+}
+
+// Fsck checks the article store against articles.db and the groups, and
+// with repair fixes what it can.
+func (c *Client) Fsck(repair bool) (databases.FsckReport, error) {
+	return c.be.DBs.Fsck(repair)
+}
+
+// RemovePeer stops peering with torId, removing our peering group so their
+// node drops us too.
+func (c *Client) RemovePeer(torId string) error {
+	if err := c.RemoveGroup(c.deviceId + ".peers." + torId); err != nil {
+		return err
+	}
+	return serr.New(c.be.DBs.DeletePeer(torId))
 }
 
 func (c *Client) Dial() {
@@ -191,11 +572,20 @@ func (c *Client) Dial() {
 
 	client, _ := nntpclient.NewConn(clientConn)
 
+	c.postLock.Lock()
+	defer c.postLock.Unlock()
 	c.NNTPclient = client
 
 	c.NNTPclient.Authenticate("test", "test")
 }
 
+// postRaw posts a signed article through our own session, one at a time.
+func (c *Client) postRaw(mail string) error {
+	c.postLock.Lock()
+	defer c.postLock.Unlock()
+	return c.NNTPclient.Post(strings.NewReader(mail))
+}
+
 func (c *Client) GetKey() keytool.EasyEdKey {
 	return c.deviceKey
 }
@@ -221,36 +611,118 @@ func (i GenIdType) GenID() string {
 
 var idGen GenIdType
 
+// DefaultListenAddress is where the TCP listener binds unless the
+// "ListenAddress" config is set, newsreaders on other machines still have to
+// log in with an account.
+const DefaultListenAddress = "127.0.0.1"
+
 func (c *Client) tcpServer(s *nntpserver.Server, port int) error {
-	a, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
+	host, err := c.be.DBs.ConfigGetString("ListenAddress")
+	if err != nil || host == "" {
+		host = DefaultListenAddress
+	}
+	a, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
 		return serr.New(err)
 	}
-	slog.Info("Resolving listener", "error", err)
 	l, err := net.ListenTCP("tcp", a)
 	if err != nil {
-		l.Close()
+		slog.Info("Error setting up listener", "address", a, "error", err)
 		return serr.New(err)
 	}
-	slog.Info("Setting up listener", "error", err)
+	slog.Info("Listening", "address", a)
 	defer l.Close()
 
 	for {
 		conn, err := l.AcceptTCP()
+		if err != nil {
+			slog.Info("Error accepting connection", "error", err)
+			continue
+		}
 
-		slog.Info("Error accepting connection", "error", err)
+		// Id and PubKey are ours until the session logs in, accounts other
+		// than the owner then get their own Id, see EmptyNntpBackend.
+		// failed logins are limited by RemoteAddr.
 		pubkey, _ := c.deviceKey.TorPubKey()
+		remote, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 		clientSession := nntpserver.ClientSession{
-			"Id":       c.deviceId,
-			"PubKey":   string(fmt.Sprintf("%x", pubkey)),
-			"ConnMode": nntpbackend.ConnModeTcp,
+			"Id":         c.deviceId,
+			"PubKey":     string(fmt.Sprintf("%x", pubkey)),
+			"ConnMode":   nntpbackend.ConnModeTcp,
+			"RemoteAddr": remote,
 		}
 
-		slog.Info("clid stuff [%#v][%#v]", c.deviceId, idGen)
 		go s.Process(conn, clientSession)
 	}
 }
 
+// AddAccount creates a local account for logging in over the TCP listener.
+func (c *Client) AddAccount(username, password string, role databases.AccountRole) error {
+	return serr.New(c.be.DBs.AddAccount(username, password, role))
+}
+
+func (c *Client) SetAccountPassword(username, password string) error {
+	return serr.New(c.be.DBs.SetAccountPassword(username, password))
+}
+
+func (c *Client) DeleteAccount(username string) error {
+	return serr.New(c.be.DBs.DeleteAccount(username))
+}
+
+func (c *Client) Accounts() ([]databases.Account, error) {
+	return c.be.DBs.GetAccounts()
+}
+
+// SubscribeGroup adds a group to an account's subscriptions, or removes it
+// when subscribe is false.
+func (c *Client) SubscribeGroup(username, group string, subscribe bool) error {
+	return serr.New(c.be.DBs.Subscribe(username, group, subscribe))
+}
+
+func (c *Client) Subscriptions(username string) ([]string, error) {
+	return c.be.DBs.GetSubscriptions(username)
+}
+
+// MarkRead sets the read state of articles in a group for an account.
+func (c *Client) MarkRead(username, group string, numbers []int64, read bool) error {
+	return serr.New(c.be.DBs.MarkRead(username, group, numbers, read))
+}
+
+func (c *Client) ReadMarks(username, group string) ([]int64, error) {
+	return c.be.DBs.GetReadMarks(username, group)
+}
+
+// Newsrc returns an account's read state in .newsrc format.
+func (c *Client) Newsrc(username string) (string, error) {
+	lines, err := c.be.DBs.GetNewsrc(username)
+	if err != nil {
+		return "", serr.New(err)
+	}
+	return messages.FormatNewsrc(lines), nil
+}
+
+// SetNewsrc imports a .newsrc for an account, replacing the read state of
+// the groups it lists.
+func (c *Client) SetNewsrc(username, newsrc string) error {
+	return serr.New(c.be.SetNewsrc(username, newsrc))
+}
+
+// EnableNewsrcSync syncs an account's read state with its other devices,
+// which have to be peers and use the same account key, see AccountKey.
+func (c *Client) EnableNewsrcSync(username string, devices []string) error {
+	return serr.New(c.be.EnableNewsrcSync(username, devices))
+}
+
+// AccountKey returns an account's identity key, to set up the same identity
+// on another device with SetAccountKey.
+func (c *Client) AccountKey(username string) (keytool.EasyEdKey, error) {
+	return c.be.DBs.GetAccountKey(username)
+}
+
+func (c *Client) SetAccountKey(username string, key keytool.EasyEdKey) error {
+	return serr.New(c.be.DBs.SetAccountKey(username, key))
+}
+
 func (c *Client) torServer(tc *torutils.TorCon, s *nntpserver.Server) error {
 
 	slog.Info("SERVER Starting", "torconn", tc)
@@ -273,7 +745,8 @@ func (c *Client) torServer(tc *torutils.TorCon, s *nntpserver.Server) error {
 			defer conn.Close()
 
 			var clientPubKey ed25519.PublicKey
-			authCallback := func(key ed25519.PublicKey) bool {
+			invited := false
+			authCallback := func(key ed25519.PublicKey, note string) bool {
 				clientPubKey = key
 				match := int64(0)
 
@@ -285,6 +758,13 @@ func (c *Client) torServer(tc *torutils.TorCon, s *nntpserver.Server) error {
 					return false
 				}
 
+				// blocks win over peering, a blocked peer stays in peers.db so
+				// unblocking them restores it.
+				if entry, blocked := c.be.DBs.IsBlocked(torId); blocked {
+					slog.Info("Refusing blocked node", "torid", torId, "source", entry.Source)
+					return false
+				}
+
 				peers, _ := c.be.DBs.GetPeerList()
 				for _, n := range peers {
 					if n == torId {
@@ -304,6 +784,23 @@ func (c *Client) torServer(tc *torutils.TorCon, s *nntpserver.Server) error {
 					slog.Info("Dodgy hacky auth accepted for", "torid", torId)
 					return true
 				}
+				request, err := c.be.DBs.GetPeerRequest(torId)
+				if err == nil && request.Status == databases.PeerRequestBlocked {
+					slog.Info("Refusing blocked node", "torid", torId)
+					return false
+				}
+				// strangers holding an open invite get a restricted session
+				// to redeem it, until they're a peer.
+				if secret, ok := messages.ParseInviteNote(note); ok && c.be.DBs.IsOpenInvite(secret) {
+					slog.Info("Letting in invitee", "torid", torId)
+					invited = true
+					return true
+				}
+				if err := c.be.DBs.AddPeerRequest(torId, note); err != nil {
+					slog.Info("Failed to record peer request", "torid", torId, "error", err)
+				} else {
+					c.be.Events.Publish(events.Event{Type: events.PeerRequest, TorId: torId})
+				}
 				// if clientPubKey == getPeer {
 				// return true
 				// }
@@ -323,6 +820,24 @@ func (c *Client) torServer(tc *torutils.TorCon, s *nntpserver.Server) error {
 				return
 			}
 
+			var sessionConn net.Conn = conn
+			if authed.HasFeature(torutils.FeatureEncryption) {
+				secureConn, err := tc.SecureServer(conn, privkey, authed)
+				if err != nil {
+					slog.Info("SERVER session encryption failed", "error", err)
+					return
+				}
+				sessionConn = secureConn
+			}
+			if authed.HasFeature(torutils.FeatureCompression) {
+				compressConn, err := torutils.Compress(sessionConn)
+				if err != nil {
+					slog.Info("SERVER session compression failed", "error", err)
+					return
+				}
+				sessionConn = compressConn
+			}
+
 			kt := keytool.EasyEdKey{}
 			kt.SetTorPublicKey(clientPubKey)
 			torId, err := kt.TorId()
@@ -334,12 +849,21 @@ func (c *Client) torServer(tc *torutils.TorCon, s *nntpserver.Server) error {
 			clientSession := nntpserver.ClientSession{
 				"Id": torId,
 				//"Id":       torutils.EncodePublicKey(clientPubKey),
-				"PubKey":   string(fmt.Sprintf("%x", clientPubKey)),
-				"ConnMode": nntpbackend.ConnModeTor,
+				"PubKey":         string(fmt.Sprintf("%x", clientPubKey)),
+				"ConnMode":       nntpbackend.ConnModeTor,
+				"Proto":          strconv.Itoa(authed.Proto),
+				"Features":       strings.Join(authed.Features, ","),
+				"MaxArticleSize": strconv.FormatInt(authed.MaxArticleSize, 10),
+				"Software":       authed.Software,
+			}
+			if invited {
+				clientSession["Invited"] = "true"
 			}
 
 			slog.Info("tor connection stuff", "deviceid", c.deviceId, "idgen", idGen)
-			s.Process(conn, clientSession)
+			c.be.Peers.InboundConnection(torId, true)
+			s.Process(sessionConn, clientSession)
+			c.be.Peers.InboundConnection(torId, false)
 			slog.Info("tor disconnection stuff", "deviceid", c.deviceId, "idgen", idGen)
 			/*
 				TODO: fix the client stuff
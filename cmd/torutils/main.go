@@ -10,7 +10,7 @@ import (
 	"github.com/kothawoc/kothawoc/pkg/keytool"
 )
 
-func authCB(s ed25519.PublicKey) bool {
+func authCB(s ed25519.PublicKey, note string) bool {
 	return true
 }
 
@@ -78,7 +78,7 @@ func main() {
 			return
 		}
 
-		authed, err := tc.ClientHandshake(conn, kt, address)
+		authed, err := tc.ClientHandshake(conn, kt, address, "")
 		fmt.Printf("CLIENT Authed response [%v][%v]\n", authed, err)
 		if err != nil {
 			fmt.Printf("CLIENT Error Dialer connect: [%v]\n", err)
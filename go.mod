@@ -12,12 +12,11 @@ require (
 require (
 	github.com/cretz/bine v0.2.0
 	github.com/emersion/go-vcard v0.0.0-20230815062825-8fda7d206ec9
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/net v0.21.0
 )
 
-require (
-	golang.org/x/net v0.21.0 // indirect
-	golang.org/x/sys v0.24.0 // indirect
-)
+require golang.org/x/sys v0.24.0 // indirect
 
 replace github.com/kothawoc/go-nntp => ../go-nntp
 
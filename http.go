@@ -0,0 +1,45 @@
+package kothawoc
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/kothawoc/kothawoc/internal/events"
+)
+
+// httpServer serves the local endpoints for apps on "HTTPAddress", such as
+// 127.0.0.1:1180, it's off unless that's set. Everything needs the APIToken.
+func (c *Client) httpServer() {
+	addr, err := c.be.DBs.ConfigGetString("HTTPAddress")
+	if err != nil || addr == "" {
+		return
+	}
+
+	token, err := c.APIToken()
+	if err != nil {
+		slog.Info("HTTP server not started, no API token", "error", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/events", requireToken(token, events.Handler(c.be.Events)))
+	mux.Handle("/api/", requireToken(token, c.apiHandler()))
+	mux.Handle("/login", webLogin(token))
+	mux.Handle("/", requireToken(token, c.webHandler()))
+
+	slog.Info("HTTP Listening", "address", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Info("HTTP server stopped", "address", addr, "error", err)
+	}
+}
+
+// Subscribe returns a channel of the node's events matching filter, such as
+// new articles, for apps to react to without polling. Stop it with
+// Unsubscribe.
+func (c *Client) Subscribe(filter events.Filter) <-chan events.Event {
+	return c.be.Events.Subscribe(filter)
+}
+
+func (c *Client) Unsubscribe(ch <-chan events.Event) {
+	c.be.Events.Unsubscribe(ch)
+}
@@ -0,0 +1,421 @@
+package databases
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"golang.org/x/crypto/argon2"
+
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// AccountRole is what a local account may do through the TCP listener.
+type AccountRole string
+
+const (
+	// RoleOwner has full rights, including control messages.
+	RoleOwner = AccountRole("owner")
+	// RoleUser can read and post articles.
+	RoleUser = AccountRole("user")
+	// RoleReader can only read.
+	RoleReader = AccountRole("reader")
+)
+
+var ErrInvalidLogin error = errors.New("invalid username or password")
+
+// Account is a person using the node through a newsreader, each has its own
+// identity key so their posts are signed as them, while the node still peers
+// with the device key. The owner posts as the node, with the device key.
+type Account struct {
+	Username string
+	Id       string
+	Role     AccountRole
+	Created  time.Time
+}
+
+// hashPassword is slow and takes 64MiB on purpose, it's never done in the
+// DB goroutine so a login doesn't hold up the node. At most loginHashes are
+// done at once.
+func hashPassword(password string, salt []byte) []byte {
+	hashing <- struct{}{}
+	defer func() { <-hashing }()
+	return argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32)
+}
+
+const loginHashes = 2
+
+var hashing = make(chan struct{}, loginHashes)
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+func validRole(role AccountRole) bool {
+	return role == RoleOwner || role == RoleUser || role == RoleReader
+}
+
+const CmdAddAccount = DatabaseCommand("AddAccount")
+
+func (dbs *BackendDbs) AddAccount(username, password string, role AccountRole) error {
+	if username == "" || password == "" || !validRole(role) {
+		return serr.Errorf("invalid account username[%s] role[%s]", username, role)
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return serr.New(err)
+	}
+
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdAddAccount,
+		Args: []interface{}{username, hashPassword(password, salt), salt, role, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) addAccount(username string, hash, salt []byte, role AccountRole) error {
+	key := keytool.EasyEdKey{}
+	key.GenerateKey()
+	privKey, err := key.TorPrivKey()
+	if err != nil {
+		return serr.New(err)
+	}
+
+	_, err = dbs.config.Exec("INSERT INTO accounts(username,hash,salt,role,key,created) VALUES(?,?,?,?,?,?);",
+		username, hash, salt, role, []byte(privKey), time.Now().Unix())
+	return serr.New(err)
+}
+
+const CmdSetAccountPassword = DatabaseCommand("SetAccountPassword")
+
+func (dbs *BackendDbs) SetAccountPassword(username, password string) error {
+	if password == "" {
+		return serr.Errorf("empty password for %s", username)
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return serr.New(err)
+	}
+
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdSetAccountPassword,
+		Args: []interface{}{username, hashPassword(password, salt), salt, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) setAccountPassword(username string, hash, salt []byte) error {
+	res, err := dbs.config.Exec("UPDATE accounts SET hash=?, salt=? WHERE username=?;",
+		hash, salt, username)
+	if err != nil {
+		return serr.New(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return serr.New(sql.ErrNoRows)
+	}
+	return nil
+}
+
+const CmdDeleteAccount = DatabaseCommand("DeleteAccount")
+
+func (dbs *BackendDbs) DeleteAccount(username string) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdDeleteAccount,
+		Args: []interface{}{username, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) deleteAccount(username string) error {
+	for _, table := range []string{"accounts", "subscriptions", "readmarks"} {
+		if _, err := dbs.config.Exec("DELETE FROM "+table+" WHERE username=?;", username); err != nil {
+			return serr.New(err)
+		}
+	}
+	return nil
+}
+
+const CmdGetAccounts = DatabaseCommand("GetAccounts")
+
+func (dbs *BackendDbs) GetAccounts() ([]Account, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetAccounts,
+		Args: []interface{}{ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].([]Account), nil
+	}
+	return res[0].([]Account), err
+}
+
+func (dbs *backendDbs) getAccounts() ([]Account, error) {
+	ret := []Account{}
+	rows, err := dbs.config.Query("SELECT username,role,key,created FROM accounts ORDER BY username;")
+	if err != nil {
+		return ret, serr.New(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a := Account{}
+		var key []byte
+		var created int64
+		if err := rows.Scan(&a.Username, &a.Role, &key, &created); err != nil {
+			return ret, serr.New(err)
+		}
+		a.Id = accountId(key)
+		a.Created = time.Unix(created, 0)
+		ret = append(ret, a)
+	}
+	return ret, nil
+}
+
+const CmdGetAccountLogin = DatabaseCommand("GetAccountLogin")
+
+// CheckAccount returns the account if the password is right, otherwise
+// ErrInvalidLogin, without saying which part was wrong. The password is
+// hashed here, not in the DB goroutine.
+func (dbs *BackendDbs) CheckAccount(username, password string) (*Account, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetAccountLogin,
+		Args: []interface{}{username, ret},
+	}
+	res := <-ret
+
+	if err, ok := res[3].(error); ok {
+		if errors.Is(err, sql.ErrNoRows) {
+			// hash anyway, so unknown users take as long as wrong passwords.
+			hashPassword(password, make([]byte, 16))
+			return nil, serr.New(ErrInvalidLogin)
+		}
+		return nil, err
+	}
+	a, hash, salt := res[0].(*Account), res[1].([]byte), res[2].([]byte)
+	if subtle.ConstantTimeCompare(hashPassword(password, salt), hash) != 1 {
+		return nil, serr.New(ErrInvalidLogin)
+	}
+	return a, nil
+}
+
+// getAccountLogin returns an account with its password hash and salt.
+func (dbs *backendDbs) getAccountLogin(username string) (*Account, []byte, []byte, error) {
+	a := &Account{}
+	var hash, salt, key []byte
+	var created int64
+
+	row := dbs.config.QueryRow("SELECT username,hash,salt,role,key,created FROM accounts WHERE username=?;", username)
+	if err := row.Scan(&a.Username, &hash, &salt, &a.Role, &key, &created); err != nil {
+		return nil, nil, nil, serr.New(err)
+	}
+	a.Id = accountId(key)
+	a.Created = time.Unix(created, 0)
+	return a, hash, salt, nil
+}
+
+func accountId(key []byte) string {
+	kt := keytool.EasyEdKey{}
+	kt.SetTorPrivateKey(ed25519.PrivateKey(key))
+	torId, _ := kt.TorId()
+	return torId
+}
+
+const CmdGetAccountKey = DatabaseCommand("GetAccountKey")
+
+// GetAccountKey returns the identity key posts from the account are signed
+// with.
+func (dbs *BackendDbs) GetAccountKey(username string) (keytool.EasyEdKey, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetAccountKey,
+		Args: []interface{}{username, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].(keytool.EasyEdKey), nil
+	}
+	return res[0].(keytool.EasyEdKey), err
+}
+
+func (dbs *backendDbs) getAccountKey(username string) (keytool.EasyEdKey, error) {
+	myKey := keytool.EasyEdKey{}
+	var key []byte
+	row := dbs.config.QueryRow("SELECT key FROM accounts WHERE username=?;", username)
+	if err := row.Scan(&key); err != nil {
+		return myKey, serr.New(err)
+	}
+	myKey.SetTorPrivateKey(ed25519.PrivateKey(key))
+	return myKey, nil
+}
+
+const CmdSubscribe = DatabaseCommand("Subscribe")
+
+// Subscribe adds, or with subscribe false removes, a group from the
+// account's subscriptions.
+func (dbs *BackendDbs) Subscribe(username, group string, subscribe bool) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdSubscribe,
+		Args: []interface{}{username, group, subscribe, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) subscribe(username, group string, subscribe bool) error {
+	var err error
+	if subscribe {
+		_, err = dbs.config.Exec("INSERT OR IGNORE INTO subscriptions(username,groupname) VALUES(?,?);", username, group)
+	} else {
+		_, err = dbs.config.Exec("DELETE FROM subscriptions WHERE username=? AND groupname=?;", username, group)
+	}
+	return serr.New(err)
+}
+
+const CmdGetSubscriptions = DatabaseCommand("GetSubscriptions")
+
+func (dbs *BackendDbs) GetSubscriptions(username string) ([]string, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetSubscriptions,
+		Args: []interface{}{username, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].([]string), nil
+	}
+	return res[0].([]string), err
+}
+
+func (dbs *backendDbs) getSubscriptions(username string) ([]string, error) {
+	ret := []string{}
+	rows, err := dbs.config.Query("SELECT groupname FROM subscriptions WHERE username=? ORDER BY groupname;", username)
+	if err != nil {
+		return ret, serr.New(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			return ret, serr.New(err)
+		}
+		ret = append(ret, group)
+	}
+	return ret, nil
+}
+
+const CmdMarkRead = DatabaseCommand("MarkRead")
+
+// MarkRead marks article numbers in a group as read, or unread, for an
+// account.
+func (dbs *BackendDbs) MarkRead(username, group string, numbers []int64, read bool) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdMarkRead,
+		Args: []interface{}{username, group, numbers, read, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) markRead(username, group string, numbers []int64, read bool) error {
+	tx, err := dbs.config.Begin()
+	if err != nil {
+		return serr.New(err)
+	}
+	defer tx.Rollback()
+
+	query := "DELETE FROM readmarks WHERE username=? AND groupname=? AND number=?;"
+	if read {
+		query = "INSERT OR IGNORE INTO readmarks(username,groupname,number) VALUES(?,?,?);"
+	}
+	for _, n := range numbers {
+		if _, err := tx.Exec(query, username, group, n); err != nil {
+			return serr.New(err)
+		}
+	}
+	return serr.New(tx.Commit())
+}
+
+const CmdGetReadMarks = DatabaseCommand("GetReadMarks")
+
+// GetReadMarks returns the article numbers the account has read in a group,
+// in order.
+func (dbs *BackendDbs) GetReadMarks(username, group string) ([]int64, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetReadMarks,
+		Args: []interface{}{username, group, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].([]int64), nil
+	}
+	return res[0].([]int64), err
+}
+
+func (dbs *backendDbs) getReadMarks(username, group string) ([]int64, error) {
+	ret := []int64{}
+	rows, err := dbs.config.Query("SELECT number FROM readmarks WHERE username=? AND groupname=? ORDER BY number;", username, group)
+	if err != nil {
+		return ret, serr.New(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n int64
+		if err := rows.Scan(&n); err != nil {
+			return ret, serr.New(err)
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
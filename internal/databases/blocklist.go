@@ -0,0 +1,239 @@
+package databases
+
+import (
+	"time"
+
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// BlockSourceLocal marks entries the user blocked themselves, the others are
+// from the blocklists of friends we follow, named by their torid.
+const BlockSourceLocal = "local"
+
+type BlockEntry struct {
+	TorId  string
+	Source string
+	Reason string
+	Added  time.Time
+}
+
+const CmdBlock = DatabaseCommand("Block")
+
+func (dbs *BackendDbs) Block(torid, source, reason string) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdBlock,
+		Args: []interface{}{torid, source, reason, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) block(torid, source, reason string) error {
+	_, err := dbs.config.Exec("INSERT OR REPLACE INTO blocklist(torid,source,reason,added) VALUES(?,?,?,?);",
+		torid, source, reason, time.Now().Unix())
+	return serr.New(err)
+}
+
+const CmdUnblock = DatabaseCommand("Unblock")
+
+// Unblock removes the block on torid from source, a local unblock removes it
+// from every source, as the user overrides their friends.
+func (dbs *BackendDbs) Unblock(torid, source string) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdUnblock,
+		Args: []interface{}{torid, source, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) unblock(torid, source string) error {
+	var err error
+	if source == BlockSourceLocal {
+		_, err = dbs.config.Exec("DELETE FROM blocklist WHERE torid=?;", torid)
+	} else {
+		_, err = dbs.config.Exec("DELETE FROM blocklist WHERE torid=? AND source=?;", torid, source)
+	}
+	return serr.New(err)
+}
+
+const CmdIsBlocked = DatabaseCommand("IsBlocked")
+
+// IsBlocked returns the entry of the first blocked torid in torids.
+func (dbs *BackendDbs) IsBlocked(torids ...string) (*BlockEntry, bool) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdIsBlocked,
+		Args: []interface{}{torids, ret},
+	}
+	res := <-ret
+
+	return res[0].(*BlockEntry), res[1].(bool)
+}
+
+func (dbs *backendDbs) isBlocked(torids []string) (*BlockEntry, bool) {
+	for _, torid := range torids {
+		row := dbs.config.QueryRow("SELECT torid,source,reason,added FROM blocklist WHERE torid=? LIMIT 1;", torid)
+		entry, err := scanBlockEntry(row)
+		if err == nil {
+			return &entry, true
+		}
+	}
+	return nil, false
+}
+
+const CmdGetBlocklist = DatabaseCommand("GetBlocklist")
+
+func (dbs *BackendDbs) GetBlocklist() ([]BlockEntry, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetBlocklist,
+		Args: []interface{}{ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].([]BlockEntry), nil
+	}
+	return res[0].([]BlockEntry), err
+}
+
+func scanBlockEntry(row interface{ Scan(...any) error }) (BlockEntry, error) {
+	e := BlockEntry{}
+	var added int64
+	if err := row.Scan(&e.TorId, &e.Source, &e.Reason, &added); err != nil {
+		return e, err
+	}
+	e.Added = time.Unix(added, 0)
+	return e, nil
+}
+
+func (dbs *backendDbs) getBlocklist() ([]BlockEntry, error) {
+	ret := []BlockEntry{}
+	rows, err := dbs.config.Query("SELECT torid,source,reason,added FROM blocklist ORDER BY added DESC;")
+	if err != nil {
+		return ret, serr.New(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanBlockEntry(rows)
+		if err != nil {
+			return ret, serr.New(err)
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+const CmdFollowBlocklist = DatabaseCommand("FollowBlocklist")
+
+// FollowBlocklist sets whether block advisories from torid are applied to
+// our blocklist, unfollowing drops the blocks they gave us.
+func (dbs *BackendDbs) FollowBlocklist(torid string, follow bool) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdFollowBlocklist,
+		Args: []interface{}{torid, follow, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) followBlocklist(torid string, follow bool) error {
+	if follow {
+		_, err := dbs.config.Exec("INSERT OR IGNORE INTO blocklist_follows(torid) VALUES(?);", torid)
+		return serr.New(err)
+	}
+
+	if _, err := dbs.config.Exec("DELETE FROM blocklist_follows WHERE torid=?;", torid); err != nil {
+		return serr.New(err)
+	}
+	_, err := dbs.config.Exec("DELETE FROM blocklist WHERE source=?;", torid)
+	return serr.New(err)
+}
+
+const CmdIsFollowingBlocklist = DatabaseCommand("IsFollowingBlocklist")
+
+func (dbs *BackendDbs) IsFollowingBlocklist(torid string) bool {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdIsFollowingBlocklist,
+		Args: []interface{}{torid, ret},
+	}
+	res := <-ret
+	return res[0].(bool)
+}
+
+func (dbs *backendDbs) isFollowingBlocklist(torid string) bool {
+	var found string
+	row := dbs.config.QueryRow("SELECT torid FROM blocklist_follows WHERE torid=?;", torid)
+	return row.Scan(&found) == nil
+}
+
+const CmdAddHistory = DatabaseCommand("AddHistory")
+
+// AddHistory records why an article was refused, like the INN history file.
+func (dbs *BackendDbs) AddHistory(messageId, sender, reason string) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdAddHistory,
+		Args: []interface{}{messageId, sender, reason, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) addHistory(messageId, sender, reason string) error {
+	_, err := dbs.articles.Exec("INSERT INTO history(messageid,sender,reason,received) VALUES(?,?,?,?);",
+		messageId, sender, reason, time.Now().Unix())
+	return serr.New(err)
+}
+
+const CmdGetHistory = DatabaseCommand("GetHistory")
+
+// GetHistory returns why an article was refused, the latest reason if it was
+// refused more than once.
+func (dbs *BackendDbs) GetHistory(messageId string) (string, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetHistory,
+		Args: []interface{}{messageId, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].(string), nil
+	}
+	return res[0].(string), err
+}
+
+func (dbs *backendDbs) getHistory(messageId string) (string, error) {
+	reason := ""
+	row := dbs.articles.QueryRow("SELECT reason FROM history WHERE messageid=? ORDER BY received DESC, rowid DESC LIMIT 1;", messageId)
+	return reason, serr.New(row.Scan(&reason))
+}
@@ -0,0 +1,33 @@
+package databases
+
+import (
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// Chunks of large objects are kept in articles.db like reactions, in no
+// group, so they're never listed. They're kept for as long as we have them.
+
+const CmdAddChunk = DatabaseCommand("AddChunk")
+
+// AddChunk keeps a stored chunk article.
+func (dbs *BackendDbs) AddChunk(messageId string) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdAddChunk,
+		Args: []interface{}{messageId, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) addChunk(messageId string) error {
+	if _, err := dbs.articles.Exec("UPDATE articles SET refs=refs + 1 WHERE messageid=? AND refs=0;", messageId); err != nil {
+		return serr.New(err)
+	}
+	return nil
+}
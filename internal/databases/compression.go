@@ -0,0 +1,160 @@
+package databases
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// Articles in the store are compressed as set by the StoreCompression config,
+// "zstd" by default, "gzip" or "none". Files are told apart by their magic
+// numbers when read, so changing it leaves older articles readable.
+const (
+	CompressionNone string = "none"
+	CompressionGzip string = "gzip"
+	CompressionZstd string = "zstd"
+
+	DefaultStoreCompression = CompressionZstd
+)
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// storeCompression is the compression new articles are stored with.
+func (dbs *backendDbs) storeCompression() string {
+	compression, err := dbs.configGetString("StoreCompression")
+	switch {
+	case err != nil || compression == "":
+		return DefaultStoreCompression
+	case compression == "deflate":
+		// what gzip used to be called.
+		return CompressionGzip
+	case compression != CompressionNone && compression != CompressionGzip && compression != CompressionZstd:
+		slog.Info("Unknown store compression, using the default", "compression", compression)
+		return DefaultStoreCompression
+	}
+	return compression
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter compresses what's written to w, it must be closed.
+func compressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		return zw, serr.New(err)
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, serr.Errorf("unknown store compression %q", compression)
+}
+
+// articleFile is a stored article being read, the file's closed once it's
+// read to the end or fails.
+type articleFile struct {
+	r      io.Reader
+	f      *os.File
+	zr     *zstd.Decoder
+	closed bool
+}
+
+func (a *articleFile) Read(p []byte) (int, error) {
+	if a.closed {
+		return 0, io.EOF
+	}
+	n, err := a.r.Read(p)
+	if err != nil {
+		a.Close()
+	}
+	return n, err
+}
+
+func (a *articleFile) Close() error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	if a.zr != nil {
+		a.zr.Close()
+	}
+	return a.f.Close()
+}
+
+// openArticleFile reads a stored article as it's decompressed, whatever it
+// was compressed with.
+func openArticleFile(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(len(zstdMagic))
+	a := &articleFile{r: br, f: f}
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			f.Close()
+			return nil, serr.New(err)
+		}
+		a.r, a.zr = zr, zr
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, serr.New(err)
+		}
+		a.r = zr
+	}
+	return a, nil
+}
+
+// readArticleFile reads all of a stored article.
+func readArticleFile(name string) ([]byte, error) {
+	r, err := openArticleFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	return data, serr.New(err)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// addStoreStats adds a stored article's size, before and after compression,
+// to the running totals.
+func (dbs *backendDbs) addStoreStats(raw, stored int64) error {
+	for key, n := range map[string]int64{"StoreBytesRaw": raw, "StoreBytesStored": stored} {
+		if _, err := dbs.config.Exec(`INSERT INTO config (key, val) VALUES (?, ?)
+			ON CONFLICT(key) DO UPDATE SET val=val+excluded.val`, key, n); err != nil {
+			return serr.New(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package databases
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+func testStore(t *testing.T) *backendDbs {
+	dbs := &backendDbs{path: t.TempDir()}
+	if err := os.MkdirAll(filepath.Join(dbs.path, "articles"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openCreateDB(filepath.Join(dbs.path, "config.db"), createConfigDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	dbs.config = db
+	return dbs
+}
+
+func TestStoreCompressionConfig(t *testing.T) {
+	dbs := testStore(t)
+	if c := dbs.storeCompression(); c != DefaultStoreCompression {
+		t.Errorf("unset is %q", c)
+	}
+	for config, expected := range map[string]string{
+		CompressionNone: CompressionNone,
+		CompressionGzip: CompressionGzip,
+		CompressionZstd: CompressionZstd,
+		"deflate":       CompressionGzip,
+		"lz4":           DefaultStoreCompression,
+	} {
+		if err := dbs.configSet("StoreCompression", config); err != nil {
+			t.Fatal(err)
+		}
+		if c := dbs.storeCompression(); c != expected {
+			t.Errorf("%q is %q, expected %q", config, c, expected)
+		}
+	}
+}
+
+// Each compression is stored with its magic number, and read back the same
+// whatever the store is set to now.
+func TestStoreCompression(t *testing.T) {
+	dbs := testStore(t)
+	body := strings.Repeat("A line that compresses well.\r\n", 200)
+
+	for compression, magic := range map[string][]byte{
+		CompressionNone: []byte("Newsgroups"),
+		CompressionGzip: gzipMagic,
+		CompressionZstd: zstdMagic,
+	} {
+		msg := messages.NewMessageTool()
+		msg.Article.Header.Set("Newsgroups", "kothawoc.test")
+		msg.Article.Header.Set("Subject", "stored with "+compression)
+		msg.Preamble = body
+
+		counted := &bodyCounter{}
+		hash, raw, stored, err := dbs.writeArticleFile(msg, compression, counted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compression != CompressionNone && stored >= raw {
+			t.Errorf("%s stored %d of %d bytes", compression, stored, raw)
+		}
+		data, err := os.ReadFile(dbs.articlePath(hash, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, magic) {
+			t.Errorf("%s starts % x", compression, data[:4])
+		}
+
+		// what's counted as it's written is what's counted reading it back.
+		size, lines, err := countArticleBody(dbs.articlePath(hash, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counted.size != int64(size) || counted.lines != int64(lines) {
+			t.Errorf("%s counted %d bytes, %d lines as it was written, %d, %d read", compression, counted.size, counted.lines, size, lines)
+		}
+
+		article, err := dbs.readArticle(0, hash, "", int(counted.size), int(counted.lines))
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(article.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if article.Header.Get("Subject") != "stored with "+compression || string(read) != body {
+			t.Errorf("%s read back wrong, subject %q", compression, article.Header.Get("Subject"))
+		}
+		if article.Bytes != len(body) || article.Lines != 201 {
+			t.Errorf("%s counted %d bytes, %d lines", compression, article.Bytes, article.Lines)
+		}
+
+		// the same content again isn't stored twice.
+		if _, _, stored, err := dbs.writeArticleFile(msg, compression, &bodyCounter{}); err != nil || stored != 0 {
+			t.Errorf("%s stored again, %d bytes, %v", compression, stored, err)
+		}
+	}
+}
+
+func openFiles(t *testing.T) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("can't count open files", err)
+	}
+	return len(fds)
+}
+
+// Reading only an article's headers, as HEAD or STAT do, leaves nothing
+// open, and an article stored before the body's size was recorded has it
+// counted and recorded when it's read.
+func TestReadArticleHeaders(t *testing.T) {
+	dbs, pub := testFsckStore(t)
+	store(t, dbs, pub, "<headers@kothawoc.test>", "")
+
+	before := openFiles(t)
+	for i := 0; i < 20; i++ {
+		if _, err := pub.GetArticleById("<headers@kothawoc.test>"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := openFiles(t); after > before {
+		t.Errorf("%d files left open reading headers", after-before)
+	}
+
+	if _, err := dbs.articles.Exec("UPDATE articles SET bytes=-1,lines=-1;"); err != nil {
+		t.Fatal(err)
+	}
+	article, err := pub.GetArticleById("<headers@kothawoc.test>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(article.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if article.Bytes != len(body) || article.Lines != 2 {
+		t.Errorf("counted %d bytes, %d lines of %q", article.Bytes, article.Lines, body)
+	}
+	var size, lines int
+	if err := dbs.articles.QueryRow("SELECT bytes,lines FROM articles;").Scan(&size, &lines); err != nil {
+		t.Fatal(err)
+	}
+	if size != len(body) || lines != 2 {
+		t.Errorf("recorded %d bytes, %d lines", size, lines)
+	}
+}
+
+// An article whose file can't be written leaves no rows behind, and storing
+// a message id again leaves the stored file alone.
+func TestStoreArticleFailures(t *testing.T) {
+	dbs, pub := testFsckStore(t)
+	name := store(t, dbs, pub, "<stored@kothawoc.test>", "")
+
+	if _, err := pub.StoreArticle(testMessage("<stored@kothawoc.test>")); err == nil {
+		t.Error("stored a message id twice")
+	}
+	if !exists(name) {
+		t.Error("storing a message id twice removed its file")
+	}
+
+	// nothing can be written with a file where the directory was.
+	articles := filepath.Join(dbs.path, "articles")
+	if err := os.Rename(articles, articles+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(articles, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pub.StoreArticle(testMessage("<unwritten@kothawoc.test>")); err == nil {
+		t.Error("stored an article that couldn't be written")
+	}
+	for _, table := range []string{"articles", "timeline", "threads"} {
+		var n int
+		if err := dbs.articles.QueryRow("SELECT COUNT(*) FROM " + table + " WHERE messageid='<unwritten@kothawoc.test>';").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%d %s rows for an article that wasn't written", n, table)
+		}
+	}
+}
@@ -1,14 +1,17 @@
 package databases
 
 import (
+	"bufio"
 	"bytes"
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/mail"
 	"net/textproto"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -46,6 +49,28 @@ CREATE TABLE IF NOT EXISTS peers (
 	pubkey TEXT NOT NULL,
 	name TEXT NOT NULL
 	);
+CREATE TABLE IF NOT EXISTS suggestions (
+	torid TEXT NOT NULL UNIQUE,
+	name TEXT NOT NULL,
+	introducer TEXT NOT NULL,
+	chain TEXT NOT NULL,
+	received INTEGER NOT NULL,
+	status TEXT NOT NULL
+	);
+CREATE TABLE IF NOT EXISTS introductions (
+	torid TEXT NOT NULL,
+	recipient TEXT NOT NULL,
+	name TEXT NOT NULL,
+	sent INTEGER NOT NULL,
+	UNIQUE(torid, recipient)
+	);
+CREATE TABLE IF NOT EXISTS peer_requests (
+	torid TEXT NOT NULL UNIQUE,
+	note TEXT NOT NULL,
+	received INTEGER NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 1,
+	status TEXT NOT NULL
+	);
 `
 
 const createConfigDB string = `
@@ -53,6 +78,45 @@ CREATE TABLE IF NOT EXISTS config (
 	key TEXT NOT NULL UNIQUE,
 	val BLOB
 	);
+CREATE TABLE IF NOT EXISTS invites (
+	secret TEXT NOT NULL UNIQUE,
+	expires INTEGER NOT NULL,
+	read BOOLEAN DEFAULT FALSE,
+	reply BOOLEAN DEFAULT FALSE,
+	post BOOLEAN DEFAULT FALSE,
+	cancel BOOLEAN DEFAULT FALSE,
+	supersede BOOLEAN DEFAULT FALSE,
+	usedby TEXT NOT NULL DEFAULT ""
+	);
+CREATE TABLE IF NOT EXISTS blocklist (
+	torid TEXT NOT NULL,
+	source TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	added INTEGER NOT NULL,
+	UNIQUE(torid, source)
+	);
+CREATE TABLE IF NOT EXISTS blocklist_follows (
+	torid TEXT NOT NULL UNIQUE
+	);
+CREATE TABLE IF NOT EXISTS accounts (
+	username TEXT NOT NULL UNIQUE,
+	hash BLOB NOT NULL,
+	salt BLOB NOT NULL,
+	role TEXT NOT NULL,
+	key BLOB NOT NULL,
+	created INTEGER NOT NULL
+	);
+CREATE TABLE IF NOT EXISTS subscriptions (
+	username TEXT NOT NULL,
+	groupname TEXT NOT NULL,
+	UNIQUE(username, groupname)
+	);
+CREATE TABLE IF NOT EXISTS readmarks (
+	username TEXT NOT NULL,
+	groupname TEXT NOT NULL,
+	number INTEGER NOT NULL,
+	UNIQUE(username, groupname, number)
+	);
 `
 
 const createGroupsDB string = `
@@ -71,11 +135,47 @@ CREATE TABLE IF NOT EXISTS articles (
 	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 	messageid TEXT NOT NULL UNIQUE,
 	signature TEXT NOT NULL,
-	refs INTEGER NOT NULL DEFAULT 0
+	refs INTEGER NOT NULL DEFAULT 0,
+	hash TEXT NOT NULL DEFAULT '',
+	bytes INTEGER NOT NULL DEFAULT -1,
+	lines INTEGER NOT NULL DEFAULT -1
 	);
 INSERT INTO articles(id,messageid,signature,refs)
 	VALUES(?,"DELETEME","1",0);
 DELETE FROM articles WHERE messageID="DELETEME";
+CREATE TABLE IF NOT EXISTS timeline (
+	id INTEGER NOT NULL PRIMARY KEY,
+	messageid TEXT NOT NULL UNIQUE,
+	date INTEGER NOT NULL,
+	sender TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	msgrefs TEXT NOT NULL,
+	newsgroups TEXT NOT NULL,
+	control TEXT NOT NULL,
+	arrived INTEGER NOT NULL
+	);
+CREATE INDEX IF NOT EXISTS timeline_date ON timeline(date);
+CREATE TABLE IF NOT EXISTS threads (
+	messageid TEXT NOT NULL UNIQUE,
+	parent TEXT NOT NULL,
+	root TEXT NOT NULL,
+	present BOOLEAN NOT NULL
+	);
+CREATE INDEX IF NOT EXISTS threads_root ON threads(root);
+CREATE TABLE IF NOT EXISTS reactions (
+	messageid TEXT NOT NULL UNIQUE,
+	sender TEXT NOT NULL,
+	target TEXT NOT NULL,
+	reaction TEXT NOT NULL,
+	UNIQUE(sender, target, reaction)
+	);
+CREATE INDEX IF NOT EXISTS reactions_target ON reactions(target);
+CREATE TABLE IF NOT EXISTS history (
+	messageid TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	received INTEGER NOT NULL
+	);
 `
 
 const createArticleIndexDB string = `
@@ -123,7 +223,19 @@ func openCreateDB(path, sqlQuery string) (*sql.DB, error) {
 }
 
 func NewBackendDbs(path string) (*BackendDbs, error) {
+	dbs, err := openBackendDbs(path)
+	if err != nil {
+		return nil, err
+	}
 
+	dbs.Cmd = make(chan DatabaseMessage, 10)
+	go dbs.dbServer()
+
+	return &BackendDbs{Cmd: dbs.Cmd}, nil
+}
+
+// openBackendDbs opens, or creates, the databases in path.
+func openBackendDbs(path string) (*backendDbs, error) {
 	dbs := &backendDbs{path: path}
 
 	os.MkdirAll(path+"/groups", 0700)
@@ -133,6 +245,9 @@ func NewBackendDbs(path string) (*BackendDbs, error) {
 	if err != nil {
 		return nil, serr.New(err)
 	}
+	if err := migrateArticlesDB(db); err != nil {
+		return nil, err
+	}
 	dbs.articles = db
 
 	db, err = openCreateDB(path+"/config.db", createConfigDB)
@@ -159,10 +274,7 @@ func NewBackendDbs(path string) (*BackendDbs, error) {
 
 	dbs.openGroups()
 
-	dbs.Cmd = make(chan DatabaseMessage, 10)
-	go dbs.dbServer()
-
-	return &BackendDbs{Cmd: dbs.Cmd}, nil
+	return dbs, nil
 }
 
 type DatabaseCommand string
@@ -172,6 +284,13 @@ type DatabaseMessage struct {
 }
 
 func (dbs *backendDbs) dbServer() error {
+	if err := dbs.backfillTimeline(); err != nil {
+		slog.Info("Failed to fill the timeline", "error", err)
+	}
+	if err := dbs.backfillThreads(); err != nil {
+		slog.Info("Failed to fill the threads", "error", err)
+	}
+
 	for {
 		cmd := <-dbs.Cmd
 		//	slog.Info("DB SERVER", "cmd", cmd.Cmd, "args", cmd.Args)
@@ -187,6 +306,12 @@ func (dbs *backendDbs) dbServer() error {
 			ret <- []interface{}{a}
 			close(ret)
 
+		case CmdRemoveGroup: // Args: []interface{}{name, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a := dbs.removeGroup(cmd.Args[0].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
 		case CmdGetArticleBySignature: // Args: []interface{}{signature, ret},
 			ret := cmd.Args[1].(chan []interface{})
 			a, b := dbs.getArticleBySignature(cmd.Args[0].(string))
@@ -283,6 +408,12 @@ func (dbs *backendDbs) dbServer() error {
 			ret <- []interface{}{a, b}
 			close(ret)
 
+		case CmdDeletePeer: // Args: []interface{}{torid, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a := dbs.deletePeer(cmd.Args[0].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
 		case CmdGroupConfigSet: // Args: []interface{}{group, key, val, ret},
 			ret := cmd.Args[3].(chan []interface{})
 			a := dbs.groupConfigSet(cmd.Args[0].(string), cmd.Args[1].(string), cmd.Args[2])
@@ -308,6 +439,294 @@ func (dbs *backendDbs) dbServer() error {
 			ret <- []interface{}{a, b}
 			close(ret)
 
+		case CmdAddPeerRequest: // Args: []interface{}{torid, note, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a := dbs.addPeerRequest(cmd.Args[0].(string), cmd.Args[1].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdGetPeerRequests: // Args: []interface{}{ret},
+			ret := cmd.Args[0].(chan []interface{})
+			a, b := dbs.getPeerRequests()
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdGetPeerRequest: // Args: []interface{}{torid, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b := dbs.getPeerRequest(cmd.Args[0].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdSetPeerRequestStatus: // Args: []interface{}{torid, status, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a := dbs.setPeerRequestStatus(cmd.Args[0].(string), cmd.Args[1].(PeerRequestStatus))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdGroupConfigGetString: // Args: []interface{}{group, key, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a, b := dbs.groupConfigGetString(cmd.Args[0].(string), cmd.Args[1].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdBlock: // Args: []interface{}{torid, source, reason, ret},
+			ret := cmd.Args[3].(chan []interface{})
+			a := dbs.block(cmd.Args[0].(string), cmd.Args[1].(string), cmd.Args[2].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdUnblock: // Args: []interface{}{torid, source, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a := dbs.unblock(cmd.Args[0].(string), cmd.Args[1].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdIsBlocked: // Args: []interface{}{torids, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b := dbs.isBlocked(cmd.Args[0].([]string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdGetBlocklist: // Args: []interface{}{ret},
+			ret := cmd.Args[0].(chan []interface{})
+			a, b := dbs.getBlocklist()
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdFollowBlocklist: // Args: []interface{}{torid, follow, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a := dbs.followBlocklist(cmd.Args[0].(string), cmd.Args[1].(bool))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdIsFollowingBlocklist: // Args: []interface{}{torid, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a := dbs.isFollowingBlocklist(cmd.Args[0].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdAddHistory: // Args: []interface{}{messageid, sender, reason, ret},
+			ret := cmd.Args[3].(chan []interface{})
+			a := dbs.addHistory(cmd.Args[0].(string), cmd.Args[1].(string), cmd.Args[2].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdGetHistory: // Args: []interface{}{messageid, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b := dbs.getHistory(cmd.Args[0].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdAddAccount: // Args: []interface{}{username, hash, salt, role, ret},
+			ret := cmd.Args[4].(chan []interface{})
+			a := dbs.addAccount(cmd.Args[0].(string), cmd.Args[1].([]byte), cmd.Args[2].([]byte), cmd.Args[3].(AccountRole))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdSetAccountPassword: // Args: []interface{}{username, hash, salt, ret},
+			ret := cmd.Args[3].(chan []interface{})
+			a := dbs.setAccountPassword(cmd.Args[0].(string), cmd.Args[1].([]byte), cmd.Args[2].([]byte))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdDeleteAccount: // Args: []interface{}{username, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a := dbs.deleteAccount(cmd.Args[0].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdGetAccounts: // Args: []interface{}{ret},
+			ret := cmd.Args[0].(chan []interface{})
+			a, b := dbs.getAccounts()
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdGetAccountLogin: // Args: []interface{}{username, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b, c, d := dbs.getAccountLogin(cmd.Args[0].(string))
+			ret <- []interface{}{a, b, c, d}
+			close(ret)
+
+		case CmdGetAccountKey: // Args: []interface{}{username, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b := dbs.getAccountKey(cmd.Args[0].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdSubscribe: // Args: []interface{}{username, group, subscribe, ret},
+			ret := cmd.Args[3].(chan []interface{})
+			a := dbs.subscribe(cmd.Args[0].(string), cmd.Args[1].(string), cmd.Args[2].(bool))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdGetSubscriptions: // Args: []interface{}{username, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b := dbs.getSubscriptions(cmd.Args[0].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdMarkRead: // Args: []interface{}{username, group, numbers, read, ret},
+			ret := cmd.Args[4].(chan []interface{})
+			a := dbs.markRead(cmd.Args[0].(string), cmd.Args[1].(string), cmd.Args[2].([]int64), cmd.Args[3].(bool))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdGetReadMarks: // Args: []interface{}{username, group, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a, b := dbs.getReadMarks(cmd.Args[0].(string), cmd.Args[1].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdGetNewsrc: // Args: []interface{}{username, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b := dbs.getNewsrc(cmd.Args[0].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdSetNewsrc: // Args: []interface{}{username, lines, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a := dbs.setNewsrc(cmd.Args[0].(string), cmd.Args[1].([]messages.NewsrcLine))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdGetNewsrcSync: // Args: []interface{}{username, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b := dbs.getNewsrcSync(cmd.Args[0].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdSetNewsrcSync: // Args: []interface{}{username, lines, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a := dbs.setNewsrcSync(cmd.Args[0].(string), cmd.Args[1].([]messages.NewsrcSyncLine))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdSetAccountKey: // Args: []interface{}{username, key, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a := dbs.setAccountKey(cmd.Args[0].(string), cmd.Args[1].(keytool.EasyEdKey))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdTimeline: // Args: []interface{}{session, since, sinceId, limit, groupFilter, ret},
+			ret := cmd.Args[5].(chan []interface{})
+			a, b := dbs.timeline(cmd.Args[0].(map[string]string), cmd.Args[1].(time.Time), cmd.Args[2].(int64), cmd.Args[3].(int), cmd.Args[4].([]string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdThread: // Args: []interface{}{messageId, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b := dbs.thread(cmd.Args[0].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdGroupThreads: // Args: []interface{}{group, page, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a, b := dbs.groupThreads(cmd.Args[0].(string), cmd.Args[1].(int))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdHasReaction: // Args: []interface{}{from, messageId, reaction, ret},
+			ret := cmd.Args[3].(chan []interface{})
+			a := dbs.hasReaction(cmd.Args[0].(string), cmd.Args[1].(string), cmd.Args[2].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdAddReaction: // Args: []interface{}{reactionId, from, messageId, reaction, ret},
+			ret := cmd.Args[4].(chan []interface{})
+			a := dbs.addReaction(cmd.Args[0].(string), cmd.Args[1].(string), cmd.Args[2].(string), cmd.Args[3].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdGetReactions: // Args: []interface{}{messageId, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b := dbs.getReactions(cmd.Args[0].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdGetMyReaction: // Args: []interface{}{from, messageId, reaction, ret},
+			ret := cmd.Args[3].(chan []interface{})
+			a, b := dbs.getMyReaction(cmd.Args[0].(string), cmd.Args[1].(string), cmd.Args[2].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdAddChunk: // Args: []interface{}{messageId, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a := dbs.addChunk(cmd.Args[0].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdFsckScan: // Args: []interface{}{repair, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b := dbs.fsckScan(cmd.Args[0].(bool))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdFsckRepair: // Args: []interface{}{kind, article, arg, ret},
+			ret := cmd.Args[3].(chan []interface{})
+			a := dbs.fsckRepair(cmd.Args[0].(string), cmd.Args[1].(fsckArticle), cmd.Args[2])
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdAddInvite: // Args: []interface{}{secret, expires, perms, ret},
+			ret := cmd.Args[3].(chan []interface{})
+			a := dbs.addInvite(cmd.Args[0].(string), cmd.Args[1].(time.Time), cmd.Args[2].(PermissionsGroupT))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdUseInvite: // Args: []interface{}{secret, torid, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a, b := dbs.useInvite(cmd.Args[0].(string), cmd.Args[1].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdIsOpenInvite: // Args: []interface{}{secret, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a := dbs.isOpenInvite(cmd.Args[0].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdAddSuggestion: // Args: []interface{}{torid, name, introducer, chain, ret},
+			ret := cmd.Args[4].(chan []interface{})
+			a := dbs.addSuggestion(cmd.Args[0].(string), cmd.Args[1].(string), cmd.Args[2].(string), cmd.Args[3].([]string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdGetSuggestions: // Args: []interface{}{ret},
+			ret := cmd.Args[0].(chan []interface{})
+			a, b := dbs.getSuggestions()
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdGetSuggestion: // Args: []interface{}{torid, ret},
+			ret := cmd.Args[1].(chan []interface{})
+			a, b := dbs.getSuggestion(cmd.Args[0].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdSetSuggestionStatus: // Args: []interface{}{torid, status, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a := dbs.setSuggestionStatus(cmd.Args[0].(string), cmd.Args[1].(SuggestionStatus))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdAddIntroduction: // Args: []interface{}{torid, recipient, name, ret},
+			ret := cmd.Args[3].(chan []interface{})
+			a := dbs.addIntroduction(cmd.Args[0].(string), cmd.Args[1].(string), cmd.Args[2].(string))
+			ret <- []interface{}{a}
+			close(ret)
+
+		case CmdGetIntroduction: // Args: []interface{}{torid, recipient, ret},
+			ret := cmd.Args[2].(chan []interface{})
+			a, b := dbs.getIntroduction(cmd.Args[0].(string), cmd.Args[1].(string))
+			ret <- []interface{}{a, b}
+			close(ret)
+
+		case CmdGetLastArticleId: // Args: []interface{}{ret},
+			ret := cmd.Args[0].(chan []interface{})
+			a, b := dbs.getLastArticleId()
+			ret <- []interface{}{a, b}
+			close(ret)
+
 		}
 	}
 }
@@ -464,7 +883,12 @@ func (dbs *backendDbs) newGroup(name, description string, card vcard.Card) error
 		slog.Info("FAILED Upserting group config value", "name", name, "description", description, "error", err, "msg", msg)
 		return serr.New(err)
 	}
-	if msg, err := db.Exec("INSERT OR REPLACE INTO config (key, val) VALUES (?, ?)", "flags", "flags"); err != nil {
+	flags := "flags"
+	moderators, moderated := messages.GetModerated(card)
+	if moderated {
+		flags = "m"
+	}
+	if msg, err := db.Exec("INSERT OR REPLACE INTO config (key, val) VALUES (?, ?)", "flags", flags); err != nil {
 		slog.Info("FAILED Upserting group config value", "name", name, "description", description, "error", err, "msg", msg)
 		return serr.New(err)
 	}
@@ -483,6 +907,35 @@ func (dbs *backendDbs) newGroup(name, description string, card vcard.Card) error
 		}
 	}
 
+	if ttl, size, ok := messages.GetEphemeral(card); ok {
+		subjectOnly := int64(0)
+		if messages.EphemeralSubjectOnly(card) {
+			subjectOnly = 1
+		}
+		for k, v := range map[string]int64{"EphemeralTTL": int64(ttl / time.Second), "EphemeralSize": int64(size), "EphemeralSubjectOnly": subjectOnly} {
+			if msg, err := db.Exec("INSERT OR REPLACE INTO config (key, val) VALUES (?, ?)", k, v); err != nil {
+				slog.Error("FAILED Upserting group config value", "name", name, "key", k, "error", err, "msg", msg)
+				return serr.New(err)
+			}
+		}
+	}
+
+	if moderated {
+		if msg, err := db.Exec("INSERT OR REPLACE INTO config (key, val) VALUES (?, ?)", "Moderators", strings.Join(moderators, ",")); err != nil {
+			slog.Error("FAILED Upserting group config value", "name", name, "key", "Moderators", "error", err, "msg", msg)
+			return serr.New(err)
+		}
+	}
+
+	if policy, ok := messages.GetContentPolicy(card); ok {
+		for k, v := range map[string]interface{}{"ContentTypes": strings.Join(policy.Types, ","), "ContentMaxSize": policy.MaxSize} {
+			if msg, err := db.Exec("INSERT OR REPLACE INTO config (key, val) VALUES (?, ?)", k, v); err != nil {
+				slog.Error("FAILED Upserting group config value", "name", name, "key", k, "error", err, "msg", msg)
+				return serr.New(err)
+			}
+		}
+	}
+
 	slog.Debug("Success NEWGROUP added o do db stuff at", "groupname", name)
 	dbs.groupArticles[name] = db
 	dbs.groupArticlesName2Int[name] = groupId
@@ -491,6 +944,69 @@ func (dbs *backendDbs) newGroup(name, description string, card vcard.Card) error
 	return nil
 }
 
+const CmdRemoveGroup = DatabaseCommand("RemoveGroup")
+
+func (dbs *BackendDbs) RemoveGroup(name string) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdRemoveGroup,
+		Args: []interface{}{name, ret},
+	}
+
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+// removeGroup empties a group and hides it. The group itself stays, so the
+// rmgroup message still reaches the peers allowed to read it, the articles
+// lose a reference but stay in articles.db.
+func (dbs *backendDbs) removeGroup(name string) error {
+	db, ok := dbs.groupArticles[name]
+	if !ok {
+		return serr.Errorf("no such group %s", name)
+	}
+
+	rows, err := db.Query("SELECT messageid FROM articles;")
+	if err != nil {
+		return serr.New(err)
+	}
+	msgIds := []string{}
+	for rows.Next() {
+		var msgId string
+		if err := rows.Scan(&msgId); err != nil {
+			rows.Close()
+			return serr.New(err)
+		}
+		msgIds = append(msgIds, msgId)
+	}
+	rows.Close()
+
+	for _, msgId := range msgIds {
+		if _, err := dbs.articles.Exec("UPDATE articles SET refs=refs - 1 WHERE messageid=?;", msgId); err != nil {
+			return serr.New(err)
+		}
+	}
+	if _, err := db.Exec("DELETE FROM articles;"); err != nil {
+		return serr.New(err)
+	}
+	if _, err := db.Exec("INSERT OR REPLACE INTO config (key, val) VALUES (?, ?)", "Removed", "true"); err != nil {
+		return serr.New(err)
+	}
+
+	slog.Info("Removed group", "name", name, "articles", len(msgIds))
+	return nil
+}
+
+func (dbs *backendDbs) groupRemoved(name string) bool {
+	removed, _ := dbs.groupConfigGetString(name, "Removed")
+	return removed == "true"
+}
+
 const CmdGetArticleBySignature = DatabaseCommand("GetArticleBySignature")
 
 func (dbs *BackendDbs) GetArticleBySignature(signature string) (*nntp.Article, error) {
@@ -509,28 +1025,125 @@ func (dbs *BackendDbs) GetArticleBySignature(signature string) (*nntp.Article, e
 }
 
 func (dbs *backendDbs) getArticleBySignature(signature string) (*nntp.Article, error) {
-
-	message, err := os.ReadFile(dbs.path + "/articles/" + signature)
-	if err != nil {
+	row := dbs.articles.QueryRow("SELECT id,hash,bytes,lines FROM articles WHERE signature=?;", signature)
+	var id int64
+	hash := ""
+	size, lines := 0, 0
+	if err := row.Scan(&id, &hash, &size, &lines); err != nil {
 		slog.Error("GetArticleBySignature", "signature", signature, "error", err)
 		return nil, serr.New(err)
 	}
-	body := (strings.SplitN(string(message), "\r\n\r\n", 2))[1]
-	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	return dbs.readArticle(id, hash, signature, size, lines)
+}
+
+// readArticle opens a stored article by its hash, or signature if it has no
+// hash. Only the headers are read, the body's opened when it's first read
+// and closed at its end, so a big article isn't held in RAM and HEAD or STAT
+// leave nothing open. The body's size is what was counted when it was
+// stored, an article stored before that is counted now, and its row with id
+// updated.
+func (dbs *backendDbs) readArticle(id int64, hash, signature string, size, lines int) (*nntp.Article, error) {
+	name := dbs.articlePath(hash, signature)
+
+	if size < 0 || lines < 0 {
+		var err error
+		size, lines, err = countArticleBody(name)
+		if err != nil {
+			slog.Error("readArticle count body", "signature", signature, "error", err)
+			return nil, err
+		}
+		if _, err := dbs.articles.Exec("UPDATE articles SET bytes=?,lines=? WHERE id=?;", size, lines, id); err != nil {
+			slog.Info("readArticle failed to record the body size", "id", id, "error", err)
+		}
+	}
+	r, err := openArticleFile(name)
 	if err != nil {
-		slog.Error("GetArticleBySignature", "signature", signature, "error", err)
+		slog.Error("readArticle", "signature", signature, "error", err)
+		return nil, err
+	}
+	defer r.Close()
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		slog.Error("readArticle", "signature", signature, "error", err)
 		return nil, serr.New(err)
 	}
 
 	article := &nntp.Article{
 		Header: textproto.MIMEHeader(msg.Header),
-		Body:   msg.Body,
-		Bytes:  len([]byte(body)),
-		Lines:  strings.Count(body, "\n") + 1,
+		Body:   &articleBody{name: name},
+		Bytes:  size,
+		Lines:  lines,
 	}
 	return article, nil
 }
 
+// articleBody is a stored article's body, the file's opened on the first read.
+type articleBody struct {
+	name string
+	r    io.Reader
+	f    io.Closer
+}
+
+func (b *articleBody) Read(p []byte) (int, error) {
+	if b.r == nil {
+		f, err := openArticleFile(b.name)
+		if err != nil {
+			return 0, err
+		}
+		msg, err := mail.ReadMessage(f)
+		if err != nil {
+			f.Close()
+			return 0, serr.New(err)
+		}
+		b.r, b.f = msg.Body, f
+	}
+	return b.r.Read(p)
+}
+
+// Close closes the file if the body wasn't read to its end.
+func (b *articleBody) Close() error {
+	if b.f == nil {
+		return nil
+	}
+	return b.f.Close()
+}
+
+// countArticleBody counts the bytes and lines of a stored article's body,
+// what's after the first blank line.
+func countArticleBody(name string) (int, int, error) {
+	r, err := openArticleFile(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			return 0, 1, nil
+		}
+		if err != nil {
+			return 0, 0, serr.New(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	size, lines := 0, 1
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := br.Read(buf)
+		size += n
+		lines += bytes.Count(buf[:n], []byte("\n"))
+		if err == io.EOF {
+			return size, lines, nil
+		}
+		if err != nil {
+			return 0, 0, serr.New(err)
+		}
+	}
+}
+
 const CmdGetArticleById = DatabaseCommand("GetArticleById")
 
 func (dbs *BackendDbs) GetArticleById(msgId string) (*nntp.Article, error) {
@@ -544,10 +1157,10 @@ func (dbs *BackendDbs) GetArticleById(msgId string) (*nntp.Article, error) {
 
 	err, ok := res[1].(error)
 	if !ok {
-		return res[0].(*nntp.Article), err
+		return res[0].(*nntp.Article), nil
 	}
 
-	return res[0].(*nntp.Article), nil
+	return res[0].(*nntp.Article), err
 }
 
 func (dbs *backendDbs) getArticleById(msgId string) (*nntp.Article, error) {
@@ -556,22 +1169,24 @@ func (dbs *backendDbs) getArticleById(msgId string) (*nntp.Article, error) {
 	query := ""
 	// if the id is an int, get the message id
 	if _, err := strconv.ParseInt(msgId, 10, 64); err == nil {
-		query = "SELECT id, messageid, signature FROM articles WHERE id=?"
+		query = "SELECT id, messageid, signature, hash, bytes, lines FROM articles WHERE id=?"
 	} else {
-		query = "SELECT id, messageid, signature FROM articles WHERE messageid=?"
+		query = "SELECT id, messageid, signature, hash, bytes, lines FROM articles WHERE messageid=?"
 	}
 	row := dbs.articles.QueryRow(query, msgId)
 
 	id := int64(0)
 	messageid := ""
 	signature := ""
-	err := row.Scan(&id, &messageid, &signature)
+	hash := ""
+	size, lines := 0, 0
+	err := row.Scan(&id, &messageid, &signature, &hash, &size, &lines)
 	if err != nil {
 		slog.Error("GetArticleById Failed to open article final row scan", "msgId", msgId, "error", err)
 		return nil, serr.New(nntpserver.ErrInvalidArticleNumber)
 	}
 
-	article, err := dbs.getArticleBySignature(signature)
+	article, err := dbs.readArticle(id, hash, signature, size, lines)
 	if err != nil {
 		slog.Error("GetArticleById Failed to get article by signature", "msgId", msgId, "signature", signature, "error", err)
 		return nil, serr.New(nntpserver.ErrInvalidArticleNumber)
@@ -625,12 +1240,22 @@ func (dbs *backendDbs) cancelMessage(from, msgId, newsgroups string, cmf message
 		return serr.Errorf("Cancel message from doesn't match article cancelMsg[%v] article[%v]", from, article.Header.Get("From"))
 	}
 
-	signature := article.Header.Get(messages.SignatureHeader)
+	signature := messages.Signature(article.Header)
+	hash := ""
+	if err := dbs.articles.QueryRow("SELECT hash FROM articles WHERE messageid=?;", msgId).Scan(&hash); err != nil {
+		return serr.New(err)
+	}
 	msgGroups := strings.Split(article.Header.Get("Newsgroups"), ",")
 	delGroups := strings.Split(newsgroups, ",")
 
 	slog.Info("CancelMessage", "msgGroups", msgGroups)
 
+	if strings.HasPrefix(article.Header.Get("Control"), "react ") {
+		if err := dbs.removeReaction(msgId); err != nil {
+			return err
+		}
+	}
+
 	for _, grp := range delGroups {
 		// if the message is actually in the group that they want to delete
 		if containsStr(msgGroups, grp) {
@@ -676,13 +1301,20 @@ func (dbs *backendDbs) cancelMessage(from, msgId, newsgroups string, cmf message
 
 			if refs == 0 {
 				// delete the article off disc
-				err := os.Remove(dbs.path + "/articles/" + signature)
+				err := dbs.removeArticleFile(msgId, hash, signature)
 				if err != nil {
 					slog.Info("CancelMessage", "Error", err, "msgId", msgId, "signature", signature)
 					return serr.New(err)
 				}
 
-				_, err = dbs.articles.Exec("DELETE articles WHERE messageid=?;", msgId)
+				if err := dbs.unindexArticle(msgId); err != nil {
+					return err
+				}
+				if err := dbs.unthreadArticle(msgId); err != nil {
+					return err
+				}
+
+				_, err = dbs.articles.Exec("DELETE FROM articles WHERE messageid=?;", msgId)
 				if err != nil {
 					slog.Info("CancelMessage: Delete from main DB Error", "Error", err, "msgId", msgId, "signature", signature)
 					return serr.New(err)
@@ -897,6 +1529,10 @@ func (dbs *backendDbs) listGroups(session map[string]string) (<-chan *nntp.Group
 				continue
 			}
 
+			if dbs.groupRemoved(name) {
+				continue
+			}
+
 			grp, err := dbs.getGroup(session, name)
 
 			if err != nil {
@@ -941,6 +1577,10 @@ func (dbs *backendDbs) getGroup(session map[string]string, groupName string) (*n
 		return nil, nntpserver.ErrNoSuchGroup
 	}
 
+	if dbs.groupRemoved(groupName) {
+		return nil, nntpserver.ErrNoSuchGroup
+	}
+
 	if articles, ok := dbs.groupArticles[groupName]; ok {
 
 		row := articles.QueryRow("SELECT val FROM config WHERE key=\"description\"")
@@ -1101,16 +1741,31 @@ func (dbs *backendDbs) storeArticle(msg *messages.MessageTool) (int64, error) {
 
 	article := msg.Article
 
-	signature := article.Header.Get(messages.SignatureHeader)
+	signature := messages.Signature(article.Header)
 	messageId := article.Header.Get("Message-Id")
-	insert := `INSERT INTO articles(messageid,signature,refs) VALUES(?,?,?);`
 
-	res, err := dbs.articles.Exec(insert, messageId, signature, 0)
+	// the file's written first, so no row points at an article that isn't
+	// there.
+	body := &bodyCounter{}
+	hash, raw, stored, err := dbs.writeArticleFile(msg, dbs.storeCompression(), body)
+	if err != nil {
+		slog.Info("Error writing file Ouch def Error insert article to do db stuff at", "error", err, "messageId", messageId)
+		return 0, err
+	}
+
+	insert := `INSERT INTO articles(messageid,signature,refs,hash,bytes,lines) VALUES(?,?,?,?,?,?);`
+	res, err := dbs.articles.Exec(insert, messageId, signature, 0, hash, body.size, body.lines)
 	if err != nil {
-		slog.Info("Ouch abc Error insert article to do db stuff at", "error", err, "messageId", article.Header.Get("Message-Id"))
+		slog.Info("Ouch abc Error insert article to do db stuff at", "error", err, "messageId", messageId)
+		// only a file this wrote, the same content may be stored already.
+		if raw > 0 {
+			if err := os.Remove(dbs.articlePath(hash, "")); err != nil {
+				slog.Info("Error removing the unstored article's file", "error", err, "messageId", messageId)
+			}
+		}
 		return 0, serr.New(err)
 	} else {
-		slog.Info("SUCCESS  insert article to do db stuff at", "error", err, "messageId", article.Header.Get("Message-Id"))
+		slog.Info("SUCCESS  insert article to do db stuff at", "error", err, "messageId", messageId)
 
 	}
 
@@ -1122,11 +1777,14 @@ func (dbs *backendDbs) storeArticle(msg *messages.MessageTool) (int64, error) {
 
 	slog.Info("Last inserted rowid to do db stuff at ", "articleId", articleId)
 
-	err = os.WriteFile(dbs.path+"/articles/"+signature, []byte(msg.RawMail()), 0600)
-
-	if err != nil {
-		slog.Info("Error writing file Ouch def Error insert article to do db stuff at", "error", err, "messageId", article.Header.Get("Message-Id"))
-		return 0, err
+	if err := dbs.indexArticle(articleId, msg); err != nil {
+		slog.Info("Error adding article to the timeline", "error", err, "messageId", messageId)
+	}
+	if err := dbs.threadArticle(msg); err != nil {
+		slog.Info("Error adding article to its thread", "error", err, "messageId", messageId)
+	}
+	if err := dbs.addStoreStats(raw, stored); err != nil {
+		slog.Info("Error adding to store stats", "error", err)
 	}
 
 	return articleId, nil
@@ -1269,12 +1927,13 @@ func (dbs *BackendDbs) GetPeerList() ([]string, error) {
 	return res[0].([]string), err
 }
 
+// getPeerList leaves out blocked peers, so they're neither dialled nor let
+// in, until they're unblocked.
 func (dbs *backendDbs) getPeerList() ([]string, error) {
 
 	ret := []string{}
 	rows, err := dbs.peers.Query("SELECT torid FROM peers;")
 	if err != nil {
-		rows.Close()
 		return nil, serr.New(err)
 	}
 	for rows.Next() {
@@ -1286,11 +1945,40 @@ func (dbs *backendDbs) getPeerList() ([]string, error) {
 		}
 		ret = append(ret, torid)
 	}
+	rows.Close()
 
-	return ret, nil
+	return slices.DeleteFunc(ret, func(torid string) bool {
+		_, blocked := dbs.isBlocked([]string{torid})
+		return blocked
+	}), nil
 
 }
 
+const CmdDeletePeer = DatabaseCommand("DeletePeer")
+
+// DeletePeer forgets a peer, so it's not connected to again on restart.
+func (dbs *BackendDbs) DeletePeer(torId string) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdDeletePeer,
+		Args: []interface{}{torId, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) deletePeer(torId string) error {
+	if _, err := dbs.peers.Exec("DELETE FROM peers WHERE torid=?;", torId); err != nil {
+		return serr.New(err)
+	}
+	return nil
+}
+
 const CmdGroupConfigSet = DatabaseCommand("GroupConfigSet")
 
 func (dbs *BackendDbs) GroupConfigSet(group, key string, val interface{}) error {
@@ -1338,6 +2026,9 @@ func (dbs *BackendDbs) GroupConfigGetInt64(group, key string) (int64, error) {
 	return res[0].(int64), err
 }
 func (dbs *backendDbs) groupConfigGetInt64(group, key string) (int64, error) {
+	if _, ok := dbs.groupArticles[group]; !ok {
+		return 0, serr.Errorf("no such group %s", group)
+	}
 	row := dbs.groupArticles[group].QueryRow("SELECT val FROM config WHERE key=?", key)
 	val := int64(0)
 	if err := row.Scan(&val); err != nil {
@@ -1346,6 +2037,36 @@ func (dbs *backendDbs) groupConfigGetInt64(group, key string) (int64, error) {
 	return val, nil
 }
 
+const CmdGroupConfigGetString = DatabaseCommand("GroupConfigGetString")
+
+func (dbs *BackendDbs) GroupConfigGetString(group, key string) (string, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGroupConfigGetString,
+		Args: []interface{}{group, key, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].(string), nil
+	}
+	return res[0].(string), err
+}
+
+func (dbs *backendDbs) groupConfigGetString(group, key string) (string, error) {
+	db, ok := dbs.groupArticles[group]
+	if !ok {
+		return "", serr.Errorf("no such group %s", group)
+	}
+	row := db.QueryRow("SELECT val FROM config WHERE key=?", key)
+	val := ""
+	if err := row.Scan(&val); err != nil {
+		return val, serr.New(err)
+	}
+	return val, nil
+}
+
 const CmdGroupUpdateSubscriptions = DatabaseCommand("GroupUpdateSubscriptions")
 
 func (dbs *BackendDbs) GroupUpdateSubscriptions(group string, list []string) error {
@@ -1422,3 +2143,30 @@ func (dbs *backendDbs) getNextArticle(lastMessage int64) (*nntpserver.NumberedAr
 	return art, nil
 
 }
+
+const CmdGetLastArticleId = DatabaseCommand("GetLastArticleId")
+
+func (dbs *BackendDbs) GetLastArticleId() (int64, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetLastArticleId,
+		Args: []interface{}{ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].(int64), err
+	}
+
+	return res[0].(int64), err
+}
+
+func (dbs *backendDbs) getLastArticleId() (int64, error) {
+	row := dbs.articles.QueryRow("SELECT COALESCE(MAX(id), 0) FROM articles;")
+	id := int64(0)
+	if err := row.Scan(&id); err != nil {
+		return 0, serr.New(err)
+	}
+	return id, nil
+}
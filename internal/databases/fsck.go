@@ -0,0 +1,407 @@
+package databases
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// Fsck cross checks articles.db, the group indexes and the article files.
+// An article's refs count the groups it's in, plus one if it's a reaction or
+// a chunk. With repair it fixes what it finds:
+//
+//   - group index entries for articles that aren't in articles.db are removed;
+//   - refs that don't match are set;
+//   - articles with a missing or corrupt file are removed, like a cancel;
+//   - articles nothing refers to, and files no article refers to, are
+//     removed, once older than fsckGrace so articles being posted are left;
+//   - articles still stored by signature are moved to their hash.
+//
+// The databases are read in one go in the DB goroutine, then the files are
+// hashed, as they're read, and walked outside it so the node carries on
+// meanwhile. Each repair is sent back to the DB goroutine, and only made if
+// the article or file is still as it was when it was checked.
+
+// fsckGrace is how old an unreferenced article or file must be to be removed.
+const fsckGrace = time.Hour
+
+// Kinds of problem found by Fsck.
+const (
+	FsckDanglingIndex string = "dangling-index"
+	FsckWrongRefs     string = "wrong-refs"
+	FsckMissingFile   string = "missing-file"
+	FsckCorruptFile   string = "corrupt-file"
+	FsckUnreferenced  string = "unreferenced"
+	FsckOrphanFile    string = "orphan-file"
+	FsckLegacyFile    string = "legacy-file"
+)
+
+type FsckProblem struct {
+	Kind      string `json:"kind"`
+	MessageId string `json:"messageid,omitempty"`
+	Group     string `json:"group,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	Repaired  bool   `json:"repaired"`
+}
+
+type FsckReport struct {
+	Articles int           `json:"articles"`
+	Files    int           `json:"files"`
+	Repair   bool          `json:"repair"`
+	Problems []FsckProblem `json:"problems"`
+}
+
+const (
+	CmdFsckScan   = DatabaseCommand("FsckScan")
+	CmdFsckRepair = DatabaseCommand("FsckRepair")
+)
+
+// Fsck checks the store, and repairs it if repair is set.
+func (dbs *BackendDbs) Fsck(repair bool) (FsckReport, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdFsckScan,
+		Args: []interface{}{repair, ret},
+	}
+	res := <-ret
+
+	scan := res[0].(fsckScan)
+	if err, ok := res[1].(error); ok {
+		return scan.report, err
+	}
+	return dbs.fsckFiles(scan, repair)
+}
+
+// fsckRepair repairs a problem found by Fsck, arg is the new refs, the new
+// hash, or the orphan file's name.
+func (dbs *BackendDbs) fsckRepair(kind string, a fsckArticle, arg interface{}) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdFsckRepair,
+		Args: []interface{}{kind, a, arg, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+type fsckArticle struct {
+	id                         int64
+	messageId, signature, hash string
+	refs                       int64
+	// groups are the groups it's in, expected the refs it should have.
+	groups   []string
+	expected int64
+}
+
+// fsckScan is what's read from the databases for the files to be checked
+// against.
+type fsckScan struct {
+	report      FsckReport
+	path        string
+	compression string
+	articles    []fsckArticle
+}
+
+// fsckScan reads the articles and the groups they're in, and removes group
+// index entries for articles that aren't in articles.db.
+func (dbs *backendDbs) fsckScan(repair bool) (fsckScan, error) {
+	scan := fsckScan{
+		report:      FsckReport{Repair: repair, Problems: []FsckProblem{}},
+		path:        dbs.path,
+		compression: dbs.storeCompression(),
+	}
+
+	articles := map[string]int{}
+	rows, err := dbs.articles.Query("SELECT id,messageid,signature,refs,hash FROM articles ORDER BY id;")
+	if err != nil {
+		return scan, serr.New(err)
+	}
+	for rows.Next() {
+		a := fsckArticle{}
+		if err := rows.Scan(&a.id, &a.messageId, &a.signature, &a.refs, &a.hash); err != nil {
+			rows.Close()
+			return scan, serr.New(err)
+		}
+		articles[a.messageId] = len(scan.articles)
+		scan.articles = append(scan.articles, a)
+	}
+	rows.Close()
+	scan.report.Articles = len(scan.articles)
+
+	reactions := map[string]bool{}
+	rows, err = dbs.articles.Query("SELECT messageid FROM reactions;")
+	if err != nil {
+		return scan, serr.New(err)
+	}
+	for rows.Next() {
+		var messageId string
+		if err := rows.Scan(&messageId); err != nil {
+			rows.Close()
+			return scan, serr.New(err)
+		}
+		reactions[messageId] = true
+	}
+	rows.Close()
+
+	for group, db := range dbs.groupArticles {
+		type entry struct {
+			id        int64
+			messageId string
+		}
+		entries := []entry{}
+		rows, err := db.Query("SELECT id,messageid FROM articles;")
+		if err != nil {
+			return scan, serr.New(err)
+		}
+		for rows.Next() {
+			e := entry{}
+			if err := rows.Scan(&e.id, &e.messageId); err != nil {
+				rows.Close()
+				return scan, serr.New(err)
+			}
+			entries = append(entries, e)
+		}
+		rows.Close()
+
+		for _, e := range entries {
+			if i, ok := articles[e.messageId]; ok && scan.articles[i].id == e.id {
+				scan.articles[i].groups = append(scan.articles[i].groups, group)
+				continue
+			}
+			p := FsckProblem{Kind: FsckDanglingIndex, MessageId: e.messageId, Group: group}
+			if repair {
+				if _, err := db.Exec("DELETE FROM articles WHERE messageid=?;", e.messageId); err != nil {
+					slog.Info("Fsck failed to repair", "kind", p.Kind, "messageId", p.MessageId, "error", err)
+				} else {
+					p.Repaired = true
+				}
+			}
+			scan.report.Problems = append(scan.report.Problems, p)
+		}
+	}
+
+	for i, a := range scan.articles {
+		scan.articles[i].expected = int64(len(a.groups))
+		if reactions[a.messageId] || strings.HasSuffix(a.messageId, "@chunk.kothawoc>") {
+			scan.articles[i].expected++
+		}
+	}
+	return scan, nil
+}
+
+// hashArticleFile is the hash of a stored article's content, read as it's
+// decompressed.
+func hashArticleFile(name string) (string, error) {
+	r, err := openArticleFile(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, r); err != nil {
+		return "", serr.New(err)
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// fsckFiles checks the files against the scan, outside the DB goroutine.
+func (dbs *BackendDbs) fsckFiles(scan fsckScan, repair bool) (FsckReport, error) {
+	report := scan.report
+	problem := func(p FsckProblem, fix func() error) {
+		if repair && fix != nil {
+			if err := fix(); err != nil {
+				slog.Info("Fsck failed to repair", "kind", p.Kind, "messageId", p.MessageId, "path", p.Path, "error", err)
+			} else {
+				p.Repaired = true
+			}
+		}
+		report.Problems = append(report.Problems, p)
+	}
+	// the file helpers only use the path, the databases are only touched in
+	// the DB goroutine.
+	files := &backendDbs{path: scan.path}
+
+	referenced := map[string]bool{}
+	for _, a := range scan.articles {
+		remove := func(kind string) func() error {
+			return func() error { return dbs.fsckRepair(kind, a, nil) }
+		}
+		name := files.articlePath(a.hash, a.signature)
+		// any problem with the file is the article's, it's not an orphan too.
+		referenced[name] = true
+		info, err := os.Stat(name)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			problem(FsckProblem{Kind: FsckMissingFile, MessageId: a.messageId, Path: name}, remove(FsckMissingFile))
+			continue
+		case err != nil:
+			problem(FsckProblem{Kind: FsckCorruptFile, MessageId: a.messageId, Path: name, Detail: err.Error()}, nil)
+			continue
+		}
+		hash, err := hashArticleFile(name)
+		if err != nil {
+			problem(FsckProblem{Kind: FsckCorruptFile, MessageId: a.messageId, Path: name, Detail: err.Error()}, remove(FsckCorruptFile))
+			continue
+		}
+		if a.hash != "" && hash != a.hash {
+			problem(FsckProblem{Kind: FsckCorruptFile, MessageId: a.messageId, Path: name, Detail: "content doesn't match its hash"}, remove(FsckCorruptFile))
+			continue
+		}
+
+		if a.expected == 0 {
+			if time.Since(info.ModTime()) < fsckGrace {
+				continue
+			}
+			problem(FsckProblem{Kind: FsckUnreferenced, MessageId: a.messageId, Path: name}, remove(FsckUnreferenced))
+			continue
+		}
+		if a.refs != a.expected {
+			problem(FsckProblem{Kind: FsckWrongRefs, MessageId: a.messageId, Detail: fmt.Sprintf("refs %d, expected %d", a.refs, a.expected)}, func() error {
+				return dbs.fsckRepair(FsckWrongRefs, a, a.expected)
+			})
+		}
+
+		if a.hash == "" {
+			problem(FsckProblem{Kind: FsckLegacyFile, MessageId: a.messageId, Path: name}, func() error {
+				hash, _, _, err := files.writeStoreFile(func(w io.Writer) error {
+					r, err := openArticleFile(name)
+					if err != nil {
+						return err
+					}
+					defer r.Close()
+					_, err = io.Copy(w, r)
+					return serr.New(err)
+				}, scan.compression)
+				if err != nil {
+					return err
+				}
+				referenced[files.articlePath(hash, "")] = true
+				return dbs.fsckRepair(FsckLegacyFile, a, hash)
+			})
+		}
+	}
+
+	err := filepath.WalkDir(filepath.Join(scan.path, "articles"), func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		report.Files++
+		if referenced[name] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) < fsckGrace {
+			return nil
+		}
+		problem(FsckProblem{Kind: FsckOrphanFile, Path: name}, func() error {
+			return dbs.fsckRepair(FsckOrphanFile, fsckArticle{}, name)
+		})
+		return nil
+	})
+	if err != nil {
+		return report, serr.New(err)
+	}
+
+	slog.Info("Fsck done", "repair", repair, "articles", report.Articles, "files", report.Files, "problems", len(report.Problems))
+	return report, nil
+}
+
+// fsckRepair makes a repair, if the article is as it was when it was checked.
+func (dbs *backendDbs) fsckRepair(kind string, a fsckArticle, arg interface{}) error {
+	if kind == FsckOrphanFile {
+		return dbs.fsckRemoveOrphan(arg.(string))
+	}
+
+	var refs int64
+	var hash string
+	row := dbs.articles.QueryRow("SELECT refs,hash FROM articles WHERE id=? AND messageid=?;", a.id, a.messageId)
+	if err := row.Scan(&refs, &hash); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return serr.New(err)
+	} else if err != nil || refs != a.refs || hash != a.hash {
+		return serr.Errorf("%s changed since it was checked", a.messageId)
+	}
+
+	switch kind {
+	case FsckWrongRefs:
+		_, err := dbs.articles.Exec("UPDATE articles SET refs=? WHERE id=?;", arg.(int64), a.id)
+		return serr.New(err)
+	case FsckLegacyFile:
+		if _, err := dbs.articles.Exec("UPDATE articles SET hash=? WHERE id=?;", arg.(string), a.id); err != nil {
+			return serr.New(err)
+		}
+		if err := os.Remove(dbs.articlePath("", a.signature)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return serr.New(err)
+		}
+		return nil
+	}
+	return dbs.fsckRemoveArticle(a)
+}
+
+// fsckRemoveArticle removes an article from its groups and articles.db, and
+// its file.
+func (dbs *backendDbs) fsckRemoveArticle(a fsckArticle) error {
+	for _, group := range a.groups {
+		if _, err := dbs.groupArticles[group].Exec("DELETE FROM articles WHERE messageid=?;", a.messageId); err != nil {
+			return serr.New(err)
+		}
+	}
+	if err := dbs.unindexArticle(a.messageId); err != nil {
+		return err
+	}
+	if err := dbs.unthreadArticle(a.messageId); err != nil {
+		return err
+	}
+	if err := dbs.removeReaction(a.messageId); err != nil {
+		return err
+	}
+	if err := dbs.removeArticleFile(a.messageId, a.hash, a.signature); err != nil {
+		return err
+	}
+	if _, err := dbs.articles.Exec("DELETE FROM articles WHERE id=?;", a.id); err != nil {
+		return serr.New(err)
+	}
+	return nil
+}
+
+// fsckRemoveOrphan removes a file no article refers to, unless one has
+// since been stored with the same content.
+func (dbs *backendDbs) fsckRemoveOrphan(name string) error {
+	var n int
+	var row *sql.Row
+	if filepath.Dir(name) == filepath.Join(dbs.path, "articles") {
+		// stored by signature, or a temporary file.
+		row = dbs.articles.QueryRow("SELECT COUNT(*) FROM articles WHERE signature=? AND hash='';", filepath.Base(name))
+	} else {
+		row = dbs.articles.QueryRow("SELECT COUNT(*) FROM articles WHERE hash=?;", filepath.Base(name))
+	}
+	if err := row.Scan(&n); err != nil {
+		return serr.New(err)
+	}
+	if n > 0 {
+		return serr.Errorf("%s is in use since it was checked", name)
+	}
+	return serr.New(os.Remove(name))
+}
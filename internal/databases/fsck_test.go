@@ -0,0 +1,198 @@
+package databases
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-vcard"
+
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+// testFsckStore is a running store, with its internals for the test to break.
+func testFsckStore(t *testing.T) (*backendDbs, *BackendDbs) {
+	path := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(path, "articles"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	dbs, err := openBackendDbs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbs.Cmd = make(chan DatabaseMessage, 10)
+	go dbs.dbServer()
+	return dbs, &BackendDbs{Cmd: dbs.Cmd}
+}
+
+func testMessage(messageId string) *messages.MessageTool {
+	msg := messages.NewMessageTool()
+	msg.Article.Header.Set("Message-Id", messageId)
+	msg.Article.Header.Set("Newsgroups", "kothawoc.test")
+	msg.Preamble = "The article " + messageId + ".\r\n"
+	return msg
+}
+
+// store adds an article, to group unless it's "".
+func store(t *testing.T, dbs *backendDbs, pub *BackendDbs, messageId, group string) string {
+	id, err := pub.StoreArticle(testMessage(messageId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group != "" {
+		if err := pub.AddArticleToGroup(group, messageId, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var hash string
+	if err := dbs.articles.QueryRow("SELECT hash FROM articles WHERE id=?;", id).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	return dbs.articlePath(hash, "")
+}
+
+func age(t *testing.T, name string) {
+	old := time.Now().Add(-2 * fsckGrace)
+	if err := os.Chtimes(name, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func TestFsckRepair(t *testing.T) {
+	dbs, pub := testFsckStore(t)
+	const group = "kothawoc.test"
+	if err := pub.NewGroup(group, "fsck", vcard.Card{}); err != nil {
+		t.Fatal(err)
+	}
+
+	good := store(t, dbs, pub, "<good@kothawoc.test>", group)
+	age(t, good)
+
+	// stored by signature, as before the store was content addressed.
+	legacy := store(t, dbs, pub, "<legacy@kothawoc.test>", group)
+	legacySig := filepath.Join(dbs.path, "articles", "LEGACYSIGNATURE")
+	if err := os.Rename(legacy, legacySig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbs.articles.Exec("UPDATE articles SET hash='', signature='LEGACYSIGNATURE' WHERE messageid='<legacy@kothawoc.test>';"); err != nil {
+		t.Fatal(err)
+	}
+
+	unreferenced := store(t, dbs, pub, "<unreferenced@kothawoc.test>", "")
+	age(t, unreferenced)
+	// within the grace window, it may still be being posted.
+	posting := store(t, dbs, pub, "<posting@kothawoc.test>", "")
+
+	store(t, dbs, pub, "<refs@kothawoc.test>", group)
+	if _, err := dbs.articles.Exec("UPDATE articles SET refs=5 WHERE messageid='<refs@kothawoc.test>';"); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := store(t, dbs, pub, "<missing@kothawoc.test>", group)
+	os.Remove(missing)
+	corrupt := store(t, dbs, pub, "<corrupt@kothawoc.test>", group)
+	if err := os.WriteFile(corrupt, []byte("not the article"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbs.groupArticles[group].Exec("INSERT INTO articles(id,messageid) VALUES(999,'<dangling@kothawoc.test>');"); err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := filepath.Join(dbs.path, "articles", "ab", "cd", "abcdef")
+	newOrphan := filepath.Join(dbs.path, "articles", "ab", "cd", "abcdeg")
+	os.MkdirAll(filepath.Dir(orphan), 0700)
+	for _, name := range []string{orphan, newOrphan} {
+		if err := os.WriteFile(name, []byte("orphan"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	age(t, orphan)
+
+	expected := map[string]bool{
+		FsckLegacyFile + " <legacy@kothawoc.test>":         true,
+		FsckUnreferenced + " <unreferenced@kothawoc.test>": true,
+		FsckWrongRefs + " <refs@kothawoc.test>":            true,
+		FsckMissingFile + " <missing@kothawoc.test>":       true,
+		FsckCorruptFile + " <corrupt@kothawoc.test>":       true,
+		FsckDanglingIndex + " <dangling@kothawoc.test>":    true,
+		FsckOrphanFile + " " + orphan:                      true,
+	}
+	check := func(report FsckReport, repaired bool) {
+		found := map[string]bool{}
+		for _, p := range report.Problems {
+			key := p.Kind + " " + p.MessageId
+			if p.Kind == FsckOrphanFile {
+				key = p.Kind + " " + p.Path
+			}
+			if !expected[key] {
+				t.Errorf("unexpected problem %+v", p)
+			}
+			if p.Repaired != repaired {
+				t.Errorf("%s repaired %v", key, p.Repaired)
+			}
+			found[key] = true
+		}
+		for key := range expected {
+			if !found[key] {
+				t.Errorf("%s wasn't found", key)
+			}
+		}
+	}
+
+	// checking changes nothing.
+	report, err := pub.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(report, false)
+	if !exists(orphan) || !exists(legacySig) || !exists(unreferenced) {
+		t.Fatal("check only removed files")
+	}
+
+	report, err = pub.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(report, true)
+
+	for name, kept := range map[string]bool{
+		good: true, posting: true, newOrphan: true,
+		orphan: false, legacySig: false, unreferenced: false, corrupt: false,
+	} {
+		if exists(name) != kept {
+			t.Errorf("%s kept %v, expected %v", name, !kept, kept)
+		}
+	}
+	article, err := pub.GetArticleById("<legacy@kothawoc.test>")
+	if err != nil || article.Header.Get("Message-Id") != "<legacy@kothawoc.test>" {
+		t.Errorf("moved article can't be read, %v", err)
+	}
+	var refs int64
+	if err := dbs.articles.QueryRow("SELECT refs FROM articles WHERE messageid='<refs@kothawoc.test>';").Scan(&refs); err != nil || refs != 1 {
+		t.Errorf("refs %d, %v", refs, err)
+	}
+
+	report, err = pub.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("problems after repair %+v", report.Problems)
+	}
+}
+
+// A file stored again after it was found orphaned isn't removed.
+func TestFsckOrphanReused(t *testing.T) {
+	dbs, pub := testFsckStore(t)
+	name := store(t, dbs, pub, "<reused@kothawoc.test>", "")
+	if err := dbs.fsckRemoveOrphan(name); err == nil || !exists(name) {
+		t.Errorf("file in use removed, %v", err)
+	}
+}
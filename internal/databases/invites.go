@@ -0,0 +1,107 @@
+package databases
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+const CmdAddInvite = DatabaseCommand("AddInvite")
+
+// AddInvite records an invite we handed out, perms are what the peer is
+// granted in the peering group once it's redeemed.
+func (dbs *BackendDbs) AddInvite(secret string, expires time.Time, perms PermissionsGroupT) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdAddInvite,
+		Args: []interface{}{secret, expires, perms, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) addInvite(secret string, expires time.Time, perms PermissionsGroupT) error {
+	_, err := dbs.config.Exec("INSERT INTO invites(secret,expires,read,reply,post,cancel,supersede) VALUES(?,?,?,?,?,?,?);",
+		secret, expires.Unix(), perms.Read, perms.Reply, perms.Post, perms.Cancel, perms.Supersede)
+	return serr.New(err)
+}
+
+const CmdUseInvite = DatabaseCommand("UseInvite")
+
+// UseInvite redeems an unexpired, unused invite for torid and returns the
+// permissions it grants.
+func (dbs *BackendDbs) UseInvite(secret, torid string) (*PermissionsGroupT, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdUseInvite,
+		Args: []interface{}{secret, torid, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].(*PermissionsGroupT), nil
+	}
+	return res[0].(*PermissionsGroupT), err
+}
+
+func (dbs *backendDbs) useInvite(secret, torid string) (*PermissionsGroupT, error) {
+	p := &PermissionsGroupT{}
+	var expires int64
+	var usedBy string
+
+	row := dbs.config.QueryRow("SELECT expires,read,reply,post,cancel,supersede,usedby FROM invites WHERE secret=?;", secret)
+	err := row.Scan(&expires, &p.Read, &p.Reply, &p.Post, &p.Cancel, &p.Supersede, &usedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, serr.Errorf("unknown invite from %s", torid)
+	}
+	if err != nil {
+		return nil, serr.New(err)
+	}
+
+	if usedBy != "" {
+		slog.Info("Invite already used", "torid", torid, "usedby", usedBy)
+		return nil, serr.Errorf("invite already used by %s", usedBy)
+	}
+	if time.Now().Unix() > expires {
+		return nil, serr.Errorf("invite expired at %s", time.Unix(expires, 0))
+	}
+
+	if _, err := dbs.config.Exec("UPDATE invites SET usedby=? WHERE secret=?;", torid, secret); err != nil {
+		return nil, serr.New(err)
+	}
+
+	return p, nil
+}
+
+const CmdIsOpenInvite = DatabaseCommand("IsOpenInvite")
+
+// IsOpenInvite is true if secret is an invite that can still be redeemed, so
+// the unknown node holding it is let in to redeem it.
+func (dbs *BackendDbs) IsOpenInvite(secret string) bool {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdIsOpenInvite,
+		Args: []interface{}{secret, ret},
+	}
+	res := <-ret
+	return res[0].(bool)
+}
+
+func (dbs *backendDbs) isOpenInvite(secret string) bool {
+	var count int64
+	row := dbs.config.QueryRow("SELECT COUNT(*) FROM invites WHERE secret=? AND usedby=\"\" AND expires>?;", secret, time.Now().Unix())
+	if err := row.Scan(&count); err != nil {
+		slog.Info("Failed to count invites", "error", err)
+		return false
+	}
+	return count > 0
+}
@@ -0,0 +1,245 @@
+package databases
+
+import (
+	"database/sql"
+
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+const CmdGetNewsrc = DatabaseCommand("GetNewsrc")
+
+// GetNewsrc returns an account's read state for every group it's subscribed
+// to or has read in.
+func (dbs *BackendDbs) GetNewsrc(username string) ([]messages.NewsrcLine, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetNewsrc,
+		Args: []interface{}{username, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].([]messages.NewsrcLine), nil
+	}
+	return res[0].([]messages.NewsrcLine), err
+}
+
+func (dbs *backendDbs) getNewsrc(username string) ([]messages.NewsrcLine, error) {
+	ret := []messages.NewsrcLine{}
+	rows, err := dbs.config.Query(`SELECT groupname, 1 FROM subscriptions WHERE username=?
+		UNION SELECT DISTINCT groupname, 0 FROM readmarks WHERE username=? AND groupname NOT IN
+			(SELECT groupname FROM subscriptions WHERE username=?)
+		ORDER BY groupname;`, username, username, username)
+	if err != nil {
+		return ret, serr.New(err)
+	}
+	for rows.Next() {
+		l := messages.NewsrcLine{}
+		if err := rows.Scan(&l.Group, &l.Subscribed); err != nil {
+			rows.Close()
+			return ret, serr.New(err)
+		}
+		ret = append(ret, l)
+	}
+	rows.Close()
+
+	for i := range ret {
+		marks, err := dbs.getReadMarks(username, ret[i].Group)
+		if err != nil {
+			return ret, err
+		}
+		ret[i].Read = messages.NumbersToRanges(marks)
+	}
+	return ret, nil
+}
+
+const CmdSetNewsrc = DatabaseCommand("SetNewsrc")
+
+// SetNewsrc replaces the read state of the groups listed, groups not listed
+// are left alone.
+func (dbs *BackendDbs) SetNewsrc(username string, lines []messages.NewsrcLine) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdSetNewsrc,
+		Args: []interface{}{username, lines, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) setNewsrc(username string, lines []messages.NewsrcLine) error {
+	for _, l := range lines {
+		if err := dbs.subscribe(username, l.Group, l.Subscribed); err != nil {
+			return err
+		}
+		if _, err := dbs.config.Exec("DELETE FROM readmarks WHERE username=? AND groupname=?;", username, l.Group); err != nil {
+			return serr.New(err)
+		}
+
+		// newsreaders happily mark 1-100000 read, only store the articles
+		// the group actually has, and don't count through the rest.
+		gdb, ok := dbs.groupArticles[l.Group]
+		if !ok {
+			continue
+		}
+
+		numbers := []int64{}
+		for _, r := range l.Read {
+			rows, err := gdb.Query("SELECT id FROM articles WHERE id>=? AND id<=? ORDER BY id;", r.From, r.To)
+			if err != nil {
+				return serr.New(err)
+			}
+			for rows.Next() {
+				var n int64
+				if err := rows.Scan(&n); err != nil {
+					rows.Close()
+					return serr.New(err)
+				}
+				numbers = append(numbers, n)
+			}
+			rows.Close()
+		}
+		if err := dbs.markRead(username, l.Group, numbers, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const CmdGetNewsrcSync = DatabaseCommand("GetNewsrcSync")
+
+// GetNewsrcSync is GetNewsrc with the read articles by Message-Id, to sync
+// with nodes that number them differently.
+func (dbs *BackendDbs) GetNewsrcSync(username string) ([]messages.NewsrcSyncLine, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetNewsrcSync,
+		Args: []interface{}{username, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].([]messages.NewsrcSyncLine), nil
+	}
+	return res[0].([]messages.NewsrcSyncLine), err
+}
+
+func (dbs *backendDbs) getNewsrcSync(username string) ([]messages.NewsrcSyncLine, error) {
+	ret := []messages.NewsrcSyncLine{}
+	lines, err := dbs.getNewsrc(username)
+	if err != nil {
+		return ret, err
+	}
+	for _, l := range lines {
+		s := messages.NewsrcSyncLine{Group: l.Group, Subscribed: l.Subscribed, Read: []string{}}
+		if gdb, ok := dbs.groupArticles[l.Group]; ok {
+			for _, r := range l.Read {
+				rows, err := gdb.Query("SELECT messageid FROM articles WHERE id>=? AND id<=? ORDER BY id;", r.From, r.To)
+				if err != nil {
+					return ret, serr.New(err)
+				}
+				for rows.Next() {
+					var messageId string
+					if err := rows.Scan(&messageId); err != nil {
+						rows.Close()
+						return ret, serr.New(err)
+					}
+					s.Read = append(s.Read, messageId)
+				}
+				rows.Close()
+			}
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+const CmdSetNewsrcSync = DatabaseCommand("SetNewsrcSync")
+
+// SetNewsrcSync is SetNewsrc with the read articles by Message-Id, those we
+// don't have are left out.
+func (dbs *BackendDbs) SetNewsrcSync(username string, lines []messages.NewsrcSyncLine) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdSetNewsrcSync,
+		Args: []interface{}{username, lines, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) setNewsrcSync(username string, lines []messages.NewsrcSyncLine) error {
+	for _, l := range lines {
+		numbers := []int64{}
+		if gdb, ok := dbs.groupArticles[l.Group]; ok {
+			for _, messageId := range l.Read {
+				var n int64
+				err := gdb.QueryRow("SELECT id FROM articles WHERE messageid=?;", messageId).Scan(&n)
+				if err == sql.ErrNoRows {
+					continue
+				}
+				if err != nil {
+					return serr.New(err)
+				}
+				numbers = append(numbers, n)
+			}
+		}
+		err := dbs.setNewsrc(username, []messages.NewsrcLine{{
+			Group:      l.Group,
+			Subscribed: l.Subscribed,
+			Read:       messages.NumbersToRanges(numbers),
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const CmdSetAccountKey = DatabaseCommand("SetAccountKey")
+
+// SetAccountKey replaces an account's identity key, to use the same
+// identity on several devices.
+func (dbs *BackendDbs) SetAccountKey(username string, key keytool.EasyEdKey) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdSetAccountKey,
+		Args: []interface{}{username, key, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) setAccountKey(username string, key keytool.EasyEdKey) error {
+	privKey, err := key.TorPrivKey()
+	if err != nil {
+		return serr.New(err)
+	}
+	res, err := dbs.config.Exec("UPDATE accounts SET key=? WHERE username=?;", []byte(privKey), username)
+	if err != nil {
+		return serr.New(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return serr.New(sql.ErrNoRows)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package databases
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+type PeerRequestStatus string
+
+const (
+	PeerRequestPending  = PeerRequestStatus("pending")
+	PeerRequestAccepted = PeerRequestStatus("accepted")
+	PeerRequestRejected = PeerRequestStatus("rejected")
+	PeerRequestBlocked  = PeerRequestStatus("blocked")
+)
+
+const (
+	// a torid can only refresh its request this often, retries in between
+	// just bump the attempts counter.
+	PeerRequestInterval = time.Hour
+	// stop recording new strangers once this many requests are pending.
+	MaxPendingPeerRequests = 256
+)
+
+// PeerRequest is an unknown node that completed a signed handshake with us,
+// it shows up as a friend request until it's accepted, rejected or blocked.
+type PeerRequest struct {
+	TorId    string
+	Note     string
+	Received time.Time
+	Attempts int64
+	Status   PeerRequestStatus
+}
+
+const CmdAddPeerRequest = DatabaseCommand("AddPeerRequest")
+
+func (dbs *BackendDbs) AddPeerRequest(torid, note string) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdAddPeerRequest,
+		Args: []interface{}{torid, note, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) addPeerRequest(torid, note string) error {
+	existing, err := dbs.getPeerRequest(torid)
+	if err == nil {
+		// a rejected node may ask again later, accepted and blocked ones
+		// never change.
+		if existing.Status != PeerRequestPending && existing.Status != PeerRequestRejected {
+			return nil
+		}
+		if time.Since(existing.Received) < PeerRequestInterval {
+			_, err := dbs.peers.Exec("UPDATE peer_requests SET attempts=attempts+1 WHERE torid=?;", torid)
+			return serr.New(err)
+		}
+		_, err := dbs.peers.Exec("UPDATE peer_requests SET note=?, received=?, attempts=attempts+1, status=? WHERE torid=?;",
+			note, time.Now().Unix(), PeerRequestPending, torid)
+		return serr.New(err)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return serr.New(err)
+	}
+
+	var count int64
+	row := dbs.peers.QueryRow("SELECT COUNT(*) FROM peer_requests WHERE status=?;", PeerRequestPending)
+	if err := row.Scan(&count); err != nil {
+		return serr.New(err)
+	}
+	if count >= MaxPendingPeerRequests {
+		slog.Info("Too many pending peer requests, dropping", "torid", torid)
+		return serr.Errorf("too many pending peer requests")
+	}
+
+	_, err = dbs.peers.Exec("INSERT INTO peer_requests(torid,note,received,status) VALUES(?,?,?,?);",
+		torid, note, time.Now().Unix(), PeerRequestPending)
+	return serr.New(err)
+}
+
+const CmdGetPeerRequests = DatabaseCommand("GetPeerRequests")
+
+func (dbs *BackendDbs) GetPeerRequests() ([]PeerRequest, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetPeerRequests,
+		Args: []interface{}{ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].([]PeerRequest), nil
+	}
+	return res[0].([]PeerRequest), err
+}
+
+func scanPeerRequest(row interface{ Scan(...any) error }) (PeerRequest, error) {
+	r := PeerRequest{}
+	var received int64
+	err := row.Scan(&r.TorId, &r.Note, &received, &r.Attempts, &r.Status)
+	if err != nil {
+		return r, err
+	}
+	r.Received = time.Unix(received, 0)
+	return r, nil
+}
+
+func (dbs *backendDbs) getPeerRequests() ([]PeerRequest, error) {
+	ret := []PeerRequest{}
+	rows, err := dbs.peers.Query("SELECT torid,note,received,attempts,status FROM peer_requests ORDER BY received DESC;")
+	if err != nil {
+		return ret, serr.New(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanPeerRequest(rows)
+		if err != nil {
+			return ret, serr.New(err)
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+const CmdGetPeerRequest = DatabaseCommand("GetPeerRequest")
+
+func (dbs *BackendDbs) GetPeerRequest(torid string) (PeerRequest, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetPeerRequest,
+		Args: []interface{}{torid, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].(PeerRequest), nil
+	}
+	return res[0].(PeerRequest), err
+}
+
+func (dbs *backendDbs) getPeerRequest(torid string) (PeerRequest, error) {
+	row := dbs.peers.QueryRow("SELECT torid,note,received,attempts,status FROM peer_requests WHERE torid=?;", torid)
+	r, err := scanPeerRequest(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, serr.New(sql.ErrNoRows)
+	}
+	return r, serr.New(err)
+}
+
+const CmdSetPeerRequestStatus = DatabaseCommand("SetPeerRequestStatus")
+
+func (dbs *BackendDbs) SetPeerRequestStatus(torid string, status PeerRequestStatus) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdSetPeerRequestStatus,
+		Args: []interface{}{torid, status, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+// setPeerRequestStatus records a decision, blocking works even if the torid
+// never sent a request, so it can't. received is the time of the decision, so
+// a rejected node has to wait before asking again.
+func (dbs *backendDbs) setPeerRequestStatus(torid string, status PeerRequestStatus) error {
+	_, err := dbs.peers.Exec(`INSERT INTO peer_requests(torid,note,received,status) VALUES(?,"",?,?)
+		ON CONFLICT(torid) DO UPDATE SET status=excluded.status, received=excluded.received;`,
+		torid, time.Now().Unix(), status)
+	return serr.New(err)
+}
@@ -0,0 +1,134 @@
+package databases
+
+import (
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// Reactions are kept in articles.db, each reaction article is referenced by
+// its row rather than by a group, so it's never listed but is still sent on
+// to peers, and cancelling it removes it like any other article.
+
+const CmdHasReaction = DatabaseCommand("HasReaction")
+
+// HasReaction tells if from already reacted to messageId with reaction.
+func (dbs *BackendDbs) HasReaction(from, messageId, reaction string) bool {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdHasReaction,
+		Args: []interface{}{from, messageId, reaction, ret},
+	}
+	res := <-ret
+	return res[0].(bool)
+}
+
+func (dbs *backendDbs) hasReaction(from, messageId, reaction string) bool {
+	var count int64
+	row := dbs.articles.QueryRow("SELECT COUNT(*) FROM reactions WHERE sender=? AND target=? AND reaction=?;", from, messageId, reaction)
+	if err := row.Scan(&count); err != nil {
+		return false
+	}
+	return count > 0
+}
+
+const CmdAddReaction = DatabaseCommand("AddReaction")
+
+// AddReaction counts a stored reaction article towards messageId.
+func (dbs *BackendDbs) AddReaction(reactionId, from, messageId, reaction string) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdAddReaction,
+		Args: []interface{}{reactionId, from, messageId, reaction, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) addReaction(reactionId, from, messageId, reaction string) error {
+	_, err := dbs.articles.Exec("INSERT INTO reactions(messageid,sender,target,reaction) VALUES(?,?,?,?);",
+		reactionId, from, messageId, reaction)
+	if err != nil {
+		return serr.New(err)
+	}
+	if _, err := dbs.articles.Exec("UPDATE articles SET refs=refs + 1 WHERE messageid=?;", reactionId); err != nil {
+		return serr.New(err)
+	}
+	return nil
+}
+
+// removeReaction forgets a cancelled reaction, the cancel takes care of the
+// article itself.
+func (dbs *backendDbs) removeReaction(reactionId string) error {
+	if _, err := dbs.articles.Exec("DELETE FROM reactions WHERE messageid=?;", reactionId); err != nil {
+		return serr.New(err)
+	}
+	return nil
+}
+
+const CmdGetReactions = DatabaseCommand("GetReactions")
+
+// GetReactions counts the reactions to messageId.
+func (dbs *BackendDbs) GetReactions(messageId string) (map[string]int64, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetReactions,
+		Args: []interface{}{messageId, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].(map[string]int64), nil
+	}
+	return res[0].(map[string]int64), err
+}
+
+func (dbs *backendDbs) getReactions(messageId string) (map[string]int64, error) {
+	ret := map[string]int64{}
+	rows, err := dbs.articles.Query("SELECT reaction, COUNT(*) FROM reactions WHERE target=? GROUP BY reaction;", messageId)
+	if err != nil {
+		return ret, serr.New(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var reaction string
+		var count int64
+		if err := rows.Scan(&reaction, &count); err != nil {
+			return ret, serr.New(err)
+		}
+		ret[reaction] = count
+	}
+	return ret, nil
+}
+
+const CmdGetMyReaction = DatabaseCommand("GetMyReaction")
+
+// GetMyReaction returns the message id of from's reaction to messageId, to
+// cancel it.
+func (dbs *BackendDbs) GetMyReaction(from, messageId, reaction string) (string, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetMyReaction,
+		Args: []interface{}{from, messageId, reaction, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].(string), nil
+	}
+	return res[0].(string), err
+}
+
+func (dbs *backendDbs) getMyReaction(from, messageId, reaction string) (string, error) {
+	var reactionId string
+	row := dbs.articles.QueryRow("SELECT messageid FROM reactions WHERE sender=? AND target=? AND reaction=?;", from, messageId, reaction)
+	if err := row.Scan(&reactionId); err != nil {
+		return "", serr.Errorf("no %s reaction to %s", reaction, messageId)
+	}
+	return reactionId, nil
+}
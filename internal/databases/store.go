@@ -0,0 +1,160 @@
+package databases
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// Articles are stored by the SHA-256 of the article as it's written, before
+// compression, sharded by the first two bytes of it:
+//
+//	articles/ab/cd/abcd...
+//
+// The same content is stored once, however many message ids it has. Articles
+// stored before were named by their signature, articles/<signature>, with no
+// hash in articles.db; they're still read, and Fsck moves them.
+
+// migrateArticlesDB adds the hash, bytes and lines columns to an articles.db
+// made before them. Articles stored before have bytes and lines of -1, and
+// they're counted the first time the article's read.
+func migrateArticlesDB(db *sql.DB) error {
+	for column, def := range map[string]string{
+		"hash":  "TEXT NOT NULL DEFAULT ''",
+		"bytes": "INTEGER NOT NULL DEFAULT -1",
+		"lines": "INTEGER NOT NULL DEFAULT -1",
+	} {
+		row := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('articles') WHERE name=?;", column)
+		var n int
+		if err := row.Scan(&n); err != nil {
+			return serr.New(err)
+		}
+		if n == 0 {
+			if _, err := db.Exec("ALTER TABLE articles ADD COLUMN " + column + " " + def + ";"); err != nil {
+				return serr.New(err)
+			}
+		}
+	}
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS articles_hash ON articles(hash);")
+	return serr.New(err)
+}
+
+// articlePath is where an article is stored, by its hash or, for older
+// articles, its signature.
+func (dbs *backendDbs) articlePath(hash, signature string) string {
+	if hash == "" {
+		return filepath.Join(dbs.path, "articles", signature)
+	}
+	return filepath.Join(dbs.path, "articles", hash[:2], hash[2:4], hash)
+}
+
+// writeArticleFile streams an article, compressed, to a temporary file and
+// renames it into place by its hash, so a half written article is never
+// read. It returns the hash, and the article's size and the size stored, 0
+// if the content was already stored. The body's counted into body as it's
+// written.
+func (dbs *backendDbs) writeArticleFile(msg *messages.MessageTool, compression string, body *bodyCounter) (string, int64, int64, error) {
+	return dbs.writeStoreFile(func(w io.Writer) error { return msg.WriteTo(io.MultiWriter(w, body), false) }, compression)
+}
+
+// bodyCounter counts the bytes and lines of an article's body as it's
+// written, what's after the first blank line. Lines starts at 1, as an
+// article's always read.
+type bodyCounter struct {
+	inBody bool
+	line   int
+	cr     bool
+	size   int64
+	lines  int64
+}
+
+func (c *bodyCounter) Write(p []byte) (int, error) {
+	if c.lines == 0 {
+		c.lines = 1
+	}
+	for i, b := range p {
+		if c.inBody {
+			c.size += int64(len(p) - i)
+			c.lines += int64(bytes.Count(p[i:], []byte("\n")))
+			break
+		}
+		if b == '\n' {
+			c.inBody = c.line == 1 && c.cr
+			c.line, c.cr = 0, false
+			continue
+		}
+		c.line++
+		c.cr = b == '\r'
+	}
+	return len(p), nil
+}
+
+// writeStoreFile stores whatever write writes, as writeArticleFile.
+func (dbs *backendDbs) writeStoreFile(write func(io.Writer) error, compression string) (string, int64, int64, error) {
+	f, err := os.CreateTemp(filepath.Join(dbs.path, "articles"), ".tmp-*")
+	if err != nil {
+		return "", 0, 0, serr.New(err)
+	}
+	defer os.Remove(f.Name())
+	stored := &countingWriter{w: f}
+	zw, err := compressWriter(stored, compression)
+	if err != nil {
+		f.Close()
+		return "", 0, 0, err
+	}
+	sum := sha256.New()
+	raw := &countingWriter{w: io.MultiWriter(zw, sum)}
+	if err := write(raw); err != nil {
+		f.Close()
+		return "", 0, 0, err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return "", 0, 0, serr.New(err)
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return "", 0, 0, serr.New(err)
+	}
+	if err := f.Close(); err != nil {
+		return "", 0, 0, serr.New(err)
+	}
+
+	hash := hex.EncodeToString(sum.Sum(nil))
+	name := dbs.articlePath(hash, "")
+	if _, err := os.Stat(name); err == nil {
+		return hash, 0, 0, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return "", 0, 0, serr.New(err)
+	}
+	return hash, raw.n, stored.n, serr.New(os.Rename(f.Name(), name))
+}
+
+// removeArticleFile removes an article's file, unless another message id
+// has the same content.
+func (dbs *backendDbs) removeArticleFile(messageId, hash, signature string) error {
+	if hash != "" {
+		row := dbs.articles.QueryRow("SELECT COUNT(*) FROM articles WHERE hash=? AND messageid!=?;", hash, messageId)
+		var n int
+		if err := row.Scan(&n); err != nil {
+			return serr.New(err)
+		}
+		if n > 0 {
+			return nil
+		}
+	}
+	if err := os.Remove(dbs.articlePath(hash, signature)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return serr.New(err)
+	}
+	return nil
+}
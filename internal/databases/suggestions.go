@@ -0,0 +1,233 @@
+package databases
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+type SuggestionStatus string
+
+const (
+	SuggestionPending  = SuggestionStatus("pending")
+	SuggestionAccepted = SuggestionStatus("accepted")
+	SuggestionRejected = SuggestionStatus("rejected")
+)
+
+// Suggestion is a friend suggestion received through an introduction, the
+// chain starts with the peer that introduced the torid to us.
+type Suggestion struct {
+	TorId      string
+	Name       string
+	Introducer string
+	Chain      []string
+	Received   time.Time
+	Status     SuggestionStatus
+}
+
+const CmdAddSuggestion = DatabaseCommand("AddSuggestion")
+
+func (dbs *BackendDbs) AddSuggestion(torid, name, introducer string, chain []string) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdAddSuggestion,
+		Args: []interface{}{torid, name, introducer, chain, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) addSuggestion(torid, name, introducer string, chain []string) error {
+
+	myKey, err := dbs.configGetDeviceKey()
+	if err != nil {
+		return serr.New(err)
+	}
+	myId, _ := myKey.TorId()
+	if torid == myId {
+		return nil
+	}
+
+	var count int64
+	row := dbs.peers.QueryRow("SELECT COUNT(*) FROM peers WHERE torid=?;", torid)
+	if err := row.Scan(&count); err != nil {
+		return serr.New(err)
+	}
+	if count > 0 {
+		slog.Info("Ignoring suggestion for existing peer", "torid", torid, "introducer", introducer)
+		return nil
+	}
+
+	fullChain := strings.Join(append([]string{introducer}, chain...), ",")
+
+	// a later introduction refreshes a pending suggestion, but never revives
+	// one that was already accepted or rejected.
+	_, err = dbs.peers.Exec(`INSERT INTO suggestions(torid,name,introducer,chain,received,status) VALUES(?,?,?,?,?,?)
+		ON CONFLICT(torid) DO UPDATE SET name=excluded.name, introducer=excluded.introducer,
+		chain=excluded.chain, received=excluded.received WHERE status=?;`,
+		torid, name, introducer, fullChain, time.Now().Unix(), SuggestionPending, SuggestionPending)
+	if err != nil {
+		slog.Info("Failed to add suggestion", "torid", torid, "introducer", introducer, "error", err)
+		return serr.New(err)
+	}
+	return nil
+}
+
+const CmdGetSuggestions = DatabaseCommand("GetSuggestions")
+
+func (dbs *BackendDbs) GetSuggestions() ([]Suggestion, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetSuggestions,
+		Args: []interface{}{ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].([]Suggestion), nil
+	}
+	return res[0].([]Suggestion), err
+}
+
+func scanSuggestion(row interface{ Scan(...any) error }) (Suggestion, error) {
+	s := Suggestion{}
+	var chain string
+	var received int64
+	err := row.Scan(&s.TorId, &s.Name, &s.Introducer, &chain, &received, &s.Status)
+	if err != nil {
+		return s, err
+	}
+	s.Chain = strings.Split(chain, ",")
+	s.Received = time.Unix(received, 0)
+	return s, nil
+}
+
+func (dbs *backendDbs) getSuggestions() ([]Suggestion, error) {
+	ret := []Suggestion{}
+	rows, err := dbs.peers.Query("SELECT torid,name,introducer,chain,received,status FROM suggestions ORDER BY received DESC;")
+	if err != nil {
+		return ret, serr.New(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s, err := scanSuggestion(rows)
+		if err != nil {
+			return ret, serr.New(err)
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+const CmdGetSuggestion = DatabaseCommand("GetSuggestion")
+
+func (dbs *BackendDbs) GetSuggestion(torid string) (Suggestion, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetSuggestion,
+		Args: []interface{}{torid, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].(Suggestion), nil
+	}
+	return res[0].(Suggestion), err
+}
+
+func (dbs *backendDbs) getSuggestion(torid string) (Suggestion, error) {
+	row := dbs.peers.QueryRow("SELECT torid,name,introducer,chain,received,status FROM suggestions WHERE torid=?;", torid)
+	s, err := scanSuggestion(row)
+	if err != nil {
+		return s, serr.New(err)
+	}
+	return s, nil
+}
+
+const CmdSetSuggestionStatus = DatabaseCommand("SetSuggestionStatus")
+
+func (dbs *BackendDbs) SetSuggestionStatus(torid string, status SuggestionStatus) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdSetSuggestionStatus,
+		Args: []interface{}{torid, status, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) setSuggestionStatus(torid string, status SuggestionStatus) error {
+	_, err := dbs.peers.Exec("UPDATE suggestions SET status=? WHERE torid=?;", status, torid)
+	return serr.New(err)
+}
+
+const CmdAddIntroduction = DatabaseCommand("AddIntroduction")
+
+// AddIntroduction records that we recommended torid to recipient, so an
+// acceptance coming back can be relayed.
+func (dbs *BackendDbs) AddIntroduction(torid, recipient, name string) error {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdAddIntroduction,
+		Args: []interface{}{torid, recipient, name, ret},
+	}
+	res := <-ret
+
+	err, ok := res[0].(error)
+	if !ok {
+		return nil
+	}
+	return err
+}
+
+func (dbs *backendDbs) addIntroduction(torid, recipient, name string) error {
+	_, err := dbs.peers.Exec("INSERT OR REPLACE INTO introductions(torid,recipient,name,sent) VALUES(?,?,?,?);",
+		torid, recipient, name, time.Now().Unix())
+	return serr.New(err)
+}
+
+const CmdGetIntroduction = DatabaseCommand("GetIntroduction")
+
+// GetIntroduction returns the name we gave torid when introducing it to
+// recipient, or sql.ErrNoRows if we never did.
+func (dbs *BackendDbs) GetIntroduction(torid, recipient string) (string, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGetIntroduction,
+		Args: []interface{}{torid, recipient, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].(string), nil
+	}
+	return res[0].(string), err
+}
+
+func (dbs *backendDbs) getIntroduction(torid, recipient string) (string, error) {
+	row := dbs.peers.QueryRow("SELECT name FROM introductions WHERE torid=? AND recipient=?;", torid, recipient)
+	name := ""
+	err := row.Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return name, serr.New(sql.ErrNoRows)
+	}
+	return name, serr.New(err)
+}
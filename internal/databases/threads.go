@@ -0,0 +1,266 @@
+package databases
+
+import (
+	"database/sql"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// ThreadsPerPage is how many threads GroupThreads returns at once.
+const ThreadsPerPage = 20
+
+// ThreadNode is an article in a thread, with the replies to it. Articles
+// that are referenced but we don't have, yet or at all, are kept as
+// placeholders so their replies still hang in the right place.
+type ThreadNode struct {
+	Id          int64
+	MessageId   string
+	Placeholder bool
+	From        string
+	Subject     string
+	Date        time.Time
+	Children    []*ThreadNode
+}
+
+// threadArticle adds an article to the threads table. The first of its
+// References is the root of the thread and the last is its parent, the ones
+// we haven't seen become placeholders, each under the one before it.
+func (dbs *backendDbs) threadArticle(msg *messages.MessageTool) error {
+	header := msg.Article.Header
+	if header.Get("Control") != "" {
+		return nil
+	}
+	messageId := header.Get("Message-Id")
+
+	refs := slices.DeleteFunc(msg.References(), func(ref string) bool { return ref == messageId })
+	root, parent := messageId, ""
+	if len(refs) > 0 {
+		root, parent = refs[0], refs[len(refs)-1]
+	}
+
+	for i, ref := range refs {
+		refParent := ""
+		if i > 0 {
+			refParent = refs[i-1]
+		}
+		_, err := dbs.articles.Exec(`INSERT INTO threads(messageid,parent,root,present) VALUES(?,?,?,FALSE)
+			ON CONFLICT(messageid) DO UPDATE SET parent=excluded.parent WHERE NOT present AND parent='';`,
+			ref, refParent, root)
+		if err != nil {
+			return serr.New(err)
+		}
+	}
+
+	// the article may have been a placeholder, which keeps its replies.
+	_, err := dbs.articles.Exec(`INSERT INTO threads(messageid,parent,root,present) VALUES(?,?,?,TRUE)
+		ON CONFLICT(messageid) DO UPDATE SET parent=excluded.parent, root=excluded.root, present=TRUE;`,
+		messageId, parent, root)
+	if err != nil {
+		return serr.New(err)
+	}
+
+	// replies that arrived first, with fewer References, may have started
+	// threads of their own further down, move them into this one.
+	for _, id := range append(refs[min(1, len(refs)):], messageId) {
+		if id == root {
+			continue
+		}
+		if _, err := dbs.articles.Exec("UPDATE threads SET root=? WHERE root=?;", root, id); err != nil {
+			return serr.New(err)
+		}
+	}
+	return nil
+}
+
+// unthreadArticle turns a removed article back into a placeholder.
+func (dbs *backendDbs) unthreadArticle(messageId string) error {
+	if _, err := dbs.articles.Exec("UPDATE threads SET present=FALSE WHERE messageid=?;", messageId); err != nil {
+		slog.Info("Failed to remove article from its thread", "messageId", messageId, "error", err)
+		return serr.New(err)
+	}
+	return nil
+}
+
+// backfillThreads threads the articles indexed before there were threads.
+func (dbs *backendDbs) backfillThreads() error {
+	rows, err := dbs.articles.Query(`SELECT messageid,msgrefs FROM timeline
+		WHERE control='' AND messageid NOT IN (SELECT messageid FROM threads WHERE present) ORDER BY id;`)
+	if err != nil {
+		return serr.New(err)
+	}
+	missing := [][2]string{}
+	for rows.Next() {
+		var messageId, refs string
+		if err := rows.Scan(&messageId, &refs); err != nil {
+			rows.Close()
+			return serr.New(err)
+		}
+		missing = append(missing, [2]string{messageId, refs})
+	}
+	rows.Close()
+
+	for _, m := range missing {
+		msg := messages.NewMessageTool()
+		msg.Article.Header.Set("Message-Id", m[0])
+		if m[1] != "" {
+			msg.Article.Header.Set("References", m[1])
+		}
+		if err := dbs.threadArticle(msg); err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		slog.Info("Added articles to threads", "count", len(missing))
+	}
+	return nil
+}
+
+// threadRoot is the root of the thread a message is in.
+func (dbs *backendDbs) threadRoot(messageId string) (string, error) {
+	root := ""
+	err := dbs.articles.QueryRow("SELECT root FROM threads WHERE messageid=?;", messageId).Scan(&root)
+	if err == sql.ErrNoRows {
+		return "", serr.Errorf("no thread for %s", messageId)
+	}
+	if err != nil {
+		return "", serr.New(err)
+	}
+	return root, nil
+}
+
+// threadTree builds the whole thread under root, oldest replies first.
+func (dbs *backendDbs) threadTree(root string) (*ThreadNode, error) {
+	rows, err := dbs.articles.Query(`SELECT threads.messageid, threads.parent, threads.present,
+		IFNULL(timeline.id, 0), IFNULL(timeline.sender, ''), IFNULL(timeline.subject, ''), IFNULL(timeline.date, 0)
+		FROM threads LEFT JOIN timeline ON timeline.messageid=threads.messageid
+		WHERE threads.root=?;`, root)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	defer rows.Close()
+
+	nodes := map[string]*ThreadNode{}
+	parents := map[string]string{}
+	for rows.Next() {
+		n := &ThreadNode{}
+		var parent string
+		var present bool
+		var date int64
+		if err := rows.Scan(&n.MessageId, &parent, &present, &n.Id, &n.From, &n.Subject, &date); err != nil {
+			return nil, serr.New(err)
+		}
+		n.Placeholder = !present
+		if present {
+			n.Date = time.Unix(date, 0)
+		}
+		nodes[n.MessageId] = n
+		parents[n.MessageId] = parent
+	}
+
+	top, ok := nodes[root]
+	if !ok {
+		return nil, serr.Errorf("no thread for %s", root)
+	}
+	for id, n := range nodes {
+		if id == root {
+			continue
+		}
+		parent, ok := nodes[parents[id]]
+		if !ok || parent == n {
+			parent = top
+		}
+		parent.Children = append(parent.Children, n)
+	}
+	for _, n := range nodes {
+		sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Date.Before(n.Children[j].Date) })
+	}
+	return top, nil
+}
+
+const CmdThread = DatabaseCommand("Thread")
+
+// Thread returns the whole thread a message is in, from its root.
+func (dbs *BackendDbs) Thread(messageId string) (*ThreadNode, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdThread,
+		Args: []interface{}{messageId, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].(*ThreadNode), nil
+	}
+	return res[0].(*ThreadNode), err
+}
+
+func (dbs *backendDbs) thread(messageId string) (*ThreadNode, error) {
+	root, err := dbs.threadRoot(messageId)
+	if err != nil {
+		return nil, err
+	}
+	return dbs.threadTree(root)
+}
+
+const CmdGroupThreads = DatabaseCommand("GroupThreads")
+
+// GroupThreads returns a page of the threads in a group, from page 0, the
+// ones with the latest articles first.
+func (dbs *BackendDbs) GroupThreads(group string, page int) ([]*ThreadNode, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdGroupThreads,
+		Args: []interface{}{group, page, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].([]*ThreadNode), nil
+	}
+	return res[0].([]*ThreadNode), err
+}
+
+func (dbs *backendDbs) groupThreads(group string, page int) ([]*ThreadNode, error) {
+	ret := []*ThreadNode{}
+	db, ok := dbs.groupArticles[group]
+	if !ok || dbs.groupRemoved(group) {
+		return ret, serr.Errorf("no such group %s", group)
+	}
+
+	rows, err := db.Query("SELECT messageid FROM articles ORDER BY id DESC;")
+	if err != nil {
+		return ret, serr.New(err)
+	}
+	defer rows.Close()
+
+	skip := page * ThreadsPerPage
+	seen := map[string]bool{}
+	for len(ret) < ThreadsPerPage && rows.Next() {
+		var messageId string
+		if err := rows.Scan(&messageId); err != nil {
+			return ret, serr.New(err)
+		}
+		root, err := dbs.threadRoot(messageId)
+		if err != nil || seen[root] {
+			continue
+		}
+		seen[root] = true
+		if skip > 0 {
+			skip--
+			continue
+		}
+		tree, err := dbs.threadTree(root)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, tree)
+	}
+	return ret, nil
+}
@@ -0,0 +1,56 @@
+package databases
+
+import "testing"
+
+// reply stores an article with References refs.
+func reply(t *testing.T, pub *BackendDbs, messageId, refs string) {
+	msg := testMessage(messageId)
+	msg.Article.Header.Set("References", refs)
+	if _, err := pub.StoreArticle(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestThreadPlaceholders(t *testing.T) {
+	_, pub := testFsckStore(t)
+
+	// the replies arrive before the articles they reference, the first one
+	// doesn't know the root so starts a thread of its own.
+	reply(t, pub, "<d@test>", "<b@test>")
+	reply(t, pub, "<c@test>", "<a@test> <b@test>")
+
+	tree, err := pub.Thread("<c@test>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.MessageId != "<a@test>" || !tree.Placeholder {
+		t.Fatalf("root is %s placeholder %v", tree.MessageId, tree.Placeholder)
+	}
+	if len(tree.Children) != 1 || tree.Children[0].MessageId != "<b@test>" || !tree.Children[0].Placeholder {
+		t.Fatalf("parent isn't a placeholder under the root, %+v", tree.Children)
+	}
+	b := tree.Children[0]
+	if len(b.Children) != 2 || b.Children[0].Placeholder || b.Children[1].Placeholder {
+		t.Fatalf("replies aren't under their parent, %+v", b.Children)
+	}
+
+	if _, err := pub.StoreArticle(testMessage("<a@test>")); err != nil {
+		t.Fatal(err)
+	}
+	reply(t, pub, "<b@test>", "<a@test>")
+
+	tree, err = pub.Thread("<c@test>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.MessageId != "<a@test>" || tree.Placeholder || tree.Id == 0 {
+		t.Fatalf("root not filled in, %+v", tree)
+	}
+	if len(tree.Children) != 1 || tree.Children[0].MessageId != "<b@test>" || tree.Children[0].Placeholder {
+		t.Fatalf("parent not filled in, %+v", tree.Children)
+	}
+	b = tree.Children[0]
+	if len(b.Children) != 2 {
+		t.Fatalf("replies moved from their parent, %+v", b.Children)
+	}
+}
@@ -0,0 +1,172 @@
+package databases
+
+import (
+	"log/slog"
+	"math"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// TimelineEntry is the overview of an article, as kept in the timeline index
+// of articles.db, so a feed across every group doesn't need to open them all.
+type TimelineEntry struct {
+	Id         int64
+	MessageId  string
+	Group      string
+	Date       time.Time
+	From       string
+	Subject    string
+	References []string
+	Newsgroups []string
+	Arrived    time.Time
+}
+
+// indexArticle adds an article to the timeline, the id is the article's
+// number in every group it's in.
+func (dbs *backendDbs) indexArticle(id int64, msg *messages.MessageTool) error {
+	header := msg.Article.Header
+
+	arrived := time.Now()
+	date, err := mail.ParseDate(header.Get("Date"))
+	if err != nil {
+		date = arrived
+	}
+
+	newsgroups := []string{}
+	for _, g := range strings.Split(header.Get("Newsgroups"), ",") {
+		newsgroups = append(newsgroups, strings.TrimSpace(g))
+	}
+
+	_, err = dbs.articles.Exec(`INSERT INTO timeline(id,messageid,date,sender,subject,msgrefs,newsgroups,control,arrived)
+		VALUES(?,?,?,?,?,?,?,?,?);`,
+		id, header.Get("Message-Id"), date.Unix(), header.Get("From"), header.Get("Subject"),
+		strings.Join(msg.References(), " "), strings.Join(newsgroups, ","), header.Get("Control"), arrived.Unix())
+	if err != nil {
+		return serr.New(err)
+	}
+	return nil
+}
+
+// backfillTimeline indexes the articles stored before there was a timeline.
+func (dbs *backendDbs) backfillTimeline() error {
+	rows, err := dbs.articles.Query("SELECT id,messageid FROM articles WHERE id NOT IN (SELECT id FROM timeline) AND refs>0;")
+	if err != nil {
+		return serr.New(err)
+	}
+	ids := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var messageId string
+		if err := rows.Scan(&id, &messageId); err != nil {
+			rows.Close()
+			return serr.New(err)
+		}
+		ids[id] = messageId
+	}
+	rows.Close()
+
+	for id, messageId := range ids {
+		article, err := dbs.getArticleById(messageId)
+		if err != nil {
+			continue
+		}
+		if err := dbs.indexArticle(id, messages.NewMessageToolFromArticle(article)); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		slog.Info("Added articles to the timeline", "count", len(ids))
+	}
+	return nil
+}
+
+const CmdTimeline = DatabaseCommand("Timeline")
+
+// Timeline returns the articles a session can read, leaving out control
+// messages, newest first going back from since, a zero since starts from now.
+// Page through it by passing the Date and Id of the last entry, dates are
+// whole seconds so the Id orders articles of the same second. With
+// groupFilter only those groups are included.
+func (dbs *BackendDbs) Timeline(session map[string]string, since time.Time, sinceId int64, limit int, groupFilter []string) ([]TimelineEntry, error) {
+	ret := make(chan []interface{})
+	dbs.Cmd <- DatabaseMessage{
+		Cmd:  CmdTimeline,
+		Args: []interface{}{session, since, sinceId, limit, groupFilter, ret},
+	}
+	res := <-ret
+
+	err, ok := res[1].(error)
+	if !ok {
+		return res[0].([]TimelineEntry), nil
+	}
+	return res[0].([]TimelineEntry), err
+}
+
+// timelineGroup is the first group of an article the session can read, the
+// article may not be in every group it was posted to.
+func (dbs *backendDbs) timelineGroup(session map[string]string, id int64, newsgroups []string, groupFilter []string) string {
+	for _, group := range newsgroups {
+		if len(groupFilter) > 0 && !containsStr(groupFilter, group) {
+			continue
+		}
+		db, ok := dbs.groupArticles[group]
+		if !ok || dbs.groupRemoved(group) {
+			continue
+		}
+		if perms := dbs.getPerms(session["Id"], group); perms != nil && !perms.Read {
+			continue
+		}
+		var found int64
+		if err := db.QueryRow("SELECT id FROM articles WHERE id=?;", id).Scan(&found); err != nil {
+			continue
+		}
+		return group
+	}
+	return ""
+}
+
+func (dbs *backendDbs) timeline(session map[string]string, since time.Time, sinceId int64, limit int, groupFilter []string) ([]TimelineEntry, error) {
+	ret := []TimelineEntry{}
+	before := int64(math.MaxInt64)
+	if !since.IsZero() {
+		before = since.Unix()
+	}
+
+	rows, err := dbs.articles.Query(`SELECT id,messageid,date,sender,subject,msgrefs,newsgroups,arrived
+		FROM timeline WHERE (date<? OR (date=? AND id<?)) AND control='' ORDER BY date DESC, id DESC;`, before, before, sinceId)
+	if err != nil {
+		return ret, serr.New(err)
+	}
+	defer rows.Close()
+
+	for len(ret) < limit && rows.Next() {
+		e := TimelineEntry{}
+		var date, arrived int64
+		var refs, newsgroups string
+		if err := rows.Scan(&e.Id, &e.MessageId, &date, &e.From, &e.Subject, &refs, &newsgroups, &arrived); err != nil {
+			return ret, serr.New(err)
+		}
+		e.Newsgroups = strings.Split(newsgroups, ",")
+		if e.Group = dbs.timelineGroup(session, e.Id, e.Newsgroups, groupFilter); e.Group == "" {
+			continue
+		}
+		e.Date = time.Unix(date, 0)
+		e.Arrived = time.Unix(arrived, 0)
+		e.References = strings.Fields(refs)
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+// unindexArticle drops an article from the timeline, once it's in no group.
+func (dbs *backendDbs) unindexArticle(messageId string) error {
+	if _, err := dbs.articles.Exec("DELETE FROM timeline WHERE messageid=?;", messageId); err != nil {
+		slog.Info("Failed to remove article from the timeline", "messageId", messageId, "error", err)
+		return serr.New(err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package events
+
+import (
+	"slices"
+	"time"
+)
+
+// EventType is what happened on the node.
+type EventType string
+
+const (
+	ArticleStored    = EventType("ArticleStored")
+	ArticleCancelled = EventType("ArticleCancelled")
+	GroupCreated     = EventType("GroupCreated")
+	PeerConnected    = EventType("PeerConnected")
+	PeerRequest      = EventType("PeerRequest")
+	ReactionAdded    = EventType("ReactionAdded")
+)
+
+// SubscriberBuffer is how many events a subscriber can fall behind before
+// events are dropped for it, the bus never waits for slow subscribers.
+const SubscriberBuffer = 64
+
+type Event struct {
+	Type      EventType `json:"type"`
+	Time      time.Time `json:"time"`
+	Group     string    `json:"group,omitempty"`
+	Number    int64     `json:"number,omitempty"`
+	MessageId string    `json:"messageid,omitempty"`
+	TorId     string    `json:"torid,omitempty"`
+}
+
+// Filter selects the events a subscriber gets, empty fields match
+// everything.
+type Filter struct {
+	Types  []EventType
+	Groups []string
+}
+
+func (f Filter) Match(e Event) bool {
+	if len(f.Types) > 0 && !slices.Contains(f.Types, e.Type) {
+		return false
+	}
+	if len(f.Groups) > 0 && !slices.Contains(f.Groups, e.Group) {
+		return false
+	}
+	return true
+}
+
+type BusCommand string
+
+const (
+	CmdPublish     = BusCommand("Publish")
+	CmdSubscribe   = BusCommand("Subscribe")
+	CmdUnsubscribe = BusCommand("Unsubscribe")
+)
+
+type BusMessage struct {
+	Cmd  BusCommand
+	Args []interface{}
+}
+
+type subscriber struct {
+	filter Filter
+	ch     chan Event
+}
+
+// Bus hands events from the node to local subscribers. A nil *Bus drops
+// everything, so parts of the node work without one.
+type Bus struct {
+	Cmd chan BusMessage
+}
+
+func NewBus() *Bus {
+	b := &Bus{Cmd: make(chan BusMessage, SubscriberBuffer)}
+	go b.worker()
+	return b
+}
+
+func (b *Bus) worker() {
+	subs := map[<-chan Event]subscriber{}
+
+	for cmd := range b.Cmd {
+		switch cmd.Cmd {
+		case CmdPublish: // Args: []interface{}{event},
+			e := cmd.Args[0].(Event)
+			for _, s := range subs {
+				if !s.filter.Match(e) {
+					continue
+				}
+				select {
+				case s.ch <- e:
+				default:
+				}
+			}
+
+		case CmdSubscribe: // Args: []interface{}{filter, ret},
+			ret := cmd.Args[1].(chan (<-chan Event))
+			s := subscriber{filter: cmd.Args[0].(Filter), ch: make(chan Event, SubscriberBuffer)}
+			subs[s.ch] = s
+			ret <- s.ch
+			close(ret)
+
+		case CmdUnsubscribe: // Args: []interface{}{ch},
+			ch := cmd.Args[0].(<-chan Event)
+			if s, ok := subs[ch]; ok {
+				close(s.ch)
+				delete(subs, ch)
+			}
+		}
+	}
+}
+
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	b.Cmd <- BusMessage{
+		Cmd:  CmdPublish,
+		Args: []interface{}{e},
+	}
+}
+
+// Subscribe returns a channel of the events matching filter, it's closed by
+// Unsubscribe.
+func (b *Bus) Subscribe(filter Filter) <-chan Event {
+	ret := make(chan (<-chan Event))
+	b.Cmd <- BusMessage{
+		Cmd:  CmdSubscribe,
+		Args: []interface{}{filter, ret},
+	}
+	return <-ret
+}
+
+func (b *Bus) Unsubscribe(ch <-chan Event) {
+	b.Cmd <- BusMessage{
+		Cmd:  CmdUnsubscribe,
+		Args: []interface{}{ch},
+	}
+}
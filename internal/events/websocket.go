@@ -0,0 +1,73 @@
+package events
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// Handler streams events as JSON over a WebSocket, filtered by the "type"
+// and "group" query parameters, which can be repeated:
+//
+//	ws://127.0.0.1:<port>/events?type=ArticleStored&group=<torid>.general
+func Handler(b *Bus) http.Handler {
+	return websocket.Server{
+		Handshake: checkOrigin,
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			query := ws.Request().URL.Query()
+			filter := Filter{Groups: query["group"]}
+			for _, t := range query["type"] {
+				filter.Types = append(filter.Types, EventType(t))
+			}
+
+			ch := b.Subscribe(filter)
+			defer b.Unsubscribe(ch)
+
+			// nothing is read from the client, this only notices it going.
+			closed := make(chan struct{})
+			go func() {
+				io.Copy(io.Discard, ws)
+				close(closed)
+			}()
+
+			for {
+				select {
+				case e, ok := <-ch:
+					if !ok {
+						return
+					}
+					if err := websocket.JSON.Send(ws, e); err != nil {
+						slog.Info("Event stream closed", "error", err)
+						return
+					}
+				case <-closed:
+					return
+				}
+			}
+		},
+	}
+}
+
+// checkOrigin stops web pages on other sites using a browser to listen in,
+// local apps don't send an Origin at all.
+func checkOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if host == "localhost" || host == "127.0.0.1" || host == "::1" || strings.EqualFold(u.Host, req.Host) {
+		return nil
+	}
+	return websocket.ErrBadWebSocketOrigin
+}
@@ -0,0 +1,102 @@
+package nntpbackend
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/kothawoc/go-nntp"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+// ErrAuthFailed is RFC 4643's answer to a wrong username or password.
+var ErrAuthFailed = &nntpserver.NNTPError{Code: 481, Msg: "Authentication failed/rejected"}
+
+// AccountNntpBackend is handed to TCP sessions that logged in with a local
+// account, it limits what they can do to the account's role.
+type AccountNntpBackend struct {
+	NextBackend *NntpBackend
+}
+
+// signingKey is the key new posts from the session get signed with, the
+// logged in account's own key, or the device key for local sessions and the
+// owner, who posts as the node.
+func (be *NntpBackend) signingKey(session map[string]string) (keytool.EasyEdKey, error) {
+	if user := session["User"]; user != "" && session["Role"] != string(databases.RoleOwner) {
+		return be.DBs.GetAccountKey(user)
+	}
+	return be.DBs.ConfigGetDeviceKey()
+}
+
+func (be *AccountNntpBackend) role(session map[string]string) databases.AccountRole {
+	return databases.AccountRole(session["Role"])
+}
+
+func (be *AccountNntpBackend) ListGroups(session map[string]string) (<-chan *nntp.Group, error) {
+	return be.NextBackend.ListGroups(session)
+}
+
+func (be *AccountNntpBackend) GetGroup(session map[string]string, name string) (*nntp.Group, error) {
+	return be.NextBackend.GetGroup(session, name)
+}
+
+func (be *AccountNntpBackend) GetArticleWithNoGroup(session map[string]string, id string) (*nntp.Article, error) {
+	if id == messages.NewsrcMessageId {
+		lines, err := be.NextBackend.DBs.GetNewsrc(session["User"])
+		if err != nil {
+			return nil, err
+		}
+		return messages.NewsrcArticle(messages.FormatNewsrc(lines)), nil
+	}
+	return be.NextBackend.GetArticleWithNoGroup(session, id)
+}
+
+func (be *AccountNntpBackend) GetArticle(session map[string]string, group *nntp.Group, id string) (*nntp.Article, error) {
+	return be.NextBackend.GetArticle(session, group, id)
+}
+
+func (be *AccountNntpBackend) GetArticles(session map[string]string, group *nntp.Group, from, to int64) (<-chan nntpserver.NumberedArticle, error) {
+	return be.NextBackend.GetArticles(session, group, from, to)
+}
+
+func (be *AccountNntpBackend) Authorized(session map[string]string) bool {
+	return true
+}
+
+func (be *AccountNntpBackend) Authenticate(session map[string]string, user, pass string) (nntpserver.Backend, error) {
+	return nil, nil
+}
+
+// AllowPost is true for readers too, they can still post their newsrc.
+func (be *AccountNntpBackend) AllowPost(session map[string]string) bool {
+	return true
+}
+
+func (be *AccountNntpBackend) Post(session map[string]string, article *nntp.Article) error {
+	if article.Header.Get("Control") == "newsrc" {
+		newsrc, err := messages.NewsrcFromArticle(article)
+		if err != nil {
+			return nntpserver.ErrPostingFailed
+		}
+		if err := be.NextBackend.SetNewsrc(session["User"], newsrc); err != nil {
+			slog.Info("Failed to set newsrc", "user", session["User"], "error", err)
+			return nntpserver.ErrPostingFailed
+		}
+		return nil
+	}
+
+	switch be.role(session) {
+	case databases.RoleOwner:
+		return be.NextBackend.Post(session, article)
+	case databases.RoleUser:
+		ctl := strings.Split(article.Header.Get("Control"), " ")[0]
+		if ctl != "" && ctl != "cancel" && ctl != "react" && ctl != "chunk" {
+			slog.Info("Account not allowed to send control messages", "user", session["User"], "control", ctl)
+			return nntpserver.ErrPostingNotPermitted
+		}
+		return be.NextBackend.Post(session, article)
+	}
+	return nntpserver.ErrPostingNotPermitted
+}
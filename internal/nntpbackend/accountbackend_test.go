@@ -0,0 +1,98 @@
+package nntpbackend
+
+import (
+	"errors"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kothawoc/go-nntp"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+
+	"github.com/kothawoc/kothawoc/internal/databases"
+)
+
+func newTestBackend(t *testing.T) *NntpBackend {
+	path := t.TempDir()
+	// the client makes it before it opens the store.
+	if err := os.MkdirAll(filepath.Join(path, "articles"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	dbs, err := databases.NewBackendDbs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &NntpBackend{DBs: dbs}
+}
+
+func login(t *testing.T, be *NntpBackend, addr, user, pass string) (nntpserver.Backend, map[string]string, error) {
+	session := map[string]string{"ConnMode": ConnModeTcp, "RemoteAddr": addr}
+	empty := &EmptyNntpBackend{DBs: be.DBs, NextBackend: be}
+	next, err := empty.Authenticate(session, user, pass)
+	return next, session, err
+}
+
+func TestAccountRoles(t *testing.T) {
+	be := newTestBackend(t)
+	for user, role := range map[string]databases.AccountRole{"reader": databases.RoleReader, "user": databases.RoleUser} {
+		if err := be.DBs.AddAccount(user, "secret", role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	post := func(control string) *nntp.Article {
+		header := textproto.MIMEHeader{"Newsgroups": {"kothawoc.test"}, "Subject": {"hello"}}
+		if control != "" {
+			header.Set("Control", control)
+		}
+		return &nntp.Article{Header: header, Body: strings.NewReader("hello\r\n")}
+	}
+
+	reader, session, err := login(t, be, "192.0.2.1", "reader", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session["Role"] != string(databases.RoleReader) || session["Id"] == "" {
+		t.Errorf("reader session %v", session)
+	}
+	if err := reader.Post(session, post("")); !errors.Is(err, nntpserver.ErrPostingNotPermitted) {
+		t.Errorf("reader posted, %v", err)
+	}
+
+	user, session, err := login(t, be, "192.0.2.1", "user", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, control := range []string{"newgroup kothawoc.test", "rmgroup kothawoc.test", "block someone"} {
+		if err := user.Post(session, post(control)); !errors.Is(err, nntpserver.ErrPostingNotPermitted) {
+			t.Errorf("user sent %s, %v", control, err)
+		}
+	}
+	// a user posts as their own identity, not the node's.
+	key, err := be.signingKey(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := key.TorId(); id != session["Id"] || id != session["UserId"] {
+		t.Errorf("user signs as %s, is %s", id, session["UserId"])
+	}
+}
+
+func TestLoginFailuresLimited(t *testing.T) {
+	be := newTestBackend(t)
+	if err := be.DBs.AddAccount("user", "secret", databases.RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxLoginFailures; i++ {
+		if _, _, err := login(t, be, "192.0.2.2", "user", "guess"); err != ErrAuthFailed {
+			t.Fatalf("wrong password, %v", err)
+		}
+	}
+	if _, _, err := login(t, be, "192.0.2.2", "user", "secret"); err != ErrAuthFailed {
+		t.Errorf("login allowed after %d failures, %v", maxLoginFailures, err)
+	}
+	if _, _, err := login(t, be, "192.0.2.3", "user", "secret"); err != nil {
+		t.Errorf("another address refused, %v", err)
+	}
+}
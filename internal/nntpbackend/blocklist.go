@@ -0,0 +1,69 @@
+package nntpbackend
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// pathHops returns the torids an article passed through, skipping the
+// .POSTED marker.
+func pathHops(path string) []string {
+	hops := []string{}
+	for _, hop := range strings.Split(path, "!") {
+		if hop != "" && !strings.HasPrefix(hop, ".") {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// checkBlocked refuses articles from, or relayed by, a blocked torid and
+// records why in the history.
+func (be *NntpBackend) checkBlocked(msg *messages.MessageTool) error {
+	from := msg.Article.Header.Get("From")
+	torids := append([]string{from}, pathHops(msg.Article.Header.Get("Path"))...)
+
+	entry, blocked := be.DBs.IsBlocked(torids...)
+	if !blocked {
+		return nil
+	}
+
+	reason := "blocked " + entry.TorId + " by " + entry.Source
+	if entry.Reason != "" {
+		reason += ": " + entry.Reason
+	}
+	slog.Info("Rejecting article from blocked node", "messageid", msg.Article.Header.Get("Message-Id"), "reason", reason)
+
+	if err := be.DBs.AddHistory(msg.Article.Header.Get("Message-Id"), from, reason); err != nil {
+		slog.Info("Failed to record history", "error", err)
+	}
+	return serr.Errorf("%s", reason)
+}
+
+// blockAdvisory applies a block from a friend, if we follow their blocklist.
+func (be *NntpBackend) blockAdvisory(from, torId, reason string) error {
+	myKey, err := be.DBs.ConfigGetDeviceKey()
+	if err != nil {
+		return serr.New(err)
+	}
+	myId, _ := myKey.TorId()
+	if from == myId || torId == myId || !be.DBs.IsFollowingBlocklist(from) {
+		return nil
+	}
+
+	slog.Info("Applying block advisory", "from", from, "torid", torId, "reason", reason)
+	if err := be.DBs.Block(torId, from, reason); err != nil {
+		return serr.New(err)
+	}
+	return serr.New(be.Peers.RemovePeer(torId))
+}
+
+func (be *NntpBackend) unblockAdvisory(from, torId string) error {
+	if !be.DBs.IsFollowingBlocklist(from) {
+		return nil
+	}
+	return serr.New(be.DBs.Unblock(torId, from))
+}
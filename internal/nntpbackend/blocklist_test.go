@@ -0,0 +1,96 @@
+package nntpbackend
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	nntpserver "github.com/kothawoc/go-nntp/server"
+
+	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/internal/peering"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+func TestBlockedArticles(t *testing.T) {
+	be := newTestBackend(t)
+	setDeviceKey(t, be)
+	blocked, blockedId := testKey(t)
+	author, _ := testKey(t)
+	_, relayId := testKey(t)
+	for _, torid := range []string{blockedId, relayId} {
+		if err := be.DBs.Block(torid, databases.BlockSourceLocal, "spam"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		msg  *messages.MessageTool
+		path string
+	}{
+		{"from a blocked node", testArticle(t, blocked, "kothawoc.test", ""), "peer"},
+		{"relayed by a blocked node", testArticle(t, author, "kothawoc.test", ""), "peer!" + relayId + "!origin"},
+	}
+	for _, test := range tests {
+		session := map[string]string{"ConnMode": ConnModeTor, "Id": "peer"}
+		if err := be.Post(session, fromPeer(t, test.msg, test.path)); !errors.Is(err, nntpserver.ErrPostingNotPermitted) {
+			t.Errorf("%s: posted, %v", test.name, err)
+		}
+		reason, err := be.DBs.GetHistory(test.msg.Article.Header.Get("Message-Id"))
+		if err != nil || !strings.Contains(reason, "spam") {
+			t.Errorf("%s: history %q, %v", test.name, reason, err)
+		}
+		if _, err := be.DBs.GetHistory("<unrefused@kothawoc.test>"); err == nil {
+			t.Errorf("%s: history of an article that wasn't refused", test.name)
+		}
+	}
+}
+
+// A block from a friend whose blocklist we follow drops the connection to a
+// peer it blocks.
+func TestBlockDropsPeer(t *testing.T) {
+	be := newTestBackend(t)
+	myKey, _ := setDeviceKey(t, be)
+	peerKey, peerId := testKey(t)
+	_, friendId := testKey(t)
+	if err := be.DBs.FollowBlocklist(friendId, true); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := peering.NewPeer(nil, make(chan peering.PeeringMessage, 10), myKey, peerKey, be.DBs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	peer.Conn = local
+	peers := &peering.Peers{
+		Conns: map[string]*peering.Peer{peerId: peer},
+		Cmd:   make(chan peering.PeeringMessage, 10),
+		Exit:  make(chan interface{}),
+		MyKey: myKey,
+		DBs:   be.DBs,
+	}
+	go peers.Worker()
+	defer close(peers.Exit)
+	be.Peers = peers
+
+	if err := be.blockAdvisory(friendId, peerId, "spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the blocked peer's connection is still open, %v", err)
+	}
+	status, err := peers.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 0 {
+		t.Errorf("the blocked peer's still a peer, %v", status)
+	}
+}
@@ -0,0 +1,37 @@
+package nntpbackend
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+// contentPolicy is the content policy a group was created with, if any.
+func (be *NntpBackend) contentPolicy(group string) (messages.ContentPolicy, bool) {
+	maxSize, err := be.DBs.GroupConfigGetInt64(group, "ContentMaxSize")
+	if err != nil {
+		return messages.ContentPolicy{}, false
+	}
+	policy := messages.ContentPolicy{MaxSize: maxSize}
+	types, _ := be.DBs.GroupConfigGetString(group, "ContentTypes")
+	for _, t := range strings.Split(types, ",") {
+		if t != "" {
+			policy.Types = append(policy.Types, t)
+		}
+	}
+	return policy, true
+}
+
+// allowedContent checks an article's attachments against a group's policy.
+func (be *NntpBackend) allowedContent(group string, msg *messages.MessageTool) bool {
+	policy, ok := be.contentPolicy(group)
+	if !ok {
+		return true
+	}
+	if err := policy.Check(msg); err != nil {
+		slog.Info("Article content not allowed in group", "group", group, "messageId", msg.Article.Header.Get("Message-Id"), "error", err)
+		return false
+	}
+	return true
+}
@@ -71,9 +71,39 @@ func (be *EmptyNntpBackend) Authorized(session map[string]string) bool {
 	return false
 }
 
-func (be *EmptyNntpBackend) Authenticate(usession map[string]string, ser, pass string) (nntpserver.Backend, error) {
+func (be *EmptyNntpBackend) Authenticate(session map[string]string, user, pass string) (nntpserver.Backend, error) {
 	slog.Info("E Authenticate")
-	return be.NextBackend, nil
+	if session["Invited"] == "true" {
+		return &InviteNntpBackend{NextBackend: be.NextBackend.(*NntpBackend)}, nil
+	}
+
+	// tor peers proved who they are in the handshake, local sessions are
+	// ourselves, TCP clients have to log in.
+	if session["ConnMode"] != ConnModeTcp {
+		return be.NextBackend, nil
+	}
+
+	addr := session["RemoteAddr"]
+	if !tcpLogins.allowed(addr) {
+		slog.Info("TCP login refused, too many failures", "user", user, "address", addr)
+		return nil, ErrAuthFailed
+	}
+	account, err := be.DBs.CheckAccount(user, pass)
+	if err != nil {
+		tcpLogins.failed(addr)
+		slog.Info("TCP login failed", "user", user, "address", addr, "error", err)
+		return nil, ErrAuthFailed
+	}
+	tcpLogins.succeeded(addr)
+	session["User"] = account.Username
+	session["UserId"] = account.Id
+	session["Role"] = string(account.Role)
+	// only the owner acts as the node, the others get the group perms of
+	// their own identity.
+	if account.Role != databases.RoleOwner {
+		session["Id"] = account.Id
+	}
+	return &AccountNntpBackend{NextBackend: be.NextBackend.(*NntpBackend)}, nil
 }
 
 func (be *EmptyNntpBackend) AllowPost(session map[string]string) bool {
@@ -0,0 +1,250 @@
+package nntpbackend
+
+import (
+	"log/slog"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kothawoc/go-nntp"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+	"github.com/kothawoc/kothawoc/internal/events"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+// ephemeralArticle is kept as the raw signed mail, so every read gets its
+// own body reader.
+type ephemeralArticle struct {
+	num       int64
+	messageId string
+	raw       string
+	expires   time.Time
+}
+
+// Whatever the group creator asked for, a node keeps no more than this.
+const (
+	maxEphemeralTTL   = 24 * time.Hour
+	maxEphemeralSize  = 1000
+	maxEphemeralBytes = 32 * 1024 * 1024
+)
+
+// ephemeralGroup is a ring of the latest articles in a group.
+type ephemeralGroup struct {
+	articles []ephemeralArticle
+}
+
+// ephemeralStore holds the articles of ephemeral groups, only in RAM.
+// Numbers are shared by every group and keep counting up from 1 for as long
+// as the node runs, so a group that empties can be dropped and come back
+// without reusing them.
+type ephemeralStore struct {
+	lock   sync.Mutex
+	groups map[string]*ephemeralGroup
+	high   int64
+	bytes  int
+}
+
+func newEphemeralStore() *ephemeralStore {
+	return &ephemeralStore{groups: map[string]*ephemeralGroup{}}
+}
+
+// drop removes the first n articles of a group, must be called with the
+// lock held.
+func (s *ephemeralStore) drop(g *ephemeralGroup, n int) {
+	for _, a := range g.articles[:n] {
+		s.bytes -= len(a.raw)
+	}
+	g.articles = append([]ephemeralArticle{}, g.articles[n:]...)
+}
+
+// expire drops articles past their ttl, must be called with the lock held.
+func (s *ephemeralStore) expire(group string) *ephemeralGroup {
+	g, ok := s.groups[group]
+	if !ok {
+		return &ephemeralGroup{}
+	}
+	now := time.Now()
+	i := 0
+	for i < len(g.articles) && now.After(g.articles[i].expires) {
+		i++
+	}
+	if i > 0 {
+		s.drop(g, i)
+	}
+	return g
+}
+
+// sweep expires every group and forgets the empty ones, then drops the
+// oldest articles until the store fits in maxEphemeralBytes. Must be called
+// with the lock held.
+func (s *ephemeralStore) sweep() {
+	for group := range s.groups {
+		if len(s.expire(group).articles) == 0 {
+			delete(s.groups, group)
+		}
+	}
+	for s.bytes > maxEphemeralBytes {
+		var oldest *ephemeralGroup
+		for _, g := range s.groups {
+			if len(g.articles) > 0 && (oldest == nil || g.articles[0].num < oldest.articles[0].num) {
+				oldest = g
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		s.drop(oldest, 1)
+	}
+}
+
+// add stores an article and returns its number, 0 if it's already there.
+func (s *ephemeralStore) add(group, messageId, raw string, ttl time.Duration, size int) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(raw) > maxEphemeralBytes {
+		return 0
+	}
+	g := s.expire(group)
+	for _, a := range g.articles {
+		if a.messageId == messageId {
+			return 0
+		}
+	}
+	s.groups[group] = g
+
+	s.high++
+	g.articles = append(g.articles, ephemeralArticle{
+		num:       s.high,
+		messageId: messageId,
+		raw:       raw,
+		expires:   time.Now().Add(ttl),
+	})
+	s.bytes += len(raw)
+	if len(g.articles) > size {
+		s.drop(g, len(g.articles)-size)
+	}
+	s.sweep()
+	return s.high
+}
+
+// stats returns count, low and high like GROUP does.
+func (s *ephemeralStore) stats(group string) (int64, int64, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	g := s.expire(group)
+	if len(g.articles) == 0 {
+		return 0, s.high + 1, s.high
+	}
+	return int64(len(g.articles)), g.articles[0].num, g.articles[len(g.articles)-1].num
+}
+
+// get finds an article by number or message id.
+func (s *ephemeralStore) get(group, id string) (*nntp.Article, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	num, _ := strconv.ParseInt(id, 10, 64)
+	for _, a := range s.expire(group).articles {
+		if a.messageId == id || a.num == num {
+			return ephemeralToArticle(a.raw), true
+		}
+	}
+	return nil, false
+}
+
+// getById looks through every group for a message id.
+func (s *ephemeralStore) getById(messageId string) (*nntp.Article, bool) {
+	s.lock.Lock()
+	groups := []string{}
+	for group := range s.groups {
+		groups = append(groups, group)
+	}
+	s.lock.Unlock()
+
+	for _, group := range groups {
+		if a, ok := s.get(group, messageId); ok {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+func (s *ephemeralStore) list(group string, from, to int64) []nntpserver.NumberedArticle {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := []nntpserver.NumberedArticle{}
+	for _, a := range s.expire(group).articles {
+		if a.num >= from && a.num <= to {
+			ret = append(ret, nntpserver.NumberedArticle{Num: a.num, Article: ephemeralToArticle(a.raw)})
+		}
+	}
+	return ret
+}
+
+func ephemeralToArticle(raw string) *nntp.Article {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	_, body, _ := strings.Cut(raw, "\r\n\r\n")
+	return &nntp.Article{
+		Header: textproto.MIMEHeader(msg.Header),
+		Body:   msg.Body,
+		Bytes:  len(body),
+		Lines:  strings.Count(body, "\n"),
+	}
+}
+
+// ephemeral returns the ttl and size of an ephemeral group, capped to what
+// we keep.
+func (be *NntpBackend) ephemeral(group string) (time.Duration, int, bool) {
+	ttl, err := be.DBs.GroupConfigGetInt64(group, "EphemeralTTL")
+	if err != nil || ttl <= 0 {
+		return 0, 0, false
+	}
+	size, err := be.DBs.GroupConfigGetInt64(group, "EphemeralSize")
+	if err != nil || size <= 0 {
+		return 0, 0, false
+	}
+	return min(time.Duration(ttl)*time.Second, maxEphemeralTTL), int(min(size, maxEphemeralSize)), true
+}
+
+// postEphemeral keeps an article of an ephemeral group in RAM and pushes it
+// to the connected peers, it's never written to disk.
+func (be *NntpBackend) postEphemeral(session map[string]string, msg *messages.MessageTool, group string) error {
+	if post := be.DBs.GetPerms(session["Id"], group); post != nil && !post.Post {
+		return nntpserver.ErrPostingNotPermitted
+	}
+	if !be.allowedContent(group, msg) {
+		return nntpserver.ErrPostingNotPermitted
+	}
+	if !be.approved(group, msg) {
+		return nntpserver.ErrPostingNotPermitted
+	}
+	if subjectOnly, _ := be.DBs.GroupConfigGetInt64(group, "EphemeralSubjectOnly"); subjectOnly == 1 &&
+		(len(msg.Parts) > 0 || strings.TrimSpace(msg.Preamble) != "") {
+		slog.Info("Ephemeral group only takes a subject", "group", group)
+		return nntpserver.ErrPostingNotPermitted
+	}
+
+	ttl, size, _ := be.ephemeral(group)
+	num := be.ephemerals.add(group, msg.Article.Header.Get("Message-Id"), msg.RawMail(), ttl, size)
+	if num == 0 {
+		return nntpserver.ErrPostingFailed
+	}
+	be.Peers.DistributeEphemeral(*msg)
+	be.Events.Publish(events.Event{
+		Type:      events.ArticleStored,
+		Group:     group,
+		Number:    num,
+		MessageId: msg.Article.Header.Get("Message-Id"),
+		TorId:     msg.Article.Header.Get("From"),
+	})
+	return nil
+}
@@ -0,0 +1,69 @@
+package nntpbackend
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+)
+
+// Ephemeral groups take articles crossposted with other groups, which are
+// stored as usual, but controls only act through the other groups.
+func TestPostEphemeral(t *testing.T) {
+	be := newTestBackend(t)
+	setDeviceKey(t, be)
+	fakePeers(t, be)
+	be.ephemerals = newEphemeralStore()
+	owner, ownerId := testKey(t)
+	author, _ := testKey(t)
+
+	chat, general := ownerId+".chat", ownerId+".general"
+	for _, group := range []string{chat, general} {
+		if err := be.DBs.NewGroup(group, group, vcard.Card{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, val := range map[string]int64{"EphemeralTTL": 60, "EphemeralSize": 10} {
+		if err := be.DBs.GroupConfigSet(chat, key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session := map[string]string{"ConnMode": ConnModeTor, "Id": "peer"}
+	inChat := func() int64 {
+		count, _, _ := be.ephemerals.stats(chat)
+		return count
+	}
+
+	msg := testArticle(t, author, chat+","+general, "")
+	if err := be.Post(session, fromPeer(t, msg, "peer")); err != nil {
+		t.Fatal(err)
+	}
+	if inChat() != 1 {
+		t.Errorf("%d articles in the ephemeral group", inChat())
+	}
+	if _, err := be.DBs.GetArticleById(msg.Article.Header.Get("Message-Id")); err != nil {
+		t.Error("crossposted article not stored", err)
+	}
+
+	made := ownerId + ".made"
+	msg = testArticle(t, owner, chat, "newgroup "+made)
+	if err := be.Post(session, fromPeer(t, msg, "peer")); !errors.Is(err, nntpserver.ErrPostingNotPermitted) {
+		t.Errorf("control posted to an ephemeral group, %v", err)
+	}
+	if id, _ := be.DBs.GetGroupNumber(made); id != 0 {
+		t.Error("control to an ephemeral group acted on")
+	}
+
+	msg = testArticle(t, owner, strings.Join([]string{chat, general}, ","), "newgroup "+made)
+	if err := be.Post(session, fromPeer(t, msg, "peer")); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := be.DBs.GetGroupNumber(made); id == 0 {
+		t.Error("crossposted control not acted on")
+	}
+	if inChat() != 1 {
+		t.Errorf("control added to the ephemeral group, %d articles", inChat())
+	}
+}
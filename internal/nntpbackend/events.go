@@ -0,0 +1,46 @@
+package nntpbackend
+
+import (
+	"strings"
+
+	"github.com/emersion/go-vcard"
+
+	"github.com/kothawoc/kothawoc/internal/events"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+// newGroup and cancel wrap the database for the control messages, to tell
+// local apps about them.
+func (be *NntpBackend) newGroup(name, description string, card vcard.Card) error {
+	if err := be.DBs.NewGroup(name, description, card); err != nil {
+		return err
+	}
+	be.Events.Publish(events.Event{Type: events.GroupCreated, Group: name})
+	return nil
+}
+
+func (be *NntpBackend) cancel(from, messageId, newsgroups string, cmf messages.ControMesasgeFunctions) error {
+	if err := be.DBs.CancelMessage(from, messageId, newsgroups, cmf); err != nil {
+		return err
+	}
+	be.Events.Publish(events.Event{Type: events.ArticleCancelled, Group: newsgroups, MessageId: messageId, TorId: from})
+	return nil
+}
+
+// rmGroup also drops the peer when its peering group is removed, from either
+// end.
+func (be *NntpBackend) rmGroup(name string) error {
+	if err := be.DBs.RemoveGroup(name); err != nil {
+		return err
+	}
+	if owner, peer, ok := strings.Cut(name, ".peers."); ok {
+		if myId, _ := be.Peers.MyKey.TorId(); peer == myId {
+			peer = owner
+		}
+		if err := be.DBs.DeletePeer(peer); err != nil {
+			return err
+		}
+		be.Peers.RemovePeer(peer)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package nntpbackend
+
+import (
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/kothawoc/go-nntp"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// PostLocal posts a signed article as if it came from the local client, this
+// is how the node sends control messages on its own behalf.
+func (be *NntpBackend) PostLocal(rawMail string) error {
+	msg, err := mail.ReadMessage(strings.NewReader(rawMail))
+	if err != nil {
+		return serr.New(err)
+	}
+
+	myKey, err := be.DBs.ConfigGetDeviceKey()
+	if err != nil {
+		return serr.New(err)
+	}
+	myId, _ := myKey.TorId()
+	pubKey, _ := myKey.TorPubKey()
+
+	session := map[string]string{
+		"Id":       myId,
+		"PubKey":   fmt.Sprintf("%x", pubKey),
+		"ConnMode": ConnModeLocal,
+	}
+
+	return be.Post(session, &nntp.Article{
+		Header: textproto.MIMEHeader(msg.Header),
+		Body:   msg.Body,
+	})
+}
+
+// recipient returns our torid if the peering group newsgroups is addressed
+// to us, otherwise it's our own copy of a message we sent.
+func (be *NntpBackend) recipient(newsgroups string) (string, bool) {
+	myKey, err := be.DBs.ConfigGetDeviceKey()
+	if err != nil {
+		return "", false
+	}
+	myId, _ := myKey.TorId()
+
+	splitGroup := strings.Split(newsgroups, ".")
+	return myId, splitGroup[len(splitGroup)-1] == myId
+}
+
+func (be *NntpBackend) isPeer(torId string) bool {
+	peers, _ := be.DBs.GetPeerList()
+	for _, p := range peers {
+		if p == torId {
+			return true
+		}
+	}
+	return false
+}
+
+// addPeer peers with the other side of a peering group we've stored, when a
+// peer creates its side of one the other side is us.
+func (be *NntpBackend) addPeer(torId string) error {
+	if myId, ok := be.recipient(torId); ok && myId == torId {
+		return nil
+	}
+	return serr.New(be.Peers.AddPeer(torId))
+}
+
+func (be *NntpBackend) introduce(introducer, newsgroups, torId, name string, chain []string) error {
+	myId, ok := be.recipient(newsgroups)
+	if !ok || torId == myId {
+		return nil
+	}
+
+	slog.Info("Received introduction", "introducer", introducer, "torid", torId, "name", name, "chain", chain)
+	return serr.New(be.DBs.AddSuggestion(torId, name, introducer, chain))
+}
+
+// introAccept runs on the introducer, the peer from accepted our
+// recommendation of torId, so relay it, and the name from gave, to torId.
+func (be *NntpBackend) introAccept(from, newsgroups, torId, name string) error {
+	if _, ok := be.recipient(newsgroups); !ok {
+		return nil
+	}
+
+	if _, err := be.DBs.GetIntroduction(torId, from); err != nil {
+		slog.Info("Introduction accept without introduction", "from", from, "torid", torId, "error", err)
+		return serr.New(err)
+	}
+
+	myKey, err := be.DBs.ConfigGetDeviceKey()
+	if err != nil {
+		return serr.New(err)
+	}
+
+	mail, err := messages.CreateIntroConfirm(myKey, be.IdGen, torId, from, name)
+	if err != nil {
+		return serr.New(err)
+	}
+
+	return serr.New(be.PostLocal(mail))
+}
+
+// introConfirm runs on the recommended node, our peer from introduced us to
+// torId and they accepted, so create our side of the peering group. We
+// trusted from enough to peer with them, so we take who they vouch for.
+func (be *NntpBackend) introConfirm(from, newsgroups, torId, name string) error {
+	if _, ok := be.recipient(newsgroups); !ok {
+		return nil
+	}
+
+	if be.isPeer(torId) {
+		return nil
+	}
+	if !be.isPeer(from) {
+		slog.Info("Introduction confirm from a node that isn't a peer", "from", from, "torid", torId)
+		return serr.Errorf("introduction confirm from %s, who isn't a peer", from)
+	}
+
+	myKey, err := be.DBs.ConfigGetDeviceKey()
+	if err != nil {
+		return serr.New(err)
+	}
+
+	slog.Info("Introduction confirmed", "introducer", from, "torid", torId, "name", name)
+
+	mail, err := messages.CreatePeerGroup(myKey, be.IdGen, "", name, torId)
+	if err != nil {
+		return serr.New(err)
+	}
+
+	return serr.New(be.PostLocal(mail))
+}
@@ -0,0 +1,78 @@
+package nntpbackend
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/kothawoc/kothawoc/internal/peering"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+type testIds struct{}
+
+func (testIds) GenID() string {
+	articles++
+	return fmt.Sprintf("<test-%d@kothawoc.test>", articles)
+}
+
+// fakePeers stands in for the peer workers, it adds peers to the database
+// but never dials them.
+func fakePeers(t *testing.T, be *NntpBackend) {
+	peers := &peering.Peers{
+		Conns: map[string]*peering.Peer{},
+		Cmd:   make(chan peering.PeeringMessage, 10),
+		DBs:   be.DBs,
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case cmd := <-peers.Cmd:
+				if cmd.Cmd == peering.CmdAddPeer {
+					errChan := cmd.Args[1].(chan error)
+					errChan <- be.DBs.AddPeer(cmd.Args[0].(string))
+					close(errChan)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	be.Peers = peers
+	be.IdGen = testIds{}
+}
+
+func TestIntroConfirm(t *testing.T) {
+	be := newTestBackend(t)
+	myKey, myId := setDeviceKey(t, be)
+	fakePeers(t, be)
+	_, introducerId := testKey(t)
+	_, strangerId := testKey(t)
+	_, introducedId := testKey(t)
+	mail, err := messages.CreatePeerGroup(myKey, be.IdGen, "", "introducer", introducerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := be.PostLocal(mail); err != nil || !be.isPeer(introducerId) {
+		t.Fatal("failed to peer with the introducer", err)
+	}
+
+	// only a peer's word is taken.
+	if err := be.introConfirm(strangerId, strangerId+".peers."+myId, introducedId, "introduced"); err == nil {
+		t.Error("a stranger's introduction was confirmed")
+	}
+	if be.isPeer(introducedId) {
+		t.Fatal("peered on a stranger's introduction")
+	}
+
+	if err := be.introConfirm(introducerId, introducerId+".peers."+myId, introducedId, "introduced"); err != nil {
+		t.Fatal(err)
+	}
+	if !be.isPeer(introducedId) {
+		t.Error("not peered on a confirmed introduction")
+	}
+	if id, err := be.DBs.GetGroupNumber(myId + ".peers." + introducedId); err != nil || id == 0 {
+		t.Errorf("no peering group, %d, %v", id, err)
+	}
+}
@@ -0,0 +1,94 @@
+package nntpbackend
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/kothawoc/go-nntp"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+)
+
+// InviteNntpBackend is handed to nodes that aren't peers yet, but were let in
+// because we have open invites. They can only create their side of the
+// peering group and redeem the invite, once that makes them a peer the
+// session gets the full backend.
+type InviteNntpBackend struct {
+	NextBackend *NntpBackend
+}
+
+func (be *InviteNntpBackend) invited(session map[string]string) bool {
+	return session["Invited"] == "true"
+}
+
+func (be *InviteNntpBackend) ListGroups(session map[string]string) (<-chan *nntp.Group, error) {
+	if be.invited(session) {
+		return nil, nntpserver.ErrNotAuthenticated
+	}
+	return be.NextBackend.ListGroups(session)
+}
+
+func (be *InviteNntpBackend) GetGroup(session map[string]string, name string) (*nntp.Group, error) {
+	if be.invited(session) {
+		return nil, nntpserver.ErrNotAuthenticated
+	}
+	return be.NextBackend.GetGroup(session, name)
+}
+
+func (be *InviteNntpBackend) GetArticleWithNoGroup(session map[string]string, id string) (*nntp.Article, error) {
+	if be.invited(session) {
+		return nil, nntpserver.ErrNotAuthenticated
+	}
+	return be.NextBackend.GetArticleWithNoGroup(session, id)
+}
+
+func (be *InviteNntpBackend) GetArticle(session map[string]string, group *nntp.Group, id string) (*nntp.Article, error) {
+	if be.invited(session) {
+		return nil, nntpserver.ErrNotAuthenticated
+	}
+	return be.NextBackend.GetArticle(session, group, id)
+}
+
+func (be *InviteNntpBackend) GetArticles(session map[string]string, group *nntp.Group, from, to int64) (<-chan nntpserver.NumberedArticle, error) {
+	if be.invited(session) {
+		return nil, nntpserver.ErrNotAuthenticated
+	}
+	return be.NextBackend.GetArticles(session, group, from, to)
+}
+
+func (be *InviteNntpBackend) Authorized(session map[string]string) bool {
+	return true
+}
+
+func (be *InviteNntpBackend) Authenticate(session map[string]string, user, pass string) (nntpserver.Backend, error) {
+	return nil, nil
+}
+
+func (be *InviteNntpBackend) AllowPost(session map[string]string) bool {
+	return true
+}
+
+func (be *InviteNntpBackend) Post(session map[string]string, article *nntp.Article) error {
+	if !be.invited(session) {
+		return be.NextBackend.Post(session, article)
+	}
+
+	myId, ok := be.NextBackend.recipient(article.Header.Get("Newsgroups"))
+	peerGroup := session["Id"] + ".peers." + myId
+	splitCtl := strings.Split(article.Header.Get("Control"), " ")
+	if !ok || article.Header.Get("Newsgroups") != peerGroup ||
+		!(splitCtl[0] == "newgroup" && len(splitCtl) > 1 && splitCtl[1] == peerGroup ||
+			splitCtl[0] == "inviteaccept") {
+		slog.Info("Invited node posted outside its peering group", "torid", session["Id"], "newsgroups", article.Header.Get("Newsgroups"))
+		return nntpserver.ErrPostingNotPermitted
+	}
+
+	if err := be.NextBackend.Post(session, article); err != nil {
+		return err
+	}
+
+	if be.NextBackend.isPeer(session["Id"]) {
+		slog.Info("Invite redeemed, full access granted", "torid", session["Id"])
+		delete(session, "Invited")
+	}
+	return nil
+}
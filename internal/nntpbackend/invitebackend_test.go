@@ -0,0 +1,88 @@
+package nntpbackend
+
+import (
+	"bufio"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kothawoc/go-nntp"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+// rawFromPeer is the raw signed mail as it's posted by a peer, with its Path.
+func rawFromPeer(t *testing.T, mail, path string) *nntp.Article {
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(mail)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Set("Path", path)
+	return &nntp.Article{Header: header, Body: r.R}
+}
+
+func TestInvitedSession(t *testing.T) {
+	be := newTestBackend(t)
+	_, myId := setDeviceKey(t, be)
+	fakePeers(t, be)
+	strangerKey, strangerId := testKey(t)
+
+	secret := "0123456789abcdef"
+	if err := be.DBs.AddInvite(secret, time.Now().Add(time.Hour), databases.PermissionsGroupT{Read: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	session := map[string]string{"ConnMode": ConnModeTor, "Id": strangerId, "Invited": "true"}
+	next, err := (&EmptyNntpBackend{DBs: be.DBs, NextBackend: be}).Authenticate(session, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	invited, ok := next.(*InviteNntpBackend)
+	if !ok {
+		t.Fatalf("invited session got %T", next)
+	}
+
+	if _, err := invited.ListGroups(session); err != nntpserver.ErrNotAuthenticated {
+		t.Error("invited session listed groups", err)
+	}
+	if _, err := invited.GetGroup(session, myId+".peers."+strangerId); err != nntpserver.ErrNotAuthenticated {
+		t.Error("invited session got a group", err)
+	}
+	if _, err := invited.GetArticleWithNoGroup(session, "<any@kothawoc.test>"); err != nntpserver.ErrNotAuthenticated {
+		t.Error("invited session got an article", err)
+	}
+
+	peerGroup := strangerId + ".peers." + myId
+	post := testArticle(t, strangerKey, peerGroup, "")
+	if err := invited.Post(session, fromPeer(t, post, strangerId)); err != nntpserver.ErrPostingNotPermitted {
+		t.Error("invited session posted an article", err)
+	}
+
+	mail, err := messages.CreatePeerGroup(strangerKey, be.IdGen, "", "stranger", myId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := invited.Post(session, rawFromPeer(t, mail, strangerId)); err != nil {
+		t.Fatal("invited session couldn't create its peering group", err)
+	}
+	if session["Invited"] != "true" {
+		t.Fatal("full access before redeeming the invite")
+	}
+
+	mail, err = messages.CreateInviteAccept(strangerKey, be.IdGen, myId, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := invited.Post(session, rawFromPeer(t, mail, strangerId)); err != nil {
+		t.Fatal("invite not redeemed", err)
+	}
+	if session["Invited"] == "true" || !be.isPeer(strangerId) {
+		t.Fatal("not peered after redeeming the invite")
+	}
+	if _, err := invited.ListGroups(session); err != nil {
+		t.Error("peered session can't list groups", err)
+	}
+}
@@ -0,0 +1,54 @@
+package nntpbackend
+
+import (
+	"log/slog"
+
+	"github.com/emersion/go-vcard"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// inviteAccept runs on the inviter, from redeemed one of our invites so peer
+// back with the permissions we offered them.
+func (be *NntpBackend) inviteAccept(from, newsgroups, secret string) error {
+	if _, ok := be.recipient(newsgroups); !ok {
+		return nil
+	}
+
+	if be.isPeer(from) {
+		return nil
+	}
+
+	perms, err := be.DBs.UseInvite(secret, from)
+	if err != nil {
+		slog.Info("Invite accept rejected", "from", from, "error", err)
+		return serr.New(err)
+	}
+
+	params := vcard.Params{}
+	for k, v := range map[string]bool{
+		"read":      perms.Read,
+		"reply":     perms.Reply,
+		"post":      perms.Post,
+		"cancel":    perms.Cancel,
+		"supersede": perms.Supersede,
+	} {
+		if v {
+			params[k] = []string{"true"}
+		}
+	}
+
+	myKey, err := be.DBs.ConfigGetDeviceKey()
+	if err != nil {
+		return serr.New(err)
+	}
+
+	slog.Info("Invite accepted", "from", from, "perms", perms)
+
+	mail, err := messages.CreatePeerGroupWithParams(myKey, be.IdGen, "", "", from, params)
+	if err != nil {
+		return serr.New(err)
+	}
+
+	return serr.New(be.PostLocal(mail))
+}
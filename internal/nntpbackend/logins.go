@@ -0,0 +1,66 @@
+package nntpbackend
+
+import (
+	"sync"
+	"time"
+)
+
+// Failed TCP logins are limited per address, so a client can't guess
+// passwords, or keep the node busy hashing them. After maxLoginFailures in
+// loginWindow the address is refused until the window has passed.
+const (
+	maxLoginFailures = 5
+	loginWindow      = 15 * time.Minute
+)
+
+type loginFailures struct {
+	count int
+	first time.Time
+}
+
+type loginLimiter struct {
+	lock     sync.Mutex
+	failures map[string]*loginFailures
+}
+
+var tcpLogins = &loginLimiter{failures: map[string]*loginFailures{}}
+
+// allowed tells if addr may try to log in.
+func (l *loginLimiter) allowed(addr string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	f, ok := l.failures[addr]
+	if !ok {
+		return true
+	}
+	if time.Since(f.first) > loginWindow {
+		delete(l.failures, addr)
+		return true
+	}
+	return f.count < maxLoginFailures
+}
+
+// failed counts a failed login from addr.
+func (l *loginLimiter) failed(addr string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	// forget old addresses as new ones fail, so the map doesn't grow.
+	for a, f := range l.failures {
+		if time.Since(f.first) > loginWindow {
+			delete(l.failures, a)
+		}
+	}
+	f, ok := l.failures[addr]
+	if !ok {
+		f = &loginFailures{first: time.Now()}
+		l.failures[addr] = f
+	}
+	f.count++
+}
+
+// succeeded forgets addr's failures.
+func (l *loginLimiter) succeeded(addr string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.failures, addr)
+}
@@ -0,0 +1,44 @@
+package nntpbackend
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+// moderators is who may approve articles in a moderated group, its owner and
+// the moderators it was created with.
+func (be *NntpBackend) moderators(group string) ([]string, bool) {
+	listed, err := be.DBs.GroupConfigGetString(group, "Moderators")
+	if err != nil {
+		return nil, false
+	}
+	owner, _, _ := strings.Cut(group, ".")
+	moderators := []string{owner}
+	for _, id := range strings.Split(listed, ",") {
+		if id != "" {
+			moderators = append(moderators, id)
+		}
+	}
+	return moderators, true
+}
+
+// approved checks an article in a moderated group is signed or countersigned
+// by a moderator. Control messages aren't exempt, their handlers don't check
+// the group they're stored in, and they carry a body like any article. The
+// controls a group's owner sends to it, like newgroup, are signed by the
+// owner so they're approved anyway. A cancel from an author who isn't a
+// moderator still removes their article here, but isn't added to the group
+// to be passed on unless a moderator countersigns it.
+func (be *NntpBackend) approved(group string, msg *messages.MessageTool) bool {
+	moderators, ok := be.moderators(group)
+	if !ok {
+		return true
+	}
+	if !msg.SignedBy(messages.RoleModerator, moderators) {
+		slog.Info("Article not approved for moderated group", "group", group, "messageId", msg.Article.Header.Get("Message-Id"))
+		return false
+	}
+	return true
+}
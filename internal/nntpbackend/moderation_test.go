@@ -0,0 +1,151 @@
+package nntpbackend
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+	"github.com/kothawoc/go-nntp"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+
+	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+func testKey(t *testing.T) (keytool.EasyEdKey, string) {
+	key := keytool.EasyEdKey{}
+	if err := key.GenerateKey(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := key.TorId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, id
+}
+
+// articles numbers the test articles, so each has its own message id.
+var articles int
+
+func testArticle(t *testing.T, key keytool.EasyEdKey, group, control string) *messages.MessageTool {
+	m := messages.NewMessageTool()
+	m.Article.Header.Set("Newsgroups", group)
+	m.Article.Header.Set("Subject", "moderated")
+	articles++
+	m.Article.Header.Set("Message-Id", fmt.Sprintf("<moderated-%d@kothawoc.test>", articles))
+	m.Article.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+	if control != "" {
+		m.Article.Header.Set("Control", control)
+	}
+	m.Preamble = "In a moderated group.\r\n"
+	if _, err := m.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// setDeviceKey gives the node a key, as the client does when it starts.
+func setDeviceKey(t *testing.T, be *NntpBackend) (keytool.EasyEdKey, string) {
+	key, id := testKey(t)
+	deviceKey, err := key.TorPrivKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := be.DBs.ConfigSet("deviceKey", []byte(deviceKey)); err != nil {
+		t.Fatal(err)
+	}
+	return key, id
+}
+
+// fromPeer is msg as it's posted by a peer, with its Path.
+func fromPeer(t *testing.T, msg *messages.MessageTool, path string) *nntp.Article {
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(msg.RawMail())))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Set("Path", path)
+	return &nntp.Article{Header: header, Body: r.R}
+}
+
+func TestApproved(t *testing.T) {
+	dbs, err := databases.NewBackendDbs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := &NntpBackend{DBs: dbs}
+
+	owner, ownerId := testKey(t)
+	moderator, moderatorId := testKey(t)
+	author, _ := testKey(t)
+
+	group := ownerId + ".moderated"
+	card := vcard.Card{}
+	messages.SetModerated(card, []string{moderatorId})
+	if err := dbs.NewGroup(group, "moderated", card); err != nil {
+		t.Fatal(err)
+	}
+	open := ownerId + ".open"
+	if err := dbs.NewGroup(open, "open", vcard.Card{}); err != nil {
+		t.Fatal(err)
+	}
+
+	countersigned := func(role string) *messages.MessageTool {
+		m := testArticle(t, author, group, "")
+		if _, err := m.Countersign(moderator, role); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	tests := []struct {
+		name     string
+		group    string
+		msg      *messages.MessageTool
+		approved bool
+	}{
+		{"unapproved", group, testArticle(t, author, group, ""), false},
+		{"by the owner", group, testArticle(t, owner, group, ""), true},
+		{"by a moderator", group, testArticle(t, moderator, group, ""), true},
+		{"countersigned by a moderator", group, countersigned(messages.RoleModerator), true},
+		{"vouched for by a moderator", group, countersigned(messages.RoleVouch), false},
+		{"reaction", group, testArticle(t, author, group, "react <other@kothawoc.test> +1"), false},
+		{"chunk", group, testArticle(t, author, group, "chunk <object@kothawoc.test> 0"), false},
+		{"cancel", group, testArticle(t, author, group, "cancel <other@kothawoc.test>"), false},
+		{"checkgroups", group, testArticle(t, author, group, "checkgroups x"), false},
+		{"newgroup by the owner", group, testArticle(t, owner, group, "newgroup "+group), true},
+		{"unmoderated group", open, testArticle(t, author, open, ""), true},
+	}
+	for _, test := range tests {
+		if be.approved(test.group, test.msg) != test.approved {
+			t.Errorf("%s: approved %v, expected %v", test.name, !test.approved, test.approved)
+		}
+	}
+}
+
+func TestPostControlModerated(t *testing.T) {
+	be := newTestBackend(t)
+	_, ownerId := testKey(t)
+	author, _ := testKey(t)
+	setDeviceKey(t, be)
+
+	group := ownerId + ".moderated"
+	card := vcard.Card{}
+	messages.SetModerated(card, nil)
+	if err := be.DBs.NewGroup(group, "moderated", card); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := testArticle(t, author, group, "checkgroups x")
+	session := map[string]string{"ConnMode": ConnModeTor, "Id": "peer"}
+	if err := be.Post(session, fromPeer(t, msg, "peer")); !errors.Is(err, nntpserver.ErrPostingFailed) {
+		t.Errorf("unapproved control posted, %v", err)
+	}
+	if _, err := be.DBs.GetArticleById(msg.Article.Header.Get("Message-Id")); err == nil {
+		t.Error("unapproved control stored")
+	}
+}
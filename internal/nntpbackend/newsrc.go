@@ -0,0 +1,148 @@
+package nntpbackend
+
+import (
+	"log/slog"
+	"net/mail"
+	"slices"
+
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// SetNewsrc replaces the read state of the groups in newsrc for an account,
+// and syncs it to the account's other devices.
+func (be *NntpBackend) SetNewsrc(username, newsrc string) error {
+	lines, err := messages.ParseNewsrc(newsrc)
+	if err != nil {
+		return err
+	}
+	if err := be.DBs.SetNewsrc(username, lines); err != nil {
+		return serr.New(err)
+	}
+	return be.SyncNewsrc(username)
+}
+
+// SyncNewsrc posts the account's newsrc to its sync group, if sync has been
+// enabled with EnableNewsrcSync.
+func (be *NntpBackend) SyncNewsrc(username string) error {
+	userKey, err := be.DBs.GetAccountKey(username)
+	if err != nil {
+		return serr.New(err)
+	}
+	userId, err := userKey.TorId()
+	if err != nil {
+		return serr.New(err)
+	}
+	// as the user, the group's only readable by its devices.
+	if _, err := be.DBs.GetGroup(map[string]string{"Id": userId}, messages.NewsrcGroup(userId)); err != nil {
+		return nil
+	}
+
+	lines, err := be.DBs.GetNewsrcSync(username)
+	if err != nil {
+		return serr.New(err)
+	}
+	mail, err := messages.CreateNewsrcSync(userKey, be.IdGen, lines)
+	if err != nil {
+		return serr.New(err)
+	}
+	return serr.New(be.PostLocal(mail))
+}
+
+// supersedeNewsrc keeps only the latest newsrc sync in its group, each one
+// has all the read state so the rest are dropped, on every node that gets
+// them. An older sync arriving late is dropped itself.
+func (be *NntpBackend) supersedeNewsrc(group string, msg *messages.MessageTool) {
+	messageId := msg.Article.Header.Get("Message-Id")
+	from := msg.Article.Header.Get("From")
+	date, err := mail.ParseDate(msg.Article.Header.Get("Date"))
+	if err != nil {
+		slog.Info("Newsrc sync without a date", "messageId", messageId, "error", err)
+		return
+	}
+
+	latest, _ := be.DBs.GroupConfigGetString(group, "NewsrcSync")
+	latestDate, _ := be.DBs.GroupConfigGetInt64(group, "NewsrcSyncDate")
+	if latest == messageId {
+		return
+	}
+	if latest != "" && date.Unix() < latestDate {
+		be.dropNewsrc(from, messageId, group)
+		return
+	}
+	if err := be.DBs.GroupConfigSet(group, "NewsrcSync", messageId); err != nil {
+		slog.Info("Failed to record the latest newsrc sync", "group", group, "error", err)
+		return
+	}
+	if err := be.DBs.GroupConfigSet(group, "NewsrcSyncDate", date.Unix()); err != nil {
+		slog.Info("Failed to record the latest newsrc sync", "group", group, "error", err)
+		return
+	}
+	if latest != "" {
+		be.dropNewsrc(from, latest, group)
+	}
+}
+
+func (be *NntpBackend) dropNewsrc(from, messageId, group string) {
+	if err := be.DBs.CancelMessage(from, messageId, group, messages.ControMesasgeFunctions{}); err != nil {
+		slog.Info("Failed to drop a superseded newsrc sync", "group", group, "messageId", messageId, "error", err)
+	}
+}
+
+// EnableNewsrcSync creates the account's private sync group, readable by
+// this device and the devices listed, which need the same account key to
+// make use of it.
+func (be *NntpBackend) EnableNewsrcSync(username string, devices []string) error {
+	userKey, err := be.DBs.GetAccountKey(username)
+	if err != nil {
+		return serr.New(err)
+	}
+	myKey, err := be.DBs.ConfigGetDeviceKey()
+	if err != nil {
+		return serr.New(err)
+	}
+	myId, _ := myKey.TorId()
+	if !slices.Contains(devices, myId) {
+		devices = append(devices, myId)
+	}
+	mail, err := messages.CreateNewsrcGroup(userKey, be.IdGen, devices)
+	if err != nil {
+		return serr.New(err)
+	}
+	if err := be.PostLocal(mail); err != nil {
+		return serr.New(err)
+	}
+	return be.SyncNewsrc(username)
+}
+
+// newsrcSync applies read state synced from another of the user's devices,
+// to every local account with the same identity.
+func (be *NntpBackend) newsrcSync(from, sealed string) error {
+	accounts, err := be.DBs.GetAccounts()
+	if err != nil {
+		return serr.New(err)
+	}
+
+	for _, a := range accounts {
+		if a.Id != from {
+			continue
+		}
+		userKey, err := be.DBs.GetAccountKey(a.Username)
+		if err != nil {
+			return serr.New(err)
+		}
+		newsrc, err := messages.OpenNewsrc(userKey, sealed)
+		if err != nil {
+			slog.Info("Failed to open synced newsrc", "user", a.Username, "error", err)
+			return err
+		}
+		lines, err := messages.ParseNewsrcSync(newsrc)
+		if err != nil {
+			return err
+		}
+		if err := be.DBs.SetNewsrcSync(a.Username, lines); err != nil {
+			return serr.New(err)
+		}
+	}
+	return nil
+}
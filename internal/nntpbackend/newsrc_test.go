@@ -0,0 +1,41 @@
+package nntpbackend
+
+import (
+	"testing"
+
+	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+// Each newsrc sync has all the read state, so only the latest is kept. The
+// group is readable by this device without it being listed.
+func TestNewsrcSuperseded(t *testing.T) {
+	be := newTestBackend(t)
+	_, deviceId := setDeviceKey(t, be)
+	fakePeers(t, be)
+	if err := be.DBs.AddAccount("alice", "secret", databases.RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.EnableNewsrcSync("alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, newsrc := range []string{"kothawoc.test: 1-3\n", "kothawoc.test: 1-100000\n", "kothawoc.test: 1-5\n"} {
+		if err := be.SetNewsrc("alice", newsrc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	userKey, err := be.DBs.GetAccountKey("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userId, _ := userKey.TorId()
+	group, err := be.DBs.GetGroup(map[string]string{"Id": deviceId}, messages.NewsrcGroup(userId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the newgroup, and the latest sync.
+	if group.Count != 2 {
+		t.Errorf("%d articles in the sync group", group.Count)
+	}
+}
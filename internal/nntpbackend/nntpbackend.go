@@ -1,8 +1,11 @@
 package nntpbackend
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +15,7 @@ import (
 	"github.com/kothawoc/go-nntp"
 	nntpserver "github.com/kothawoc/go-nntp/server"
 	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/internal/events"
 	"github.com/kothawoc/kothawoc/internal/peering"
 	"github.com/kothawoc/kothawoc/internal/torutils"
 	"github.com/kothawoc/kothawoc/pkg/keytool"
@@ -56,12 +60,16 @@ func NewNNTPBackend(path string, tc *torutils.TorCon, dbs *databases.BackendDbs)
 	if err != nil {
 		return nil, serr.New(err)
 	}
+	bus := events.NewBus()
+	peers.Events = bus
 	go peers.Connect()
 
 	nextBackend := &NntpBackend{
 		ConfigPath: path,
 		Peers:      peers,
 		DBs:        dbs,
+		Events:     bus,
+		ephemerals: newEphemeralStore(),
 	}
 
 	return &EmptyNntpBackend{
@@ -81,6 +89,12 @@ type NntpBackend struct {
 	ConfigPath string
 	Peers      *peering.Peers
 	DBs        *databases.BackendDbs
+	// IdGen creates message ids for control messages the node sends itself.
+	IdGen nntpserver.IdGenerator
+	// Events tells local apps what's happening.
+	Events *events.Bus
+
+	ephemerals *ephemeralStore
 }
 
 func (be *NntpBackend) ListGroups(session map[string]string) (<-chan *nntp.Group, error) {
@@ -103,6 +117,11 @@ func (be *NntpBackend) GetGroup(session map[string]string, groupName string) (*n
 	}
 
 	a, b := be.DBs.GetGroup(session, groupName)
+	if b == nil {
+		if _, _, ok := be.ephemeral(groupName); ok {
+			a.Count, a.Low, a.High = be.ephemerals.stats(groupName)
+		}
+	}
 
 	return a, b
 
@@ -112,7 +131,14 @@ func (be *NntpBackend) GetArticleWithNoGroup(session map[string]string, id strin
 
 	slog.Debug("E GetArticleWithNoGroup")
 
+	if a, ok := be.ephemerals.getById(id); ok {
+		return a, nil
+	}
+
 	ret, err := be.DBs.GetArticleById(id)
+	if err == nil && !be.canRead(session, ret) {
+		return nil, nntpserver.ErrInvalidMessageID
+	}
 
 	return ret, err
 
@@ -126,11 +152,21 @@ func (be *NntpBackend) GetArticle(session map[string]string, group *nntp.Group,
 
 	slog.Debug("GetArticle", "group", group, "grpMsgId", grpMsgId)
 
-	if !be.DBs.GetPerms(session["Id"], group.Name).Read {
+	if perms := be.DBs.GetPerms(session["Id"], group.Name); perms != nil && !perms.Read {
+		return nil, nntpserver.ErrInvalidArticleNumber
+	}
+
+	if _, _, ok := be.ephemeral(group.Name); ok {
+		if a, ok := be.ephemerals.get(group.Name, grpMsgId); ok {
+			return a, nil
+		}
 		return nil, nntpserver.ErrInvalidArticleNumber
 	}
 
 	ret, err := be.DBs.GetArticleById(grpMsgId)
+	if err == nil && !be.canRead(session, ret) {
+		return nil, nntpserver.ErrInvalidArticleNumber
+	}
 
 	return ret, err
 
@@ -144,11 +180,25 @@ func (be *NntpBackend) GetArticles(session map[string]string, group *nntp.Group,
 		return nil, nntpserver.ErrInvalidArticleNumber
 	}
 
+	if _, _, ok := be.ephemeral(group.Name); ok {
+		articles := be.ephemerals.list(group.Name, from, to)
+		retChan := make(chan nntpserver.NumberedArticle, len(articles))
+		for _, a := range articles {
+			retChan <- a
+		}
+		close(retChan)
+		return retChan, nil
+	}
+
 	list, err := be.DBs.ListArticles(session, group.Name, from, to)
+	if err != nil {
+		return nil, err
+	}
 
 	retChan := make(chan nntpserver.NumberedArticle, 10)
 
 	go func() {
+		defer close(retChan)
 		for id := range list {
 			//		err := row.Scan(&id)
 
@@ -169,7 +219,6 @@ func (be *NntpBackend) GetArticles(session map[string]string, group *nntp.Group,
 			}
 
 		}
-		close(retChan)
 	}()
 
 	return retChan, nil
@@ -190,10 +239,45 @@ func (be *NntpBackend) AllowPost(session map[string]string) bool {
 	return true
 }
 
+// countingReader counts the body bytes received from a peer for the status
+// statistics.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
 func (be *NntpBackend) Post(session map[string]string, article *nntp.Article) error {
 	slog.Info("E Post")
 
-	msg := messages.NewMessageToolFromArticle(article)
+	body := &countingReader{r: article.Body}
+	article.Body = body
+	// whatever happens the rest of the article must be read, or the
+	// connection is out of step.
+	defer io.Copy(io.Discard, body)
+
+	// the node's limit, or what was agreed with the peer if that's smaller.
+	maxSize, err := be.DBs.ConfigGetInt64("MaxArticleSize")
+	if err != nil {
+		maxSize = messages.DefaultMaxArticleSize
+	}
+	if sessionMax, err := strconv.ParseInt(session["MaxArticleSize"], 10, 64); err == nil && sessionMax > 0 && (maxSize <= 0 || sessionMax < maxSize) {
+		maxSize = sessionMax
+	}
+	msg, err := messages.ReadMessageTool(article, maxSize)
+	if errors.Is(err, messages.ErrArticleTooLarge) {
+		slog.Info("Error Posting, article too large", "maxSize", maxSize)
+		return nntpserver.ErrPostingFailed
+	}
+	if err != nil {
+		slog.Info("Error Posting, failed to read article", "error", err)
+		return nntpserver.ErrPostingFailed
+	}
 
 	// if the connection is local, sign it.
 	if session["ConnMode"] == ConnModeLocal || session["ConnMode"] == ConnModeTcp {
@@ -206,7 +290,11 @@ func (be *NntpBackend) Post(session map[string]string, article *nntp.Article) er
 			}
 
 			//kt := keytool.EasyEdKey{}
-			kt, _ := be.DBs.ConfigGetDeviceKey()
+			kt, err := be.signingKey(session)
+			if err != nil {
+				slog.Info("Error Posting, no signing key", "user", session["User"], "error", err)
+				return nntpserver.ErrPostingFailed
+			}
 			//kt.SetTorPrivateKey(ed25519.PrivateKey(deviceKey))
 
 			msg.Sign(kt)
@@ -220,6 +308,16 @@ func (be *NntpBackend) Post(session map[string]string, article *nntp.Article) er
 		return nntpserver.ErrPostingNotPermitted
 	}
 
+	// it's stored as it's written, which must be how it was signed.
+	if !msg.Reproducible() {
+		slog.Info("Error Posting, body isn't in canonical form", "messageId", msg.Article.Header.Get("Message-Id"))
+		return nntpserver.ErrPostingNotPermitted
+	}
+
+	if err := be.checkBlocked(msg); err != nil {
+		return nntpserver.ErrPostingNotPermitted
+	}
+
 	deviceKey, _ := be.DBs.ConfigGetBytes("deviceKey")
 
 	//	torId := torutils.EncodePublicKey(ed25519.PrivateKey(deviceKey).PublicKey())
@@ -255,11 +353,40 @@ func (be *NntpBackend) Post(session map[string]string, article *nntp.Article) er
 
 	//np, _ := NewPeers(be.DBs.peers,be.)
 	cmf := messages.ControMesasgeFunctions{
-		NewGroup:   be.DBs.NewGroup,
-		AddPeer:    be.Peers.AddPeer,
-		RemovePeer: be.Peers.RemovePeer,
-		Cancel:     be.DBs.CancelMessage,
-		Sendme:     be.Peers.Sendme,
+		NewGroup:     be.newGroup,
+		AddPeer:      be.addPeer,
+		RemovePeer:   be.Peers.RemovePeer,
+		Cancel:       be.cancel,
+		Sendme:       be.Peers.Sendme,
+		Introduce:    be.introduce,
+		IntroAccept:  be.introAccept,
+		IntroConfirm: be.introConfirm,
+		InviteAccept: be.inviteAccept,
+		Block:        be.blockAdvisory,
+		Unblock:      be.unblockAdvisory,
+		Newsrc:       be.newsrcSync,
+		RmGroup:      be.rmGroup,
+		React:        be.checkReaction,
+	}
+
+	// ephemeral groups are only in RAM, so nothing posted to them may have
+	// a lasting effect, a control only goes to the other groups it names.
+	splitGroups := strings.Split(article.Header.Get("Newsgroups"), ",")
+	ephemeralGroups, persistentGroups := []string{}, []string{}
+	for _, group := range splitGroups {
+		group := strings.TrimSpace(group)
+		if _, _, ok := be.ephemeral(group); ok {
+			ephemeralGroups = append(ephemeralGroups, group)
+		} else {
+			persistentGroups = append(persistentGroups, group)
+		}
+	}
+	if article.Header.Get("Control") != "" && len(ephemeralGroups) > 0 {
+		slog.Info("Control messages aren't posted to ephemeral groups", "groups", ephemeralGroups)
+		if len(persistentGroups) == 0 {
+			return nntpserver.ErrPostingNotPermitted
+		}
+		ephemeralGroups = nil
 	}
 
 	if err := messages.CheckControl(msg, cmf, session); err != nil {
@@ -275,14 +402,32 @@ func (be *NntpBackend) Post(session map[string]string, article *nntp.Article) er
 	//
 	//	}
 
-	splitGroups := strings.Split(article.Header.Get("Newsgroups"), ",")
-	postableGroups := map[string]int64{}
+	var ephemeralErr error
+	ephemeralPosted := false
+	for _, group := range ephemeralGroups {
+		if err := be.postEphemeral(session, msg, group); err != nil {
+			ephemeralErr = err
+			continue
+		}
+		ephemeralPosted = true
+	}
 
-	for _, group := range splitGroups {
-		group := strings.TrimSpace(group)
+	postableGroups := map[string]int64{}
+	for _, group := range persistentGroups {
 		if post := be.DBs.GetPerms(session["Id"], group); post != nil && !post.Post {
 			continue
 		}
+		// only the rmgroup itself goes into a removed group, to pass it on.
+		if removed, _ := be.DBs.GroupConfigGetString(group, "Removed"); removed == "true" &&
+			!strings.HasPrefix(article.Header.Get("Control"), "rmgroup ") {
+			continue
+		}
+		if !be.allowedContent(group, msg) {
+			continue
+		}
+		if !be.approved(group, msg) {
+			continue
+		}
 
 		/*
 			row := be.DBs.groups.QueryRow("SELECT id,name FROM groups WHERE name=?;", group)
@@ -329,6 +474,13 @@ func (be *NntpBackend) Post(session map[string]string, article *nntp.Article) er
 
 		be.Peers.DistributeArticle(*msg)
 
+		if target, reaction, ok := messages.ParseReaction(article.Header.Get("Control")); ok {
+			return be.storeReaction(session, msg, target, reaction, body.n)
+		}
+		if _, ok := messages.ParseChunkControl(article.Header.Get("Control")); ok {
+			return be.storeChunk(session, msg, body.n)
+		}
+
 		for group := range postableGroups {
 
 			err := be.DBs.AddArticleToGroup(group, article.Header.Get("Message-Id"), articleId)
@@ -338,13 +490,39 @@ func (be *NntpBackend) Post(session map[string]string, article *nntp.Article) er
 			} else {
 				slog.Info("SUCCESS update refs insert article to do db stuff at", "error", err, "messageId", article.Header.Get("Message-Id"))
 			}
+			be.Events.Publish(events.Event{
+				Type:      events.ArticleStored,
+				Group:     group,
+				Number:    articleId,
+				MessageId: article.Header.Get("Message-Id"),
+				TorId:     msg.Article.Header.Get("From"),
+			})
 
 		}
 
+		if article.Header.Get("Control") == "newsrc" {
+			for group := range postableGroups {
+				be.supersedeNewsrc(group, msg)
+			}
+		}
+
 		slog.Info("Post Success of", "messageid", article.Header.Get("Message-Id"))
 
+		if session["ConnMode"] == ConnModeTor {
+			be.Peers.ArticleReceived(session["Id"], body.n)
+		}
+
 		return nil
 	}
 
+	if ephemeralPosted {
+		if session["ConnMode"] == ConnModeTor {
+			be.Peers.ArticleReceived(session["Id"], body.n)
+		}
+		return nil
+	}
+	if ephemeralErr != nil {
+		return ephemeralErr
+	}
 	return nntpserver.ErrPostingFailed
 }
@@ -0,0 +1,178 @@
+package nntpbackend
+
+import (
+	"io"
+	"log/slog"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/kothawoc/go-nntp"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// prefetchChunks is how many chunks of an object are fetched ahead of the
+// reader, in parallel.
+const prefetchChunks = 4
+
+// storeChunk keeps a stored chunk instead of adding it to its group.
+func (be *NntpBackend) storeChunk(session map[string]string, msg *messages.MessageTool, received int) error {
+	if err := be.DBs.AddChunk(msg.Article.Header.Get("Message-Id")); err != nil {
+		return nntpserver.ErrPostingFailed
+	}
+	if session["ConnMode"] == ConnModeTor {
+		be.Peers.ArticleReceived(session["Id"], received)
+	}
+	return nil
+}
+
+// canRead tells if a peer may read an article it asked for by message id, it
+// must be able to read one of the article's groups. Local sessions read
+// everything.
+func (be *NntpBackend) canRead(session map[string]string, article *nntp.Article) bool {
+	if session["ConnMode"] == ConnModeLocal ||
+		(session["ConnMode"] == ConnModeTcp && session["Role"] == string(databases.RoleOwner)) {
+		return true
+	}
+	for _, group := range strings.Split(article.Header.Get("Newsgroups"), ",") {
+		if perms := be.DBs.GetPerms(session["Id"], strings.TrimSpace(group)); perms != nil && perms.Read {
+			return true
+		}
+	}
+	return false
+}
+
+// Chunk returns a chunk of a large object, from articles.db or else from a
+// peer, starting with the hint'th. Fetched chunks are kept, so our peers can
+// get them from us.
+func (be *NntpBackend) Chunk(hash string, hint int) ([]byte, error) {
+	messageId := messages.ChunkMessageId(hash)
+	if a, err := be.DBs.GetArticleById(messageId); err == nil {
+		return messages.ChunkContent(messages.NewMessageToolFromArticle(a))
+	}
+
+	raw, err := be.Peers.Fetch(messageId, hint)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	msg := messages.NewMessageToolFromArticle(&nntp.Article{Header: textproto.MIMEHeader(m.Header), Body: m.Body})
+	if !msg.Verify() {
+		return nil, serr.Errorf("chunk %s failed to verify", hash)
+	}
+	content, err := messages.ChunkContent(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// another reader may have fetched it at the same time.
+	if _, err := be.DBs.StoreArticle(msg); err != nil {
+		slog.Info("Failed to keep fetched chunk", "messageId", messageId, "error", err)
+		return content, nil
+	}
+	if err := be.DBs.AddChunk(messageId); err != nil {
+		slog.Info("Failed to keep fetched chunk", "messageId", messageId, "error", err)
+	}
+	return content, nil
+}
+
+type chunkResult struct {
+	content []byte
+	err     error
+}
+
+// ObjectReader reads a large object, fetching its chunks as they're needed,
+// a few ahead at a time. It can seek, to serve ranges of it.
+type ObjectReader struct {
+	be       *NntpBackend
+	manifest messages.Manifest
+	offset   int64
+
+	current int
+	content []byte
+	fetches map[int]chan chunkResult
+}
+
+// OpenObject reads the object a manifest describes.
+func (be *NntpBackend) OpenObject(manifest messages.Manifest) *ObjectReader {
+	return &ObjectReader{
+		be:       be,
+		manifest: manifest,
+		current:  -1,
+		fetches:  map[int]chan chunkResult{},
+	}
+}
+
+// prefetch starts fetching chunk i and the few after it.
+func (r *ObjectReader) prefetch(i int) {
+	for n := i; n < len(r.manifest.Chunks) && n < i+prefetchChunks; n++ {
+		if _, ok := r.fetches[n]; ok || n == r.current {
+			continue
+		}
+		ret := make(chan chunkResult, 1)
+		r.fetches[n] = ret
+		go func(n int) {
+			content, err := r.be.Chunk(r.manifest.Chunks[n], n)
+			ret <- chunkResult{content, err}
+		}(n)
+	}
+}
+
+func (r *ObjectReader) chunk(i int) ([]byte, error) {
+	if i == r.current {
+		return r.content, nil
+	}
+	r.prefetch(i)
+	res := <-r.fetches[i]
+	delete(r.fetches, i)
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	size := r.manifest.ChunkSize
+	if i == len(r.manifest.Chunks)-1 {
+		size = r.manifest.Size - int64(i)*r.manifest.ChunkSize
+	}
+	if int64(len(res.content)) != size {
+		return nil, serr.Errorf("chunk %d of %s is %d bytes not %d", i, r.manifest.Name, len(res.content), size)
+	}
+	r.current, r.content = i, res.content
+	return r.content, nil
+}
+
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.manifest.Size {
+		return 0, io.EOF
+	}
+	i := int(r.offset / r.manifest.ChunkSize)
+	content, err := r.chunk(i)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, content[r.offset-int64(i)*r.manifest.ChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.manifest.Size
+	default:
+		return r.offset, serr.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return r.offset, serr.Errorf("negative position %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
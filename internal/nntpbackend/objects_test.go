@@ -0,0 +1,95 @@
+package nntpbackend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+)
+
+func TestChunkBadHash(t *testing.T) {
+	be := newTestBackend(t)
+	setDeviceKey(t, be)
+	fakePeers(t, be)
+	owner, ownerId := testKey(t)
+	group := ownerId + ".files"
+	if err := be.DBs.NewGroup(group, group, vcard.Card{}); err != nil {
+		t.Fatal(err)
+	}
+	session := map[string]string{"ConnMode": ConnModeTor, "Id": "peer"}
+
+	sum := sha256.Sum256([]byte("what it claims to be"))
+	hash := hex.EncodeToString(sum[:])
+	msg := messages.NewMessageTool()
+	msg.Article.Header.Set("Newsgroups", group)
+	msg.Article.Header.Set("Subject", "cmsg chunk "+hash)
+	msg.Article.Header.Set("Control", "chunk "+hash)
+	msg.Article.Header.Set("Message-Id", messages.ChunkMessageId(hash))
+	msg.Article.Header.Set("Content-Type", "multipart/mixed; boundary=\"nxtprt\"")
+	msg.Preamble = "This is a MIME control message."
+	msg.Parts = []messages.MimePart{{
+		Header: textproto.MIMEHeader{
+			"Content-Type":              {"application/octet-stream"},
+			"Content-Transfer-Encoding": {"base64"},
+		},
+		Content: []byte("what it is"),
+	}}
+	if _, err := msg.Sign(owner); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := be.Post(session, fromPeer(t, msg, "peer")); err == nil {
+		t.Error("chunk not matching its hash posted")
+	}
+	if _, err := be.DBs.GetArticleById(messages.ChunkMessageId(hash)); err == nil {
+		t.Error("chunk not matching its hash stored")
+	}
+}
+
+func TestObjectRange(t *testing.T) {
+	be := newTestBackend(t)
+	setDeviceKey(t, be)
+	fakePeers(t, be)
+	owner, ownerId := testKey(t)
+	group := ownerId + ".files"
+	if err := be.DBs.NewGroup(group, group, vcard.Card{}); err != nil {
+		t.Fatal(err)
+	}
+	session := map[string]string{"ConnMode": ConnModeTor, "Id": "peer"}
+
+	// small chunks, so a short range crosses them.
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxy")
+	manifest := messages.Manifest{Name: "test.txt", Type: "text/plain", Size: int64(len(data)), ChunkSize: 10}
+	for i := 0; i < len(data); i += 10 {
+		chunk := data[i:min(i+10, len(data))]
+		mail, _, err := messages.CreateChunk(owner, []string{group}, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := be.Post(session, rawFromPeer(t, mail, "peer")); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(chunk)
+		manifest.Chunks = append(manifest.Chunks, hex.EncodeToString(sum[:]))
+	}
+
+	req := httptest.NewRequest("GET", "/object", nil)
+	req.Header.Set("Range", "bytes=5-31")
+	rec := httptest.NewRecorder()
+	http.ServeContent(rec, req, manifest.Name, time.Time{}, be.OpenObject(manifest))
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if string(body) != string(data[5:32]) {
+		t.Errorf("range is %q not %q", body, data[5:32])
+	}
+}
@@ -0,0 +1,37 @@
+package nntpbackend
+
+import (
+	"strings"
+
+	nntpserver "github.com/kothawoc/go-nntp/server"
+	"github.com/kothawoc/kothawoc/internal/events"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// checkReaction drops a second identical reaction from the same signer.
+func (be *NntpBackend) checkReaction(from, messageId, reaction string) error {
+	if be.DBs.HasReaction(from, messageId, reaction) {
+		return serr.Errorf("%s already reacted %s to %s", from, reaction, messageId)
+	}
+	return nil
+}
+
+// storeReaction counts a stored reaction instead of adding it to its group.
+func (be *NntpBackend) storeReaction(session map[string]string, msg *messages.MessageTool, target, reaction string, received int) error {
+	header := msg.Article.Header
+	if err := be.DBs.AddReaction(header.Get("Message-Id"), msg.Sender(), target, reaction); err != nil {
+		return nntpserver.ErrPostingFailed
+	}
+	be.Events.Publish(events.Event{
+		Type:      events.ReactionAdded,
+		Group:     strings.TrimSpace(header.Get("Newsgroups")),
+		MessageId: target,
+		TorId:     msg.Sender(),
+	})
+
+	if session["ConnMode"] == ConnModeTor {
+		be.Peers.ArticleReceived(session["Id"], received)
+	}
+	return nil
+}
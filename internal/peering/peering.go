@@ -1,16 +1,22 @@
 package peering
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"net/textproto"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cretz/bine/torutil/ed25519"
 
 	nntpclient "github.com/kothawoc/go-nntp/client"
 	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/internal/events"
 	"github.com/kothawoc/kothawoc/internal/torutils"
 	"github.com/kothawoc/kothawoc/pkg/keytool"
 	"github.com/kothawoc/kothawoc/pkg/messages"
@@ -37,8 +43,49 @@ const (
 	CmdExit         = PeeringCommand("Exit")
 	CmdWorkerExited = PeeringCommand("WorkerExited")
 	CmdSendme       = PeeringCommand("Sendme")
+	CmdStatus       = PeeringCommand("Status")
+	CmdReceived     = PeeringCommand("Received")
+	CmdInbound      = PeeringCommand("Inbound")
+
+	// CmdDistributeEphemeral pushes an article out now, as it's not in the
+	// database for SendMessages to find.
+	CmdDistributeEphemeral = PeeringCommand("DistributeEphemeral")
+)
+
+type PeerState string
+
+const (
+	PeerStateDisconnected = PeerState("Disconnected")
+	PeerStateConnecting   = PeerState("Connecting")
+	PeerStateConnected    = PeerState("Connected")
 )
 
+// PeerStatus is a snapshot of a peer connection, LastMessage is the last
+// article from articles.db that has been offered to the peer, HeadMessage
+// is the newest article we hold, and Behind is the difference.
+type PeerStatus struct {
+	TorId            string
+	State            PeerState
+	Inbound          bool
+	LastConnect      time.Time
+	LastError        string
+	LastErrorTime    time.Time
+	ArticlesSent     int64
+	ArticlesReceived int64
+	BytesSent        int64
+	BytesReceived    int64
+	LastMessage      int64
+	HeadMessage      int64
+	Behind           int64
+	HandshakeRTT     time.Duration
+
+	// negotiated in the last outbound handshake.
+	Proto          int
+	Features       []string
+	MaxArticleSize int64
+	Software       string
+}
+
 type PeeringMessage struct {
 	Cmd  PeeringCommand
 	Args []interface{}
@@ -57,9 +104,30 @@ type Peer struct {
 	Client    *nntpclient.Client
 	ParentCmd chan PeeringMessage
 	Cmd       chan PeeringMessage
+
+	// the worker runs commands in their own goroutines, so the status is
+	// locked rather than owned by a single goroutine.
+	statusLock sync.Mutex
+	status     PeerStatus
+	handshake  *torutils.Handshake
+
+	// commands run concurrently, but the client can only post, or fetch, one
+	// at a time.
+	postLock sync.Mutex
+
+	// connLock guards Conn and Client, commands read them while the worker
+	// redials or a failed command drops them.
+	connLock sync.Mutex
+
+	// stopped is set, and done closed, once the peer's removed or exits,
+	// nothing connects to it after.
+	stopped bool
+	done    chan struct{}
+
+	events *events.Bus
 }
 
-func NewPeer(tc *torutils.TorCon, parent chan PeeringMessage, myKey, peerKey keytool.EasyEdKey, dbs *databases.BackendDbs) (*Peer, error) {
+func NewPeer(tc *torutils.TorCon, parent chan PeeringMessage, myKey, peerKey keytool.EasyEdKey, dbs *databases.BackendDbs, bus *events.Bus) (*Peer, error) {
 
 	myTorId, _ := myKey.TorId()
 	peerTorId, _ := peerKey.TorId()
@@ -76,27 +144,170 @@ func NewPeer(tc *torutils.TorCon, parent chan PeeringMessage, myKey, peerKey key
 		MyTorId:   myTorId,
 		PeerTorId: peerTorId,
 		Cmd:       make(chan PeeringMessage, 10),
+		done:      make(chan struct{}),
+		events:    bus,
+		status: PeerStatus{
+			TorId: peerTorId,
+			State: PeerStateDisconnected,
+		},
 	}
 	go Peer.Worker()
 
 	return Peer, nil
 }
 
+func (p *Peer) Status() PeerStatus {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+	return p.status
+}
+
+func (p *Peer) setState(state PeerState) {
+	p.statusLock.Lock()
+	p.status.State = state
+	if state == PeerStateConnected {
+		p.status.LastConnect = time.Now()
+	}
+	p.statusLock.Unlock()
+
+	// subscribers may ask for the status, so publish without the lock.
+	if state == PeerStateConnected {
+		p.events.Publish(events.Event{Type: events.PeerConnected, TorId: p.PeerTorId})
+	}
+}
+
+func (p *Peer) setError(err error) {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+	p.status.LastError = err.Error()
+	p.status.LastErrorTime = time.Now()
+}
+
+func (p *Peer) addSent(bytes int) {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+	p.status.ArticlesSent++
+	p.status.BytesSent += int64(bytes)
+}
+
+func (p *Peer) addReceived(bytes int) {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+	p.status.ArticlesReceived++
+	p.status.BytesReceived += int64(bytes)
+}
+
+func (p *Peer) setInbound(connected bool) {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+	p.status.Inbound = connected
+}
+
+func (p *Peer) setHandshake(h *torutils.Handshake, rtt time.Duration) {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+	p.status.HandshakeRTT = rtt
+	p.status.Proto = h.Proto
+	p.status.Features = h.Features
+	p.status.MaxArticleSize = h.MaxArticleSize
+	p.status.Software = h.Software
+	p.handshake = h
+}
+
+// Handshake returns what was negotiated with the peer on the current
+// connection.
+func (p *Peer) Handshake() *torutils.Handshake {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+	return p.handshake
+}
+
+// connected tells if there's an outbound connection to the peer.
+func (p *Peer) connected() bool {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	return p.Conn != nil
+}
+
+// isStopped tells if the peer's been removed.
+func (p *Peer) isStopped() bool {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	return p.stopped
+}
+
+// client returns the outbound connection's client, nil if there's none.
+func (p *Peer) client() *nntpclient.Client {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	return p.Client
+}
+
+// closeConn closes the outbound connection, if there is one.
+func (p *Peer) closeConn() {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	if p.Conn != nil {
+		p.Conn.Close()
+	}
+	p.Conn = nil
+	p.Client = nil
+}
+
+// stop closes the connection for good and stops the worker's ticker.
+func (p *Peer) stop() {
+	p.connLock.Lock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.done)
+	}
+	p.connLock.Unlock()
+	p.closeConn()
+	p.setState(PeerStateDisconnected)
+}
+
+// disconnect drops a broken outbound connection so the next tick redials.
+func (p *Peer) disconnect(err error) {
+	p.closeConn()
+	p.setError(err)
+	p.setState(PeerStateDisconnected)
+}
+
 func (p *Peer) Worker() {
 	go func() {
+		ticker := time.NewTicker(time.Second * 5)
+		defer ticker.Stop()
 		for {
-			time.Sleep(time.Second * 5)
-			// only send a refresh if it's not busy
-			if len(p.Cmd) == 0 {
-				p.Cmd <- PeeringMessage{}
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				// only send a refresh if it's not busy
+				if len(p.Cmd) == 0 {
+					p.Cmd <- PeeringMessage{}
+				}
 			}
 		}
 	}()
-	defer close(p.Cmd)
 
 	//gDB := p.Dbs.GroupArticles[p.GroupName]
 
 	for cmd := range p.Cmd {
+		// these stop the worker, so they're not run alongside the others,
+		// which would redial.
+		switch cmd.Cmd {
+		case CmdExit:
+			p.ParentCmd <- PeeringMessage{
+				Cmd:  CmdWorkerExited,
+				Args: []interface{}{p.PeerTorId},
+			}
+			p.stop()
+			return
+		case CmdRemovePeer:
+			p.stop()
+			return
+		}
+
 		go func(cmd PeeringMessage) {
 			//log.Printf("Spam Command Loop: [%#v]", cmd)
 			switch cmd.Cmd {
@@ -124,13 +335,8 @@ func (p *Peer) Worker() {
 					}
 				}
 
-			case CmdExit:
-				p.ParentCmd <- PeeringMessage{
-					Cmd:  CmdWorkerExited,
-					Args: []interface{}{p.PeerTorId},
-				}
-				p.Conn.Close()
-				return
+			case CmdDistributeEphemeral:
+				p.sendEphemeral(cmd.Args[0].(messages.MessageTool))
 
 			case CmdSendme:
 				/*
@@ -188,7 +394,7 @@ func (p *Peer) Worker() {
 
 func (p *Peer) SendMessages() {
 
-	if p.Conn == nil {
+	if !p.connected() {
 		return
 	}
 
@@ -225,6 +431,14 @@ func (p *Peer) SendMessages() {
 		}
 	}
 
+	// chunks of large objects are fetched by the peers reading them.
+	if _, ok := messages.ParseChunkControl(msg.Article.Header.Get("Control")); ok {
+		if err := p.Dbs.GroupConfigSet(p.GroupName, "LastMessage", art.Num); err != nil {
+			slog.Error("Failed to update LastMessage for skip", "sqlErr", err, "LastMessage", art.Num)
+		}
+		return
+	}
+
 	notAllowed := true
 
 	splitGroups := strings.Split(msg.Article.Header.Get("Newsgroups"), ",")
@@ -247,10 +461,19 @@ func (p *Peer) SendMessages() {
 
 	// TODO: CHECK SUBSCRIPTION
 
-	err = p.Client.Post(strings.NewReader(msg.RawMail()))
+	rawMail := msg.RawMail()
+	err = p.post(rawMail)
 
 	if err != nil {
 		slog.Info("Failed to post LastMessage for skip", "LastMessage", art.Num, "error", err)
+		// anything other than an NNTP response means the connection is gone,
+		// so retry the article after reconnecting.
+		var nntpErr *textproto.Error
+		if !errors.As(err, &nntpErr) {
+			p.disconnect(err)
+			return
+		}
+		p.setError(err)
 		err := p.Dbs.GroupConfigSet(p.GroupName, "LastMessage", art.Num)
 		if err != nil {
 			slog.Error("Failed to update LastMessage for skip", "sqlErr", err, "LastMessage", art.Num)
@@ -258,6 +481,7 @@ func (p *Peer) SendMessages() {
 		}
 		return
 	} else {
+		p.addSent(len(rawMail))
 		err := p.Dbs.GroupConfigSet(p.GroupName, "LastMessage", art.Num)
 		if err != nil {
 			slog.Error("Failed to update LastMessage for skip", "sqlErr", err, "LastMessage", art.Num)
@@ -266,44 +490,181 @@ func (p *Peer) SendMessages() {
 	}
 }
 
+func (p *Peer) post(rawMail string) error {
+	p.postLock.Lock()
+	defer p.postLock.Unlock()
+	client := p.client()
+	if client == nil {
+		return serr.Errorf("not connected to %s", p.PeerTorId)
+	}
+	return client.Post(strings.NewReader(rawMail))
+}
+
+// fetch gets an article from the peer by message id.
+func (p *Peer) fetch(messageId string) (string, error) {
+	p.postLock.Lock()
+	defer p.postLock.Unlock()
+	client := p.client()
+	if client == nil {
+		return "", serr.Errorf("not connected to %s", p.PeerTorId)
+	}
+	_, _, r, err := client.Article(messageId)
+	if err != nil {
+		var nntpErr *textproto.Error
+		if !errors.As(err, &nntpErr) {
+			p.disconnect(err)
+		}
+		return "", serr.New(err)
+	}
+	// no more than was agreed in the handshake, the rest is left unread so
+	// the connection's dropped.
+	limit := messages.DefaultMaxArticleSize
+	if h := p.Handshake(); h != nil && h.MaxArticleSize > 0 {
+		limit = h.MaxArticleSize
+	}
+	raw, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		p.disconnect(err)
+		return "", serr.New(err)
+	}
+	if int64(len(raw)) > limit {
+		p.disconnect(messages.ErrArticleTooLarge)
+		return "", serr.Errorf("%w: %s from %s", messages.ErrArticleTooLarge, messageId, p.PeerTorId)
+	}
+	p.addReceived(len(raw))
+	return string(raw), nil
+}
+
+// sendEphemeral posts an ephemeral article to the peer straight away, if
+// it's connected, allowed to read it and hasn't had it already. There's no
+// retry, a peer that's offline misses it.
+func (p *Peer) sendEphemeral(msg messages.MessageTool) {
+	if !p.connected() {
+		return
+	}
+	for _, pathHost := range strings.Split(msg.Article.Header.Get("Path"), "!") {
+		if p.PeerTorId == pathHost {
+			return
+		}
+	}
+	for _, group := range strings.Split(msg.Article.Header.Get("Newsgroups"), ",") {
+		if perms := p.Dbs.GetPerms(p.PeerTorId, strings.TrimSpace(group)); perms == nil || !perms.Read {
+			return
+		}
+	}
+
+	rawMail := msg.RawMail()
+	if err := p.post(rawMail); err != nil {
+		slog.Info("Failed to send ephemeral article", "torid", p.PeerTorId, "error", err)
+		var nntpErr *textproto.Error
+		if !errors.As(err, &nntpErr) {
+			p.disconnect(err)
+		}
+		return
+	}
+	p.addSent(len(rawMail))
+}
+
 func (p *Peer) Connect() {
 	//
-	if p.Conn != nil {
+	if p.connected() || p.isStopped() {
 		return
 	}
 
 	slog.Info("CLIENT Dialing", "torid", p.PeerTorId)
-	conn, err := p.Tc.Dial("tcp", p.PeerTorId+".onion:80")
-	//defer conn.Close()
+	p.setState(PeerStateConnecting)
 
-	slog.Info("CLIENT Dialing response", "conn", conn, "error", err)
-	if err != nil {
+	note, _ := p.Dbs.ConfigGetString("IntroNote." + p.PeerTorId)
+	if note == "" {
+		// where notes were kept before.
+		note, _ = p.Dbs.GroupConfigGetString(p.GroupName, "IntroNote")
+	}
+	dialed := false
+	handshakeStart := time.Now()
+	dial := func() (net.Conn, error) {
+		conn, err := p.Tc.Dial("tcp", p.PeerTorId+".onion:80")
+		slog.Info("CLIENT Dialing response", "conn", conn, "error", err)
+		dialed = dialed || err == nil
+		handshakeStart = time.Now()
+		return conn, err
+	}
+
+	// a peer that's spoken version 2 isn't let downgrade.
+	proto, _ := p.Dbs.ConfigGetInt64("HandshakeProto." + p.PeerTorId)
+	conn, authed, err := p.Tc.DialHandshake(dial, p.MyKey, p.PeerTorId, note, proto < torutils.HandshakeVersion)
+	slog.Info("CLIENT Authed response", "authed", authed, "error", err)
+	if err != nil && !dialed {
+		p.setError(err)
+		p.setState(PeerStateDisconnected)
 		time.Sleep(time.Second * 5)
 		slog.Info("Error Dialer connect: try again.", "error", err)
-		//p.Cmd <- cmd
 		return
-		//return nil, err
 	}
-
-	authed, err := p.Tc.ClientHandshake(conn, p.MyKey, p.PeerTorId)
-	slog.Info("CLIENT Authed response", "authed", authed, "error", err)
 	if err != nil {
+		p.setError(err)
+		p.setState(PeerStateDisconnected)
 		slog.Info("CLIENT Error Dialer connect", "error", err)
 		return
 		//return nil, err
 	}
 	if authed == nil {
 		conn.Close()
+		p.setError(serr.Errorf("failed to handshake with %s", p.PeerTorId))
+		p.setState(PeerStateDisconnected)
 		slog.Info("CLIENT: Failed to handshake.")
 		return
 		//return nil, errors.New("Failed hanshake, signature didn't match.")
 	}
+	p.setHandshake(authed, time.Since(handshakeStart))
+	if int64(authed.Proto) > proto {
+		if err := p.Dbs.ConfigSet("HandshakeProto."+p.PeerTorId, authed.Proto); err != nil {
+			slog.Info("Failed to record the peer's handshake version", "torid", p.PeerTorId, "error", err)
+		}
+	}
 
-	c, _ := nntpclient.NewConn(conn)
-	p.Client = c
+	if authed.HasFeature(torutils.FeatureEncryption) {
+		privateKey, _ := p.MyKey.TorPrivKey()
+		secureConn, err := p.Tc.SecureClient(conn, privateKey, authed)
+		if err != nil {
+			conn.Close()
+			p.setError(err)
+			p.setState(PeerStateDisconnected)
+			return
+		}
+		conn = secureConn
+	}
+	if authed.HasFeature(torutils.FeatureCompression) {
+		compressConn, err := torutils.Compress(conn)
+		if err != nil {
+			conn.Close()
+			p.setError(err)
+			p.setState(PeerStateDisconnected)
+			return
+		}
+		conn = compressConn
+	}
 
-	p.Conn = conn
+	c, err := nntpclient.NewConn(conn)
+	if err != nil {
+		conn.Close()
+		p.setError(err)
+		p.setState(PeerStateDisconnected)
+		return
+	}
 	c.Authenticate("user", "password")
+
+	p.connLock.Lock()
+	if p.Conn != nil || p.stopped {
+		// another command connected, or the peer was removed, while we were
+		// dialing.
+		p.connLock.Unlock()
+		conn.Close()
+		return
+	}
+	p.Client = c
+	p.Conn = conn
+	p.connLock.Unlock()
+	p.setState(PeerStateConnected)
 }
 
 type Peers struct {
@@ -314,6 +675,9 @@ type Peers struct {
 	DBs   *databases.BackendDbs
 	Cmd   chan PeeringMessage
 	Exit  chan interface{}
+
+	// Events gets peer connections, set it before Connect.
+	Events *events.Bus
 }
 
 func NewPeers(tc *torutils.TorCon, myKey keytool.EasyEdKey, DBs *databases.BackendDbs) (*Peers, error) {
@@ -357,13 +721,13 @@ func (p *Peers) Worker() {
 				for _, torid := range peerList {
 					peerKey := keytool.EasyEdKey{}
 					peerKey.SetTorId(torid)
-					conn, _ := NewPeer(p.Tc, p.Cmd, p.MyKey, peerKey, p.DBs)
+					conn, _ := NewPeer(p.Tc, p.Cmd, p.MyKey, peerKey, p.DBs, p.Events)
 					p.Conns[torid] = conn
 					p.Conns[torid].Cmd <- cmd
 				}
 
 				close(errChan)
-			case CmdDistribute:
+			case CmdDistribute, CmdDistributeEphemeral:
 				for _, peer := range p.Conns {
 					peer.Cmd <- cmd
 				}
@@ -371,7 +735,9 @@ func (p *Peers) Worker() {
 			case CmdRemovePeer:
 
 				torid := cmd.Args[0].(string)
-				p.Conns[torid].Cmd <- cmd
+				if peer, ok := p.Conns[torid]; ok {
+					peer.Cmd <- cmd
+				}
 				delete(p.Conns, torid)
 				//res, err := p.DBs.Peers.Exec("DELETE FROM peers WHERE torid=?;", torid)
 				//slog.Info("TRY REMOVE PEER DELETE", "error", err, "res", res)
@@ -400,7 +766,7 @@ func (p *Peers) Worker() {
 
 				peerKey := keytool.EasyEdKey{}
 				peerKey.SetTorId(torid)
-				conn, err := NewPeer(p.Tc, p.Cmd, p.MyKey, peerKey, p.DBs)
+				conn, err := NewPeer(p.Tc, p.Cmd, p.MyKey, peerKey, p.DBs, p.Events)
 
 				slog.Info("ERROR ADDPEER", "error", err)
 				if err != nil {
@@ -416,6 +782,30 @@ func (p *Peers) Worker() {
 			case CmdSendme:
 				torid := cmd.Args[0].(string)
 				p.Conns[torid].Cmd <- cmd
+
+			case CmdStatus:
+				ret := cmd.Args[0].(chan []*Peer)
+				list := []*Peer{}
+				for _, peer := range p.Conns {
+					list = append(list, peer)
+				}
+				ret <- list
+				close(ret)
+
+			case CmdReceived:
+				torid := cmd.Args[0].(string)
+				if peer, ok := p.Conns[torid]; ok {
+					peer.addReceived(cmd.Args[1].(int))
+				}
+
+			case CmdInbound:
+				torid := cmd.Args[0].(string)
+				if peer, ok := p.Conns[torid]; ok {
+					peer.setInbound(cmd.Args[1].(bool))
+				}
+				if cmd.Args[1].(bool) {
+					p.Events.Publish(events.Event{Type: events.PeerConnected, TorId: torid})
+				}
 			}
 
 		case <-p.Exit:
@@ -456,6 +846,14 @@ func (p *Peers) DistributeArticle(msg messages.MessageTool) error {
 	return nil
 }
 
+// DistributeEphemeral sends an ephemeral article to every connected peer.
+func (p *Peers) DistributeEphemeral(msg messages.MessageTool) {
+	p.Cmd <- PeeringMessage{
+		Cmd:  CmdDistributeEphemeral,
+		Args: []interface{}{msg},
+	}
+}
+
 func (p *Peers) Connect() error {
 	err := make(chan error)
 	p.Cmd <- PeeringMessage{
@@ -475,3 +873,75 @@ func (p *Peers) Sendme(peerid, list, options string) error {
 
 	return <-err
 }
+
+// Status returns the state of every peer, including how far behind the head
+// of articles.db each one is.
+func (p *Peers) Status() ([]PeerStatus, error) {
+	ret := make(chan []*Peer)
+	p.Cmd <- PeeringMessage{
+		Cmd:  CmdStatus,
+		Args: []interface{}{ret},
+	}
+	peers := <-ret
+
+	head, err := p.DBs.GetLastArticleId()
+	if err != nil {
+		return nil, serr.New(err)
+	}
+
+	list := []PeerStatus{}
+	for _, peer := range peers {
+		status := peer.Status()
+		status.HeadMessage = head
+		lastMessage, err := p.DBs.GroupConfigGetInt64(peer.GroupName, "LastMessage")
+		if err == nil {
+			status.LastMessage = lastMessage
+			status.Behind = head - lastMessage
+		}
+		list = append(list, status)
+	}
+
+	return list, nil
+}
+
+// Fetch asks the connected peers for an article by message id, starting
+// with the first'th of them, so fetches running in parallel are spread
+// across the peers.
+func (p *Peers) Fetch(messageId string, first int) (string, error) {
+	ret := make(chan []*Peer)
+	p.Cmd <- PeeringMessage{
+		Cmd:  CmdStatus,
+		Args: []interface{}{ret},
+	}
+	peers := <-ret
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PeerTorId < peers[j].PeerTorId })
+
+	for i := range peers {
+		peer := peers[(first+i)%len(peers)]
+		if !peer.connected() {
+			continue
+		}
+		raw, err := peer.fetch(messageId)
+		if err == nil {
+			return raw, nil
+		}
+		slog.Info("Failed to fetch article from peer", "torid", peer.PeerTorId, "messageId", messageId, "error", err)
+	}
+	return "", serr.Errorf("no peer has %s", messageId)
+}
+
+// ArticleReceived records an article accepted from a peer's session.
+func (p *Peers) ArticleReceived(torId string, bytes int) {
+	p.Cmd <- PeeringMessage{
+		Cmd:  CmdReceived,
+		Args: []interface{}{torId, bytes},
+	}
+}
+
+// InboundConnection records a peer connecting to, or leaving, our onion service.
+func (p *Peers) InboundConnection(torId string, connected bool) {
+	p.Cmd <- PeeringMessage{
+		Cmd:  CmdInbound,
+		Args: []interface{}{torId, connected},
+	}
+}
@@ -0,0 +1,127 @@
+package torutils
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// Session compression, used when both sides negotiated FeatureCompression.
+//
+// This isn't NNTP COMPRESS DEFLATE (RFC 8054), the NNTP client and server
+// don't implement the COMPRESS command, so plain NNTP clients can't use it.
+// It's turned on by the handshake instead: straight after it, and session
+// encryption if any, each direction is a single raw DEFLATE stream.
+//
+// Writes are held in the compressor, so a burst of small writes goes out as
+// one block, until the connection is read or flushDelay passes. A sync
+// flush after every write grew NNTP traffic, each one adds a few bytes and a
+// new block.
+//
+// Compressing before encrypting means the size of what's sent shows how
+// well it compressed. Someone who can get their own articles sent over a
+// session, and watch its traffic, can guess other content in the same
+// stream by how the sizes change, as in CRIME. Sessions only carry articles
+// the peer may read anyway, and the handshake and keys are sent before
+// compression starts, but a node carrying private groups can stop offering
+// it with the WireCompression config set to "false".
+
+// flushDelay is the longest written data waits in the compressor.
+const flushDelay = 5 * time.Millisecond
+
+// wireRaw and wireCompressed count every compressed session's bytes, before
+// and after compression, both ways.
+var wireRaw, wireCompressed atomic.Int64
+
+// CompressionStats returns the bytes sent and received over compressed
+// sessions, and what they took on the wire.
+func CompressionStats() (raw, compressed int64) {
+	return wireRaw.Load(), wireCompressed.Load()
+}
+
+// CompressConn compresses everything written to, and read from, a
+// connection.
+type CompressConn struct {
+	net.Conn
+
+	reader    io.ReadCloser
+	writeLock sync.Mutex
+	writer    *flate.Writer
+	// pending is set while written data waits in the compressor, and a
+	// flush is due.
+	pending bool
+}
+
+type countingConn struct {
+	net.Conn
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	wireCompressed.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	wireCompressed.Add(int64(n))
+	return n, err
+}
+
+// Compress starts compressing conn, both sides must do so at the same point.
+func Compress(conn net.Conn) (*CompressConn, error) {
+	wire := &countingConn{Conn: conn}
+	writer, err := flate.NewWriter(wire, flate.DefaultCompression)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	return &CompressConn{
+		Conn:   conn,
+		reader: flate.NewReader(wire),
+		writer: writer,
+	}, nil
+}
+
+func (c *CompressConn) Read(p []byte) (int, error) {
+	// the peer may be waiting on what's written before it replies.
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	n, err := c.reader.Read(p)
+	wireRaw.Add(int64(n))
+	return n, err
+}
+
+func (c *CompressConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	n, err := c.writer.Write(p)
+	wireRaw.Add(int64(n))
+	if err == nil && !c.pending {
+		c.pending = true
+		time.AfterFunc(flushDelay, func() { c.flush() })
+	}
+	return n, err
+}
+
+// flush sends anything waiting in the compressor.
+func (c *CompressConn) flush() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if !c.pending {
+		return nil
+	}
+	c.pending = false
+	return c.writer.Flush()
+}
+
+func (c *CompressConn) Close() error {
+	c.flush()
+	c.reader.Close()
+	return c.Conn.Close()
+}
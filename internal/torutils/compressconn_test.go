@@ -0,0 +1,126 @@
+package torutils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wireCounter counts what's written to a connection.
+type wireCounter struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (w wireCounter) Write(p []byte) (int, error) {
+	n, err := w.Conn.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+func compressedPipe(t *testing.T) (*CompressConn, *CompressConn, *atomic.Int64) {
+	c1, c2 := net.Pipe()
+	wire := &atomic.Int64{}
+	client, err := Compress(wireCounter{Conn: c1, n: wire})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := Compress(wireCounter{Conn: c2, n: wire})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server, wire
+}
+
+// TestCompressConnSession runs an NNTP like session of small writes, each
+// side waits on the other with nothing flushed by hand. It must all arrive,
+// and be smaller on the wire.
+func TestCompressConnSession(t *testing.T) {
+	client, server, wire := compressedPipe(t)
+	const articles = 50
+
+	raw := &atomic.Int64{}
+	write := func(w io.Writer, line string) {
+		raw.Add(int64(len(line)))
+		if _, err := io.WriteString(w, line); err != nil {
+			t.Error(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := bufio.NewReader(server)
+		write(server, "200 kothawoc ready\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			id := strings.TrimSpace(strings.TrimPrefix(line, "ARTICLE "))
+			write(server, "220 0 "+id+"\r\n")
+			write(server, "From: aoqqpp7tzyil4hlq3umoos6atft6jvrqtosq2xy53sdgiesvgg4bqead\r\n")
+			write(server, "Newsgroups: kothawoc.test\r\n")
+			write(server, "Subject: article "+id+"\r\n")
+			write(server, "Message-Id: "+id+"\r\n")
+			write(server, "\r\n")
+			write(server, "The body of the article.\r\n")
+			write(server, ".\r\n")
+		}
+	}()
+
+	r := bufio.NewReader(client)
+	if line, err := r.ReadString('\n'); err != nil || line != "200 kothawoc ready\r\n" {
+		t.Fatalf("greeting %q, %v", line, err)
+	}
+	for i := 0; i < articles; i++ {
+		id := fmt.Sprintf("<%d@kothawoc.test>", i)
+		write(client, "ARTICLE "+id+"\r\n")
+		lines := 0
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == ".\r\n" {
+				break
+			}
+			lines++
+			if lines == 1 && line != "220 0 "+id+"\r\n" {
+				t.Fatalf("response %q", line)
+			}
+		}
+		if lines != 7 {
+			t.Fatalf("article %s had %d lines", id, lines)
+		}
+	}
+	client.Close()
+	<-done
+
+	if wire.Load() >= raw.Load() {
+		t.Errorf("%d bytes took %d on the wire", raw.Load(), wire.Load())
+	}
+}
+
+// A write with nothing read after it still goes out.
+func TestCompressConnDelayedFlush(t *testing.T) {
+	client, server, _ := compressedPipe(t)
+
+	if _, err := io.WriteString(client, "MODE STREAM\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(server).ReadString('\n')
+	if err != nil || line != "MODE STREAM\r\n" {
+		t.Fatalf("read %q, %v", line, err)
+	}
+}
@@ -0,0 +1,707 @@
+package torutils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/torutil/ed25519"
+
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// Protocol version 1, still accepted by the server from older nodes.
+//
+// C > {public key hex} {tor id} {random hex string 64 bytes long} [{intro note hex}] {signature}\n
+// S    - verify the signature, drop connection if falty
+// S    - check if the tor ID is allowed to connect, drop connection if not,
+// S      strangers can send an intro note, which is shown with their request.
+// S    - otherwise send the next message.
+// S    - create signature of: {server message} + " " + {client message}
+// S > {public key hex} {tor id} {random hex string 64 bytes long} {special signature}\n
+// C    - verify the server message, drop if it's not who you thought.
+// C > {hex sign server message}\n
+// S    - verify client signature, drop connection if falty
+// S > {OK}\n
+
+// Protocol version 2, every line is "KWHS <version>" followed by space
+// separated key=value fields, the signature is always the last field and
+// covers everything before it.
+//
+// C > KWHS 2 pubkey={hex} torid={tor id} nonce={hex} ts={unix} features={a,b} maxsize={bytes} sw={software} [note={hex}] sig={hex}\n
+// S    - verify the signature, timestamp and that the nonce wasn't seen before
+// S    - check if the tor ID is allowed to connect, drop connection if not
+// S > KWHS 2 pubkey={hex} torid={tor id} nonce={hex} ts={unix} features={a,b} maxsize={bytes} sw={software} sig={hex}\n
+// S      the signature covers the server fields + "\n" + the client line.
+// C    - verify the server is who we dialed, and the signature
+// C > {hex sign server line}\n
+// S    - verify client signature, drop connection if falty
+// S > OK\n
+//
+// Both sides then use the intersection of the features, and the smallest
+// non zero max article size.
+//
+// Nodes from before version 2 hang up on a version 2 line, so a client that
+// gets no response redials and speaks version 1, see DialHandshake. Anyone
+// on the path can hang up too, so once a peer's spoken version 2 it's never
+// spoken to with version 1, which has no encryption or compression.
+//
+// Everything arriving is hostile until the signatures check out, so every
+// field is length and format checked before it's used, and every read has a
+// deadline.
+
+const (
+	Ed25519privateKeySize int = ed25519.PrivateKeySize
+	Ed25519publicKeySize  int = ed25519.PublicKeySize
+	Ed25519signatureSize  int = ed25519.SignatureSize
+
+	// hex encoded it has to fit in the handshake line.
+	MaxIntroNoteSize int = 200
+
+	maxHandshakeLine = 1024
+	nonceSize        = 32
+	torIdSize        = 56
+
+	handshakeMagic   = "KWHS"
+	HandshakeVersion = 2
+
+	// how far the timestamp may be from our clock, and how long nonces
+	// are remembered to refuse replays.
+	HandshakeWindow = 5 * time.Minute
+
+	Software = "kothawoc/0.2"
+)
+
+// HandshakeTimeout is the deadline for each line of the handshake.
+var HandshakeTimeout = 30 * time.Second
+
+var (
+	ErrHandshakeMalformed  error = errors.New("malformed handshake")
+	ErrHandshakeOversize   error = errors.New("handshake line too long")
+	ErrHandshakeVersion    error = errors.New("unsupported handshake version")
+	ErrHandshakeIdentity   error = errors.New("handshake torid doesn't match public key")
+	ErrHandshakeSignature  error = errors.New("handshake signature invalid")
+	ErrHandshakeExpired    error = errors.New("handshake timestamp outside window")
+	ErrHandshakeReplay     error = errors.New("handshake replayed")
+	ErrHandshakeRefused    error = errors.New("handshake refused")
+	ErrHandshakeUnexpected error = errors.New("handshake with unexpected node")
+	ErrHandshakeLegacy     error = errors.New("handshake version 2 not understood")
+	ErrHandshakeDowngrade  error = errors.New("handshake version 1 refused, the node spoke version 2 before")
+)
+
+// Features that can be negotiated in the handshake.
+const (
+	FeatureStreaming   = "streaming"
+	FeatureCompression = "compress"
+	FeatureEncryption  = "encrypt"
+)
+
+// HandshakeOptions is what this node offers to its peers.
+type HandshakeOptions struct {
+	Features       []string
+	MaxArticleSize int64
+	Software       string
+}
+
+// Handshake is the result of a successful handshake, Features and
+// MaxArticleSize are the negotiated values for the connection, the rest
+// describes the remote node.
+type Handshake struct {
+	Proto          int
+	PubKey         ed25519.PublicKey
+	TorId          string
+	Features       []string
+	MaxArticleSize int64
+	Software       string
+	Note           string
+
+	// Transcript is a hash of both handshake lines, later layers bind to it
+	// so they can't be spliced onto another handshake.
+	Transcript []byte
+}
+
+func transcript(clientRequest, serverResponse string) []byte {
+	sum := sha256.Sum256([]byte(clientRequest + "\n" + serverResponse))
+	return sum[:]
+}
+
+func (h *Handshake) HasFeature(feature string) bool {
+	return slices.Contains(h.Features, feature)
+}
+
+// replayCache remembers the nonces seen within the handshake window.
+type replayCache struct {
+	lock   sync.Mutex
+	nonces map[string]time.Time
+}
+
+func (r *replayCache) seen(nonce string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.nonces == nil {
+		r.nonces = map[string]time.Time{}
+	}
+	now := time.Now()
+	for n, t := range r.nonces {
+		if now.Sub(t) > 2*HandshakeWindow {
+			delete(r.nonces, n)
+		}
+	}
+	if _, ok := r.nonces[nonce]; ok {
+		return true
+	}
+	r.nonces[nonce] = now
+	return false
+}
+
+func randomHexString(n int) string {
+	rMesg := make([]byte, n)
+	rand.Read(rMesg)
+	return hex.EncodeToString(rMesg)
+}
+
+// readLine reads a single handshake line, a byte at a time so nothing after
+// the handshake is consumed. Only printable ascii is allowed.
+func readLine(conn net.Conn) (string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return "", serr.New(err)
+	}
+
+	tbuf := make([]byte, 1)
+	line := make([]byte, 0, 256)
+	for {
+		if _, err := conn.Read(tbuf); err != nil {
+			return "", serr.New(err)
+		}
+		switch c := tbuf[0]; {
+		case c == '\n':
+			return strings.TrimSuffix(string(line), "\r"), nil
+		case c == '\r' || (c >= 0x20 && c < 0x7f):
+			line = append(line, c)
+		default:
+			return "", serr.New(ErrHandshakeMalformed)
+		}
+		if len(line) > maxHandshakeLine {
+			return "", serr.New(ErrHandshakeOversize)
+		}
+	}
+}
+
+func writeLine(conn net.Conn, line string) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return serr.New(err)
+	}
+	_, err := conn.Write([]byte(line + "\n"))
+	return serr.New(err)
+}
+
+// clearDeadlines hands the connection back without the handshake deadlines.
+func clearDeadlines(conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+}
+
+// decodeHex decodes s, which must decode to exactly size bytes.
+func decodeHex(s string, size int) ([]byte, error) {
+	if len(s) != size*2 {
+		return nil, serr.New(ErrHandshakeMalformed)
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, serr.New(ErrHandshakeMalformed)
+	}
+	return b, nil
+}
+
+// decodePubKey decodes a hex public key and checks it belongs to torId.
+func decodePubKey(hexKey, torId string) (ed25519.PublicKey, error) {
+	raw, err := decodeHex(hexKey, Ed25519publicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	if len(torId) != torIdSize {
+		return nil, serr.New(ErrHandshakeMalformed)
+	}
+
+	pubKey := ed25519.PublicKey(raw)
+	key := keytool.EasyEdKey{}
+	key.SetTorPublicKey(pubKey)
+	keyTorId, err := key.TorId()
+	if err != nil || keyTorId != torId {
+		return nil, serr.New(ErrHandshakeIdentity)
+	}
+	return pubKey, nil
+}
+
+func decodeNote(hexNote string) (string, error) {
+	if len(hexNote) > MaxIntroNoteSize*2 {
+		return "", serr.New(ErrHandshakeMalformed)
+	}
+	note, err := hex.DecodeString(hexNote)
+	if err != nil {
+		return "", serr.New(ErrHandshakeMalformed)
+	}
+	return string(note), nil
+}
+
+func verify(pubKey ed25519.PublicKey, msg string, hexSig string) error {
+	sig, err := decodeHex(hexSig, Ed25519signatureSize)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pubKey, []byte(msg), sig) {
+		return serr.New(ErrHandshakeSignature)
+	}
+	return nil
+}
+
+func validToken(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func (o HandshakeOptions) fields(privateKey ed25519.PrivateKey) (string, error) {
+	key := keytool.EasyEdKey{}
+	key.SetTorPrivateKey(privateKey)
+	torId, err := key.TorId()
+	if err != nil {
+		return "", serr.New(err)
+	}
+
+	software := o.Software
+	if software == "" {
+		software = Software
+	}
+
+	return handshakeMagic + " " + strconv.Itoa(HandshakeVersion) +
+		" pubkey=" + hex.EncodeToString([]byte(privateKey.PublicKey())) +
+		" torid=" + torId +
+		" nonce=" + randomHexString(nonceSize) +
+		" ts=" + strconv.FormatInt(time.Now().Unix(), 10) +
+		" features=" + strings.Join(o.Features, ",") +
+		" maxsize=" + strconv.FormatInt(o.MaxArticleSize, 10) +
+		" sw=" + strings.ReplaceAll(software, " ", "_"), nil
+}
+
+// parseHandshakeLine splits a v2 line into its fields, and the part of the
+// line the signature covers.
+func parseHandshakeLine(line string) (map[string]string, string, error) {
+	split := strings.Split(line, " ")
+	if len(split) < 3 || split[0] != handshakeMagic {
+		return nil, "", serr.New(ErrHandshakeMalformed)
+	}
+	if version, err := strconv.Atoi(split[1]); err != nil || version < HandshakeVersion {
+		return nil, "", serr.New(ErrHandshakeVersion)
+	}
+
+	fields := map[string]string{}
+	for _, f := range split[2:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || !validToken(kv[0]) {
+			return nil, "", serr.New(ErrHandshakeMalformed)
+		}
+		if _, ok := fields[kv[0]]; ok {
+			return nil, "", serr.New(ErrHandshakeMalformed)
+		}
+		fields[kv[0]] = kv[1]
+	}
+
+	for _, required := range []string{"pubkey", "torid", "nonce", "ts", "features", "maxsize", "sw", "sig"} {
+		if _, ok := fields[required]; !ok {
+			return nil, "", serr.New(ErrHandshakeMalformed)
+		}
+	}
+	if !strings.HasPrefix(split[len(split)-1], "sig=") {
+		return nil, "", serr.New(ErrHandshakeMalformed)
+	}
+
+	return fields, line[:strings.LastIndex(line, " sig=")], nil
+}
+
+// checkHandshakeFields verifies the identity and freshness of the fields, and
+// returns the remote's view of the handshake.
+func checkHandshakeFields(fields map[string]string, signed string) (*Handshake, error) {
+	pubKey, err := decodePubKey(fields["pubkey"], fields["torid"])
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := decodeHex(fields["nonce"], nonceSize); err != nil {
+		return nil, err
+	}
+
+	ts, err := strconv.ParseInt(fields["ts"], 10, 64)
+	if err != nil {
+		return nil, serr.New(ErrHandshakeMalformed)
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > HandshakeWindow || d < -HandshakeWindow {
+		return nil, serr.New(ErrHandshakeExpired)
+	}
+
+	maxSize, err := strconv.ParseInt(fields["maxsize"], 10, 64)
+	if err != nil || maxSize < 0 {
+		return nil, serr.New(ErrHandshakeMalformed)
+	}
+
+	features := []string{}
+	if fields["features"] != "" {
+		features = strings.Split(fields["features"], ",")
+		for _, f := range features {
+			if !validToken(f) {
+				return nil, serr.New(ErrHandshakeMalformed)
+			}
+		}
+	}
+
+	note, err := decodeNote(fields["note"])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verify(pubKey, signed, fields["sig"]); err != nil {
+		return nil, err
+	}
+
+	return &Handshake{
+		Proto:          HandshakeVersion,
+		PubKey:         pubKey,
+		TorId:          fields["torid"],
+		Features:       features,
+		MaxArticleSize: maxSize,
+		Software:       fields["sw"],
+		Note:           note,
+	}, nil
+}
+
+// negotiate narrows the remote's handshake down to what both sides support.
+func (o HandshakeOptions) negotiate(h *Handshake) {
+	features := []string{}
+	for _, f := range h.Features {
+		if slices.Contains(o.Features, f) {
+			features = append(features, f)
+		}
+	}
+	h.Features = features
+
+	if h.MaxArticleSize <= 0 || (o.MaxArticleSize > 0 && o.MaxArticleSize < h.MaxArticleSize) {
+		h.MaxArticleSize = o.MaxArticleSize
+	}
+}
+
+// ClientHandshake authenticates us to the node at remoteAddr and checks it
+// really is that node. note is shown to the remote user if we aren't their
+// peer yet.
+func (t *TorCon) ClientHandshake(conn net.Conn, myKey keytool.EasyEdKey, remoteAddr, note string) (*Handshake, error) {
+	defer clearDeadlines(conn)
+
+	privateKey, err := myKey.TorPrivKey()
+	if err != nil {
+		return nil, serr.New(err)
+	}
+
+	request, err := t.Options.fields(privateKey)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	if note != "" {
+		if len(note) > MaxIntroNoteSize {
+			note = note[:MaxIntroNoteSize]
+		}
+		request += " note=" + hex.EncodeToString([]byte(note))
+	}
+	request += " sig=" + hex.EncodeToString(ed25519.Sign(privateKey, []byte(request)))
+	if err := writeLine(conn, request); err != nil {
+		return nil, err
+	}
+
+	// get response, older nodes hang up without one.
+	response, err := readLine(conn)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, serr.Wrap(ErrHandshakeLegacy, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(response, handshakeMagic+" ") {
+		return nil, serr.New(ErrHandshakeLegacy)
+	}
+	fields, signed, err := parseHandshakeLine(response)
+	if err != nil {
+		return nil, err
+	}
+	if fields["torid"] != strings.TrimSuffix(remoteAddr, ".onion") {
+		return nil, serr.Wrap(ErrHandshakeUnexpected, serr.Errorf("expected %s got %s", remoteAddr, fields["torid"]))
+	}
+	h, err := checkHandshakeFields(fields, signed+"\n"+request)
+	if err != nil {
+		return nil, err
+	}
+
+	// sign server message so they can trust you.
+	if err := writeLine(conn, hex.EncodeToString(ed25519.Sign(privateKey, []byte(response)))); err != nil {
+		return nil, err
+	}
+	serverLine := response
+
+	// wait for OK
+	response, err = readLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	if response != "OK" {
+		return nil, serr.New(ErrHandshakeRefused)
+	}
+
+	h.Transcript = transcript(request, serverLine)
+	t.Options.negotiate(h)
+	return h, nil
+}
+
+// ClientHandshakeV1 is ClientHandshake for nodes from before version 2, there
+// is nothing to negotiate.
+func (t *TorCon) ClientHandshakeV1(conn net.Conn, myKey keytool.EasyEdKey, remoteAddr, note string) (*Handshake, error) {
+	defer clearDeadlines(conn)
+
+	privateKey, err := myKey.TorPrivKey()
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	torId, err := myKey.TorId()
+	if err != nil {
+		return nil, serr.New(err)
+	}
+
+	request := hex.EncodeToString([]byte(privateKey.PublicKey())) + " " + torId + " " + randomHexString(nonceSize)
+	if note != "" {
+		if len(note) > MaxIntroNoteSize {
+			note = note[:MaxIntroNoteSize]
+		}
+		request += " " + hex.EncodeToString([]byte(note))
+	}
+	request += " " + hex.EncodeToString(ed25519.Sign(privateKey, []byte(request)))
+	if err := writeLine(conn, request); err != nil {
+		return nil, err
+	}
+
+	response, err := readLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	splitResponse := strings.Split(response, " ")
+	if len(splitResponse) != 4 {
+		return nil, serr.New(ErrHandshakeMalformed)
+	}
+	// the oldest nodes sent the wrong torid, so only the key is checked.
+	serverKey, err := decodeHex(splitResponse[0], Ed25519publicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	key := keytool.EasyEdKey{}
+	key.SetTorPublicKey(ed25519.PublicKey(serverKey))
+	serverId, err := key.TorId()
+	if err != nil || serverId != strings.TrimSuffix(remoteAddr, ".onion") {
+		return nil, serr.Wrap(ErrHandshakeUnexpected, serr.Errorf("expected %s got %s", remoteAddr, serverId))
+	}
+	if _, err := decodeHex(splitResponse[2], nonceSize); err != nil {
+		return nil, err
+	}
+	if err := verify(ed25519.PublicKey(serverKey), strings.Join(splitResponse[:3], " ")+" "+request, splitResponse[3]); err != nil {
+		return nil, err
+	}
+
+	if err := writeLine(conn, hex.EncodeToString(ed25519.Sign(privateKey, []byte(response)))); err != nil {
+		return nil, err
+	}
+	ok, err := readLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	if ok != "OK" {
+		return nil, serr.New(ErrHandshakeRefused)
+	}
+
+	h := &Handshake{
+		Proto:    1,
+		PubKey:   ed25519.PublicKey(serverKey),
+		TorId:    serverId,
+		Features: []string{},
+	}
+	t.Options.negotiate(h)
+	return h, nil
+}
+
+// DialHandshake dials with dial and shakes hands with remoteAddr. If it
+// doesn't understand version 2 it's spoken to with version 1, only if
+// allowV1, which should be false once it's spoken version 2.
+func (t *TorCon) DialHandshake(dial func() (net.Conn, error), myKey keytool.EasyEdKey, remoteAddr, note string, allowV1 bool) (net.Conn, *Handshake, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, nil, serr.New(err)
+	}
+	h, err := t.ClientHandshake(conn, myKey, remoteAddr, note)
+	if err == nil {
+		return conn, h, nil
+	}
+	conn.Close()
+	if !errors.Is(err, ErrHandshakeLegacy) {
+		return nil, nil, err
+	}
+
+	if !allowV1 {
+		slog.Warn("Handshake version 2 not understood by a node that spoke it before, refusing version 1", "torid", remoteAddr, "error", err)
+		return nil, nil, serr.Wrap(ErrHandshakeDowngrade, err)
+	}
+	slog.Warn("Handshake version 2 not understood, downgrading to version 1 without encryption or compression", "torid", remoteAddr)
+	conn, err = dial()
+	if err != nil {
+		return nil, nil, serr.New(err)
+	}
+	h, err = t.ClientHandshakeV1(conn, myKey, remoteAddr, note)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, h, nil
+}
+
+// ServerHandshake authenticates a connecting node, speaking whichever
+// protocol version it started with.
+func (t *TorCon) ServerHandshake(conn net.Conn, privateKey ed25519.PrivateKey, authCallback func(clientPubKey ed25519.PublicKey, note string) bool) (*Handshake, error) {
+	defer clearDeadlines(conn)
+
+	// get initial client request
+	clientRequest, err := readLine(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(clientRequest, handshakeMagic+" ") {
+		return t.serverHandshakeV2(conn, privateKey, clientRequest, authCallback)
+	}
+	return t.serverHandshakeV1(conn, privateKey, clientRequest, authCallback)
+}
+
+func (t *TorCon) serverHandshakeV1(conn net.Conn, privateKey ed25519.PrivateKey, clientRequest string, authCallback func(clientPubKey ed25519.PublicKey, note string) bool) (*Handshake, error) {
+	splitRequest := strings.Split(clientRequest, " ")
+	if len(splitRequest) != 4 && len(splitRequest) != 5 {
+		return nil, serr.New(ErrHandshakeMalformed)
+	}
+
+	clientPubKey, err := decodePubKey(splitRequest[0], splitRequest[1])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decodeHex(splitRequest[2], nonceSize); err != nil {
+		return nil, err
+	}
+
+	sigPos := len(splitRequest) - 1
+	note := ""
+	if sigPos == 4 {
+		if note, err = decodeNote(splitRequest[3]); err != nil {
+			return nil, err
+		}
+	}
+
+	// verify before asking the callback, so only genuine keys are recorded.
+	if err := verify(clientPubKey, strings.Join(splitRequest[:sigPos], " "), splitRequest[sigPos]); err != nil {
+		slog.Info("SERVER HANDSHAKE AUTH SIGNATURE FAILED", "torid", splitRequest[1])
+		return nil, err
+	}
+	if !authCallback(clientPubKey, note) {
+		slog.Info("SERVER HANDSHAKE AUTH CALLBACK FAILED", "torid", splitRequest[1])
+		return nil, serr.New(ErrHandshakeRefused)
+	}
+
+	// send response to client
+	myKey := keytool.EasyEdKey{}
+	myKey.SetTorPrivateKey(privateKey)
+	torId, err := myKey.TorId()
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	response := hex.EncodeToString([]byte(privateKey.PublicKey())) + " " + torId + " " + randomHexString(nonceSize)
+	specialSignature := hex.EncodeToString(ed25519.Sign(privateKey, []byte(response+" "+clientRequest)))
+	response += " " + specialSignature
+	if err := writeLine(conn, response); err != nil {
+		return nil, err
+	}
+
+	// get final signature from client
+	clientSig, err := readLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(clientPubKey, response, clientSig); err != nil {
+		return nil, err
+	}
+	if err := writeLine(conn, "OK"); err != nil {
+		return nil, err
+	}
+
+	return &Handshake{
+		Proto:    1,
+		PubKey:   clientPubKey,
+		TorId:    splitRequest[1],
+		Features: []string{},
+		Note:     note,
+	}, nil
+}
+
+func (t *TorCon) serverHandshakeV2(conn net.Conn, privateKey ed25519.PrivateKey, clientRequest string, authCallback func(clientPubKey ed25519.PublicKey, note string) bool) (*Handshake, error) {
+	fields, signed, err := parseHandshakeLine(clientRequest)
+	if err != nil {
+		return nil, err
+	}
+	// verify before asking the callback, so only genuine keys are recorded.
+	h, err := checkHandshakeFields(fields, signed)
+	if err != nil {
+		return nil, err
+	}
+	if t.replays.seen(fields["nonce"]) {
+		return nil, serr.New(ErrHandshakeReplay)
+	}
+
+	if !authCallback(h.PubKey, h.Note) {
+		return nil, serr.New(ErrHandshakeRefused)
+	}
+
+	response, err := t.Options.fields(privateKey)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	response += " sig=" + hex.EncodeToString(ed25519.Sign(privateKey, []byte(response+"\n"+clientRequest)))
+	if err := writeLine(conn, response); err != nil {
+		return nil, err
+	}
+
+	// get final signature from client
+	clientSig, err := readLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(h.PubKey, response, clientSig); err != nil {
+		return nil, err
+	}
+	if err := writeLine(conn, "OK"); err != nil {
+		return nil, err
+	}
+
+	h.Transcript = transcript(clientRequest, response)
+	t.Options.negotiate(h)
+	return h, nil
+}
@@ -0,0 +1,294 @@
+package torutils
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/torutil/ed25519"
+
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+)
+
+func testKey(t testing.TB) (keytool.EasyEdKey, ed25519.PrivateKey, string) {
+	key := keytool.EasyEdKey{}
+	key.GenerateKey()
+	privateKey, err := key.TorPrivKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	torId, err := key.TorId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, privateKey, torId
+}
+
+func acceptAll(ed25519.PublicKey, string) bool { return true }
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	cliKey, _, cliId := testKey(t)
+	_, srvPriv, srvId := testKey(t)
+
+	server := &TorCon{Options: HandshakeOptions{Features: []string{FeatureStreaming, FeatureEncryption}, MaxArticleSize: 1000}}
+	client := &TorCon{Options: HandshakeOptions{Features: []string{FeatureEncryption, FeatureCompression}, MaxArticleSize: 500}}
+
+	srvConn, cliConn := net.Pipe()
+	defer srvConn.Close()
+	defer cliConn.Close()
+
+	type result struct {
+		h   *Handshake
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		var note string
+		h, err := server.ServerHandshake(srvConn, srvPriv, func(_ ed25519.PublicKey, n string) bool {
+			note = n
+			return true
+		})
+		if h != nil && h.Note != note {
+			t.Errorf("callback note %q, handshake note %q", note, h.Note)
+		}
+		done <- result{h, err}
+	}()
+
+	cliH, err := client.ClientHandshake(cliConn, cliKey, srvId+".onion", "hello there")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := <-done
+	if srv.err != nil {
+		t.Fatal(srv.err)
+	}
+
+	if cliH.TorId != srvId || srv.h.TorId != cliId {
+		t.Errorf("torids client saw %s server saw %s", cliH.TorId, srv.h.TorId)
+	}
+	if srv.h.Note != "hello there" {
+		t.Errorf("note %q", srv.h.Note)
+	}
+	for _, h := range []*Handshake{cliH, srv.h} {
+		if h.Proto != HandshakeVersion || len(h.Features) != 1 || !h.HasFeature(FeatureEncryption) || h.MaxArticleSize != 500 {
+			t.Errorf("bad negotiation %+v", h)
+		}
+	}
+}
+
+func TestHandshakeWrongServer(t *testing.T) {
+	cliKey, _, _ := testKey(t)
+	_, srvPriv, _ := testKey(t)
+	_, _, otherId := testKey(t)
+
+	srvConn, cliConn := net.Pipe()
+	defer srvConn.Close()
+	defer cliConn.Close()
+
+	go (&TorCon{}).ServerHandshake(srvConn, srvPriv, acceptAll)
+
+	if _, err := (&TorCon{}).ClientHandshake(cliConn, cliKey, otherId, ""); err == nil {
+		t.Fatal("handshake with the wrong node succeeded")
+	}
+}
+
+// v1Request is a valid request from an old node.
+func v1Request(t testing.TB) string {
+	_, priv, torId := testKey(t)
+	req := hex.EncodeToString([]byte(priv.PublicKey())) + " " + torId + " " + randomHexString(nonceSize)
+	return req + " " + hex.EncodeToString(ed25519.Sign(priv, []byte(req)))
+}
+
+// v2Request is a valid request from a current node.
+func v2Request(t testing.TB) string {
+	_, priv, _ := testKey(t)
+	req, err := HandshakeOptions{Features: []string{FeatureStreaming}}.fields(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req += " note=" + hex.EncodeToString([]byte("hi"))
+	return req + " sig=" + hex.EncodeToString(ed25519.Sign(priv, []byte(req)))
+}
+
+func FuzzParseHandshakeLine(f *testing.F) {
+	f.Add(v2Request(f))
+	f.Add("KWHS 2 sig=")
+	f.Add("KWHS 99 a=b sig=00")
+	f.Add("KWHS -1")
+
+	f.Fuzz(func(t *testing.T, line string) {
+		fields, signed, err := parseHandshakeLine(line)
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(line, signed) {
+			t.Fatalf("signed part %q isn't a prefix of %q", signed, line)
+		}
+		checkHandshakeFields(fields, signed)
+	})
+}
+
+// FuzzServerHandshake feeds arbitrary client input to the server, it must
+// never panic or hang.
+func FuzzServerHandshake(f *testing.F) {
+	HandshakeTimeout = 100 * time.Millisecond
+	_, srvPriv, _ := testKey(f)
+
+	f.Add([]byte(v1Request(f) + "\n"))
+	f.Add([]byte(v2Request(f) + "\n"))
+	f.Add([]byte(v2Request(f) + "\n" + strings.Repeat("0", 128) + "\n"))
+	f.Add([]byte("a b c d\n"))
+	f.Add([]byte(strings.Repeat("A", 2000)))
+	f.Add([]byte("\x00\xff\n"))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		srvConn, cliConn := net.Pipe()
+		defer srvConn.Close()
+		defer cliConn.Close()
+
+		go func() {
+			cliConn.Write(input)
+			io.Copy(io.Discard, cliConn)
+		}()
+
+		h, err := (&TorCon{}).ServerHandshake(srvConn, srvPriv, acceptAll)
+		if err == nil && h == nil {
+			t.Fatal("no handshake and no error")
+		}
+	})
+}
+
+// FuzzClientHandshake answers the client with arbitrary server input.
+func FuzzClientHandshake(f *testing.F) {
+	HandshakeTimeout = 100 * time.Millisecond
+	cliKey, _, _ := testKey(f)
+	_, srvPriv, srvId := testKey(f)
+
+	valid, _ := HandshakeOptions{}.fields(srvPriv)
+	f.Add([]byte(valid + " sig=" + strings.Repeat("00", Ed25519signatureSize) + "\nOK\n"))
+	f.Add([]byte("KWHS 2 torid=" + srvId + "\n"))
+	f.Add([]byte("a b c\n"))
+	f.Add([]byte("OK\n"))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		srvConn, cliConn := net.Pipe()
+		defer srvConn.Close()
+		defer cliConn.Close()
+
+		go func() {
+			readLine(srvConn)
+			srvConn.Write(input)
+			io.Copy(io.Discard, srvConn)
+		}()
+
+		h, err := (&TorCon{}).ClientHandshake(cliConn, cliKey, srvId, "")
+		if err == nil {
+			t.Fatalf("forged server handshake accepted %+v", h)
+		}
+	})
+}
+
+// oldServer shakes hands like a node from before version 2, hanging up on a
+// version 2 line.
+func oldServer(t *testing.T, ln net.Listener, srvPriv ed25519.PrivateKey, done chan *Handshake) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		request, err := readLine(conn)
+		if err != nil || strings.HasPrefix(request, handshakeMagic+" ") {
+			conn.Close()
+			continue
+		}
+		h, err := (&TorCon{}).serverHandshakeV1(conn, srvPriv, request, acceptAll)
+		if err != nil {
+			t.Error(err)
+		}
+		conn.Close()
+		done <- h
+		return
+	}
+}
+
+func TestHandshakeV1Fallback(t *testing.T) {
+	cliKey, _, cliId := testKey(t)
+	_, srvPriv, srvId := testKey(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan *Handshake, 1)
+	go oldServer(t, ln, srvPriv, done)
+
+	dials := 0
+	dial := func() (net.Conn, error) {
+		dials++
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	client := &TorCon{Options: HandshakeOptions{Features: []string{FeatureEncryption}, MaxArticleSize: 500}}
+	conn, cliH, err := client.DialHandshake(dial, cliKey, srvId, "hello there", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	srvH := <-done
+
+	if dials != 2 {
+		t.Errorf("dialed %d times", dials)
+	}
+	if cliH.Proto != 1 || len(cliH.Features) != 0 || cliH.TorId != srvId {
+		t.Errorf("client handshake %+v", cliH)
+	}
+	if srvH.TorId != cliId || srvH.Note != "hello there" {
+		t.Errorf("server handshake %+v", srvH)
+	}
+}
+
+// A node that spoke version 2 before isn't spoken to with version 1, it may
+// be someone on the path hanging up to force it.
+func TestHandshakeV1Refused(t *testing.T) {
+	cliKey, _, _ := testKey(t)
+	_, srvPriv, srvId := testKey(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go oldServer(t, ln, srvPriv, make(chan *Handshake, 1))
+
+	dials := 0
+	dial := func() (net.Conn, error) {
+		dials++
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	if _, _, err := (&TorCon{}).DialHandshake(dial, cliKey, srvId, "", false); !errors.Is(err, ErrHandshakeDowngrade) {
+		t.Errorf("downgraded, %v", err)
+	}
+	if dials != 1 {
+		t.Errorf("dialed %d times", dials)
+	}
+}
+
+func TestHandshakeV1WrongServer(t *testing.T) {
+	cliKey, _, _ := testKey(t)
+	_, srvPriv, _ := testKey(t)
+	_, _, otherId := testKey(t)
+
+	srvConn, cliConn := net.Pipe()
+	defer srvConn.Close()
+	defer cliConn.Close()
+
+	go (&TorCon{}).ServerHandshake(srvConn, srvPriv, acceptAll)
+
+	if _, err := (&TorCon{}).ClientHandshakeV1(cliConn, cliKey, otherId, ""); err == nil {
+		t.Fatal("handshake with the wrong node succeeded")
+	}
+}
@@ -0,0 +1,225 @@
+package torutils
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// Session encryption, used when both sides negotiated FeatureEncryption.
+//
+// Straight after the handshake each side sends an ephemeral X25519 key,
+// signed with its device key over the handshake transcript:
+//
+// C > KWSC {ephemeral pubkey hex} {hex sign("client" + ephemeral pubkey + transcript)}\n
+// S > KWSC {ephemeral pubkey hex} {hex sign("server" + ephemeral pubkey + transcript)}\n
+//
+// The shared secret goes through HKDF-SHA256, salted with the transcript, to
+// give a ChaCha20-Poly1305 key per direction. The ephemeral keys are thrown
+// away, so recorded traffic can't be read later even with the device keys.
+//
+// After that every frame is {4 byte big endian length}{ciphertext}, the
+// nonce is a per direction counter, which is never sent.
+//
+// Peers only connect over onion services for now, which Tor already
+// encrypts, so this adds forward secrecy that doesn't depend on Tor. There's
+// no plain TCP or LAN peer transport yet, the newsreader TCP listener isn't
+// one; when there is, it has to require this rather than negotiate it.
+
+const (
+	secureMagic    = "KWSC"
+	secureInfo     = "kothawoc session v1"
+	maxSecureFrame = 16 * 1024
+)
+
+var (
+	ErrSecureMalformed = errors.New("malformed session key exchange")
+	ErrSecureFrame     = errors.New("invalid session frame")
+)
+
+// SecureConn encrypts everything written to, and read from, a connection.
+type SecureConn struct {
+	net.Conn
+
+	readLock  sync.Mutex
+	readAEAD  cipher.AEAD
+	readSeq   uint64
+	readBuf   []byte
+	writeLock sync.Mutex
+	writeAEAD cipher.AEAD
+	writeSeq  uint64
+}
+
+// SecureClient runs the client side of the session key exchange on conn.
+func (t *TorCon) SecureClient(conn net.Conn, privateKey ed25519.PrivateKey, h *Handshake) (*SecureConn, error) {
+	return secure(conn, privateKey, h, true)
+}
+
+// SecureServer runs the server side of the session key exchange on conn.
+func (t *TorCon) SecureServer(conn net.Conn, privateKey ed25519.PrivateKey, h *Handshake) (*SecureConn, error) {
+	return secure(conn, privateKey, h, false)
+}
+
+func secureSigned(role string, ephemeral, transcript []byte) []byte {
+	return append(append([]byte(role), ephemeral...), transcript...)
+}
+
+func secure(conn net.Conn, privateKey ed25519.PrivateKey, h *Handshake, initiator bool) (*SecureConn, error) {
+	defer clearDeadlines(conn)
+
+	if len(h.Transcript) == 0 {
+		return nil, serr.New(ErrSecureMalformed)
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+
+	myRole, peerRole := "client", "server"
+	if !initiator {
+		myRole, peerRole = peerRole, myRole
+	}
+
+	myPub := ephemeral.PublicKey().Bytes()
+	myLine := secureMagic + " " + hex.EncodeToString(myPub) + " " +
+		hex.EncodeToString(ed25519.Sign(privateKey, secureSigned(myRole, myPub, h.Transcript)))
+
+	var peerLine string
+	if initiator {
+		if err := writeLine(conn, myLine); err != nil {
+			return nil, err
+		}
+		if peerLine, err = readLine(conn); err != nil {
+			return nil, err
+		}
+	} else {
+		if peerLine, err = readLine(conn); err != nil {
+			return nil, err
+		}
+		if err := writeLine(conn, myLine); err != nil {
+			return nil, err
+		}
+	}
+
+	split := strings.Split(peerLine, " ")
+	if len(split) != 3 || split[0] != secureMagic {
+		return nil, serr.New(ErrSecureMalformed)
+	}
+	peerPub, err := decodeHex(split[1], 32)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(h.PubKey, string(secureSigned(peerRole, peerPub, h.Transcript)), split[2]); err != nil {
+		return nil, err
+	}
+
+	peerKey, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, serr.New(ErrSecureMalformed)
+	}
+	shared, err := ephemeral.ECDH(peerKey)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, h.Transcript, []byte(secureInfo)), keys); err != nil {
+		return nil, serr.New(err)
+	}
+	clientKey, serverKey := keys[:chacha20poly1305.KeySize], keys[chacha20poly1305.KeySize:]
+	if !initiator {
+		clientKey, serverKey = serverKey, clientKey
+	}
+
+	writeAEAD, err := chacha20poly1305.New(clientKey)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	readAEAD, err := chacha20poly1305.New(serverKey)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+
+	return &SecureConn{
+		Conn:      conn,
+		readAEAD:  readAEAD,
+		writeAEAD: writeAEAD,
+	}, nil
+}
+
+func seqNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func (c *SecureConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxSecureFrame {
+			chunk = chunk[:maxSecureFrame]
+		}
+
+		frame := make([]byte, 4, 4+len(chunk)+c.writeAEAD.Overhead())
+		frame = c.writeAEAD.Seal(frame, seqNonce(c.writeSeq), chunk, nil)
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+		c.writeSeq++
+
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *SecureConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if len(c.readBuf) == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size < uint32(c.readAEAD.Overhead()) || size > uint32(maxSecureFrame+c.readAEAD.Overhead()) {
+			return 0, serr.New(ErrSecureFrame)
+		}
+
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			return 0, err
+		}
+		plain, err := c.readAEAD.Open(frame[:0], seqNonce(c.readSeq), frame, nil)
+		if err != nil {
+			return 0, serr.New(ErrSecureFrame)
+		}
+		c.readSeq++
+		c.readBuf = plain
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
@@ -0,0 +1,72 @@
+package torutils
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+func TestSecureConn(t *testing.T) {
+	cliKey, cliPriv, _ := testKey(t)
+	_, srvPriv, srvId := testKey(t)
+
+	options := HandshakeOptions{Features: []string{FeatureEncryption}}
+	server := &TorCon{Options: options}
+	client := &TorCon{Options: options}
+
+	srvConn, cliConn := net.Pipe()
+	defer srvConn.Close()
+	defer cliConn.Close()
+
+	srvDone := make(chan *SecureConn)
+	go func() {
+		h, err := server.ServerHandshake(srvConn, srvPriv, func(ed25519.PublicKey, string) bool { return true })
+		if err != nil {
+			t.Error(err)
+			close(srvDone)
+			return
+		}
+		sc, err := server.SecureServer(srvConn, srvPriv, h)
+		if err != nil {
+			t.Error(err)
+		}
+		srvDone <- sc
+	}()
+
+	h, err := client.ClientHandshake(cliConn, cliKey, srvId, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.HasFeature(FeatureEncryption) {
+		t.Fatal("encryption not negotiated")
+	}
+	cliSecure, err := client.SecureClient(cliConn, cliPriv, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvSecure := <-srvDone
+	if srvSecure == nil {
+		t.FailNow()
+	}
+
+	// bigger than a frame, so it's split.
+	msg := bytes.Repeat([]byte("ARTICLE <x@y>\r\n"), 2000)
+	go cliSecure.Write(msg)
+
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(srvSecure, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("plaintext mismatch")
+	}
+
+	go srvSecure.Write([]byte("200 ok\r\n"))
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(cliSecure, reply); err != nil || string(reply) != "200 ok\r\n" {
+		t.Fatalf("reply %q %v", reply, err)
+	}
+}
@@ -0,0 +1,40 @@
+package kothawoc
+
+import (
+	"io"
+
+	"github.com/kothawoc/kothawoc/internal/nntpbackend"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// UploadObject posts a large object's chunks to newsgroups as it reads it,
+// the manifest it returns goes in a post with PostFiles. Chunks we already
+// have aren't posted again.
+func (c *Client) UploadObject(newsgroups []string, name, mimeType string, r io.Reader) (messages.Manifest, error) {
+	return messages.SplitObject(name, mimeType, r, func(chunk []byte) error {
+		mail, messageId, err := messages.CreateChunk(c.deviceKey, newsgroups, chunk)
+		if err != nil {
+			return serr.New(err)
+		}
+		if _, err := c.be.DBs.GetArticleById(messageId); err == nil {
+			return nil
+		}
+		return serr.New(c.postRaw(mail))
+	})
+}
+
+// OpenObject reads a large object in an article, by its part number. Chunks
+// we don't have yet are fetched from peers as it's read.
+func (c *Client) OpenObject(messageId string, part int) (*nntpbackend.ObjectReader, *messages.Manifest, error) {
+	a, err := c.be.GetArticleWithNoGroup(c.localSession(), messageId)
+	if err != nil {
+		return nil, nil, serr.New(err)
+	}
+	for _, manifest := range messages.NewMessageToolFromArticle(a).Objects() {
+		if manifest.Part == part {
+			return c.be.OpenObject(manifest), &manifest, nil
+		}
+	}
+	return nil, nil, serr.Errorf("no object %d in %s", part, messageId)
+}
@@ -0,0 +1,499 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+/*
+# Attachments
+
+Files are sent as base64 parts of a multipart/mixed article, after the text:
+
+	Content-Type: image/png; name="cat.png"
+	Content-Disposition: attachment; filename="cat.png"
+	Content-Transfer-Encoding: base64
+
+Images we can decode get a small JPEG thumbnail part straight after them, so
+readers don't need the whole file to show it:
+
+	Content-Type: image/jpeg; name="cat.png.jpg"
+	Content-Disposition: inline; filename="cat.png.jpg"
+	Content-Transfer-Encoding: base64
+	X-Kothawoc-Thumbnail: cat.png
+
+# Content policies
+
+A group can limit what's posted in it, in the newgroup vcard, so every node
+carrying the group enforces the same. It applies to every part but the text,
+attached or inline, and to the article's own Content-Type. TYPES is a comma
+separated list of media types, "image/*" matches any image, MAXSIZE is the
+most bytes one part may have, 0 for no limit:
+
+	X-KW-CONTENT;TYPES=image/png,image/jpeg;MAXSIZE=<bytes>:true
+*/
+
+const (
+	ContentPolicyField string = "X-KW-CONTENT"
+	ThumbnailHeader    string = "X-Kothawoc-Thumbnail"
+)
+
+// ThumbnailSize is the longest side of a thumbnail, in pixels.
+const ThumbnailSize = 320
+
+// maxThumbnailPixels stops huge images being decoded for a thumbnail.
+const maxThumbnailPixels = 50 * 1000 * 1000
+
+var ErrContentNotAllowed error = errors.New("content not allowed in group")
+
+// Encode returns the content as it's sent, in the part's
+// Content-Transfer-Encoding. Anything but base64 is text, its line endings
+// are made CRLF.
+func (p *MimePart) Encode() []byte {
+	var buf bytes.Buffer
+	p.encodeTo(&buf)
+	return buf.Bytes()
+}
+
+// encodeTo writes the content as it's sent, without encoding it all first.
+func (p *MimePart) encodeTo(w io.Writer) error {
+	switch strings.ToLower(p.Header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		enc := base64.NewEncoder(base64.StdEncoding, &lineWriter{w: w})
+		if _, err := io.Copy(enc, p.Open()); err != nil {
+			return serr.New(err)
+		}
+		return serr.New(enc.Close())
+	case "quoted-printable":
+		qp := quotedprintable.NewWriter(w)
+		if _, err := io.Copy(&crlfWriter{w: qp}, p.Open()); err != nil {
+			return serr.New(err)
+		}
+		return serr.New(qp.Close())
+	}
+	_, err := io.Copy(&crlfWriter{w: w}, p.Open())
+	return serr.New(err)
+}
+
+// Decode sets the content from how it was sent.
+func (p *MimePart) Decode(raw []byte) error {
+	return p.decodeFrom(bytes.NewReader(raw))
+}
+
+// spillSize is the most content of a part held in RAM when it's read.
+const spillSize = 256 << 10
+
+// SpillDir is where the content of big parts is kept while they're in use,
+// the system's temporary directory if empty.
+var SpillDir string
+
+// spillFile is a part's content in a temporary file, removed as soon as it's
+// made so nothing is left behind, the space is freed once it's closed.
+type spillFile struct {
+	f    *os.File
+	size int64
+}
+
+// decodeFrom reads and decodes the content, so only the decoded content is
+// held, in a temporary file if it's over spillSize.
+func (p *MimePart) decodeFrom(r io.Reader) error {
+	switch strings.ToLower(p.Header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, spillSize+1); err == io.EOF {
+		p.Content = buf.Bytes()
+		p.spill = nil
+		return nil
+	} else if err != nil {
+		return serr.New(err)
+	}
+
+	f, err := os.CreateTemp(SpillDir, "kothawoc-part-*")
+	if err != nil {
+		return serr.New(err)
+	}
+	os.Remove(f.Name())
+	size, err := io.Copy(f, io.MultiReader(&buf, r))
+	if err != nil {
+		f.Close()
+		return serr.New(err)
+	}
+	p.Content = nil
+	p.spill = &spillFile{f: f, size: size}
+	runtime.SetFinalizer(p.spill, func(s *spillFile) { s.f.Close() })
+	return nil
+}
+
+// Size is the size of the decoded content.
+func (p *MimePart) Size() int64 {
+	if p.spill != nil {
+		return p.spill.size
+	}
+	return int64(len(p.Content))
+}
+
+// Open reads the decoded content, wherever it's kept.
+func (p *MimePart) Open() io.Reader {
+	if p.spill != nil {
+		return io.NewSectionReader(p.spill.f, 0, p.spill.size)
+	}
+	return bytes.NewReader(p.Content)
+}
+
+// Bytes returns the decoded content, reading it in if it's in a file.
+func (p *MimePart) Bytes() ([]byte, error) {
+	if p.spill == nil {
+		return p.Content, nil
+	}
+	content, err := io.ReadAll(p.Open())
+	return content, serr.New(err)
+}
+
+// lineWriter breaks base64 into lines of 76, with no line break at the end.
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+
+func (l *lineWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if l.col == 76 {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return n, err
+			}
+			l.col = 0
+		}
+		chunk := b[:min(len(b), 76-l.col)]
+		written, err := l.w.Write(chunk)
+		n += written
+		l.col += written
+		if err != nil {
+			return n, err
+		}
+		b = b[written:]
+	}
+	return n, nil
+}
+
+// crlfWriter makes every line ending CRLF, dropping any CR already there.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c *crlfWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexAny(b, "\r\n")
+		if i < 0 {
+			_, err := c.w.Write(b)
+			return n, err
+		}
+		if _, err := c.w.Write(b[:i]); err != nil {
+			return n, err
+		}
+		if b[i] == '\n' {
+			if _, err := io.WriteString(c.w, "\r\n"); err != nil {
+				return n, err
+			}
+		}
+		b = b[i+1:]
+	}
+	return n, nil
+}
+
+// Attachment is a file in an article, Part is its index in Parts, Thumbnail
+// the index of its thumbnail, or -1.
+type Attachment struct {
+	Part      int    `json:"part"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Size      int64  `json:"size"`
+	Thumbnail int    `json:"thumbnail"`
+}
+
+// attachmentName is the file name of an attached part, "" for the text.
+func attachmentName(p MimePart) string {
+	disposition, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil || disposition != "attachment" {
+		return ""
+	}
+	if params["filename"] == "" {
+		return "attachment"
+	}
+	return params["filename"]
+}
+
+// Attachments lists the files in a parsed article.
+func (m *MessageTool) Attachments() []Attachment {
+	ret := []Attachment{}
+	thumbnails := map[string]int{}
+	for i, p := range m.Parts {
+		if of := p.Header.Get(ThumbnailHeader); of != "" {
+			thumbnails[of] = i
+		}
+	}
+	for i, p := range m.Parts {
+		name := attachmentName(p)
+		if name == "" {
+			continue
+		}
+		mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		thumbnail, ok := thumbnails[name]
+		if !ok {
+			thumbnail = -1
+		}
+		ret = append(ret, Attachment{Part: i, Name: name, Type: mediaType, Size: p.Size(), Thumbnail: thumbnail})
+	}
+	return ret
+}
+
+// makeMultipart moves a plain article's text into a part of its own, so
+// files can go after it.
+func (m *MessageTool) makeMultipart() {
+	mediaType, _, err := mime.ParseMediaType(m.Article.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		return
+	}
+	textType := m.Article.Header.Get("Content-Type")
+	if textType == "" {
+		textType = "text/plain;charset=UTF-8"
+	}
+	m.Parts = append([]MimePart{{
+		Header: textproto.MIMEHeader{
+			"Content-Type":              {textType},
+			"Content-Transfer-Encoding": {"8bit"},
+		},
+		Content: []byte(m.Preamble),
+	}}, m.Parts...)
+	m.Preamble = "This is a MIME message."
+	m.Article.Header.Set("Mime-Version", "1.0")
+	m.Article.Header.Set("Content-Type", "multipart/mixed; boundary=\"nxtprt\"")
+	m.Article.Header.Set("Content-Transfer-Encoding", "8bit")
+}
+
+// AddAttachment attaches a file, base64 encoded, with a thumbnail if it's an
+// image we can decode.
+func (m *MessageTool) AddAttachment(name, mimeType string, r io.Reader) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return serr.New(err)
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	m.makeMultipart()
+	m.Parts = append(m.Parts, MimePart{
+		Header: textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(mimeType, map[string]string{"name": name})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+			"Content-Transfer-Encoding": {"base64"},
+		},
+		Content: content,
+	})
+
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil
+	}
+	thumbnail, err := Thumbnail(content)
+	if err != nil {
+		// not every image type can be decoded, it's still attached.
+		return nil
+	}
+	m.Parts = append(m.Parts, MimePart{
+		Header: textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType("image/jpeg", map[string]string{"name": name + ".jpg"})},
+			"Content-Disposition":       {mime.FormatMediaType("inline", map[string]string{"filename": name + ".jpg"})},
+			"Content-Transfer-Encoding": {"base64"},
+			ThumbnailHeader:             {name},
+		},
+		Content: thumbnail,
+	})
+	return nil
+}
+
+// Thumbnail scales an image down to fit in ThumbnailSize, as a JPEG.
+func Thumbnail(content []byte) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return nil, serr.Errorf("image too large for a thumbnail %dx%d", config.Width, config.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, serr.New(err)
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return nil, serr.Errorf("empty image")
+	}
+	dw, dh := w, h
+	if w > ThumbnailSize || h > ThumbnailSize {
+		if w > h {
+			dw, dh = ThumbnailSize, max(1, h*ThumbnailSize/w)
+		} else {
+			dw, dh = max(1, w*ThumbnailSize/h), ThumbnailSize
+		}
+	}
+
+	// average the block of source pixels under each thumbnail pixel.
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+max((x+1)*w/dw, x*w/dw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, serr.New(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ContentPolicy limits the attachments posted to a group, no Types allows
+// any, a zero MaxSize any size.
+type ContentPolicy struct {
+	Types   []string `json:"types,omitempty"`
+	MaxSize int64    `json:"maxsize,omitempty"`
+}
+
+// SetContentPolicy sets the content policy of a group's card.
+func SetContentPolicy(card vcard.Card, policy ContentPolicy) {
+	card.Set(ContentPolicyField, &vcard.Field{
+		Value: "true",
+		Params: vcard.Params{
+			"TYPES":   {strings.Join(policy.Types, ",")},
+			"MAXSIZE": {strconv.FormatInt(policy.MaxSize, 10)},
+		},
+	})
+}
+
+// GetContentPolicy returns the content policy of a group's card.
+func GetContentPolicy(card vcard.Card) (ContentPolicy, bool) {
+	f := card.Get(ContentPolicyField)
+	if f == nil || f.Value != "true" {
+		return ContentPolicy{}, false
+	}
+	policy := ContentPolicy{}
+	for _, t := range strings.Split(f.Params.Get("TYPES"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			policy.Types = append(policy.Types, strings.ToLower(t))
+		}
+	}
+	policy.MaxSize, _ = strconv.ParseInt(f.Params.Get("MAXSIZE"), 10, 64)
+	return policy, true
+}
+
+// Allows tells if a media type is allowed, "image/*" allows every image.
+func (p ContentPolicy) Allows(mediaType string) bool {
+	if len(p.Types) == 0 {
+		return true
+	}
+	mediaType = strings.ToLower(mediaType)
+	for _, t := range p.Types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check checks an article against the policy, its Content-Type and every
+// part but its text, whether attached or inline, and every large object.
+// Thumbnails only count towards the size. The parts of group and peer
+// control messages, and chunks, which are checked as part of their object,
+// aren't content.
+func (p ContentPolicy) Check(m *MessageTool) error {
+	mediaType, _, err := mime.ParseMediaType(m.Article.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if mediaType != "text/plain" && !strings.HasPrefix(mediaType, "multipart/") && !p.Allows(mediaType) {
+		return serr.Errorf("%w: article is %s", ErrContentNotAllowed, mediaType)
+	}
+	if len(m.Parts) == 0 && p.MaxSize > 0 && mediaType != "text/plain" && int64(len(m.Preamble)) > p.MaxSize {
+		return serr.Errorf("%w: article is over %d bytes", ErrContentNotAllowed, p.MaxSize)
+	}
+	control := m.Article.Header.Get("Control")
+	if _, chunk := ParseChunkControl(control); chunk || SystemControl(control) {
+		return nil
+	}
+
+	for _, part := range m.Parts {
+		partType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			partType = "text/plain"
+		}
+		name := attachmentName(part)
+		if name == "" {
+			name = params["name"]
+		}
+		if name == "" {
+			name = "inline part"
+		}
+		switch {
+		case partType == ObjectContentType:
+			continue
+		case part.Header.Get(ThumbnailHeader) != "":
+			if p.MaxSize > 0 && part.Size() > p.MaxSize {
+				return serr.Errorf("%w: thumbnail is over %d bytes", ErrContentNotAllowed, p.MaxSize)
+			}
+			continue
+		case partType == "text/plain" && attachmentName(part) == "":
+			continue
+		}
+		if !p.Allows(partType) {
+			return serr.Errorf("%w: %s is %s", ErrContentNotAllowed, name, partType)
+		}
+		if p.MaxSize > 0 && part.Size() > p.MaxSize {
+			return serr.Errorf("%w: %s is over %d bytes", ErrContentNotAllowed, name, p.MaxSize)
+		}
+	}
+	for _, o := range m.Objects() {
+		if !p.Allows(o.Type) {
+			return serr.Errorf("%w: %s is %s", ErrContentNotAllowed, o.Name, o.Type)
+		}
+		if p.MaxSize > 0 && o.Size > p.MaxSize {
+			return serr.Errorf("%w: %s is over %d bytes", ErrContentNotAllowed, o.Name, p.MaxSize)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package messages
+
+import (
+	"net/textproto"
+	"time"
+
+	"github.com/kothawoc/go-nntp"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+/*
+# Block advisories
+
+A node can publish who it blocks in its <torid>.blocklist group, so friends
+that trust its judgement can follow the list. They're only advisory, the
+receiving node decides if it follows the blocklist of the sender.
+
+	Control: block <torid>
+	Control: unblock <torid>
+
+With a "application/x-kothawoc-block" part holding:
+
+	Torid: <torid>
+	Reason: <free text>
+*/
+
+const BlockContentType string = "application/x-kothawoc-block;charset=UTF-8"
+
+// BlocklistGroup is the group torId publishes its block advisories in.
+func BlocklistGroup(torId string) string {
+	return torId + ".blocklist"
+}
+
+func createBlockMail(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, command, torId, reason string) (string, error) {
+	ownerID, err := myKey.TorId()
+	if err != nil {
+		return "", serr.New(err)
+	}
+
+	checkKey := keytool.EasyEdKey{}
+	if err := checkKey.SetTorId(torId); err != nil {
+		return "", serr.New(err)
+	}
+
+	parts := []MimePart{
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{BlockContentType}},
+			Content: []byte("Torid: " + torId + "\r\nReason: " + fieldValue(reason)),
+		},
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{"text/plain;charset=UTF-8"}},
+			Content: []byte("This is a system control message to " + command + " " + torId + " from " + ownerID + ".\r\n"),
+		},
+	}
+
+	return (&MessageTool{
+		Article: &nntp.Article{
+			Header: textproto.MIMEHeader{
+				"Subject":                   {"cmsg " + command + " " + torId},
+				"Control":                   {command + " " + torId},
+				"Message-Id":                {idgen.GenID()},
+				"Date":                      {time.Now().UTC().Format(time.RFC1123Z)},
+				"Newsgroups":                {BlocklistGroup(ownerID)},
+				"Content-Type":              {"multipart/mixed; boundary=\"nxtprt\""},
+				"Content-Transfer-Encoding": {"8bit"},
+			},
+		},
+		Preamble: "This is a MIME control message.",
+		Parts:    parts,
+	}).Sign(myKey)
+}
+
+// CreateBlockAdvisory announces to our followers that we block torId.
+func CreateBlockAdvisory(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, torId, reason string) (string, error) {
+	return createBlockMail(myKey, idgen, "block", torId, reason)
+}
+
+// CreateUnblockAdvisory withdraws a block advisory of torId.
+func CreateUnblockAdvisory(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, torId string) (string, error) {
+	return createBlockMail(myKey, idgen, "unblock", torId, "")
+}
@@ -54,11 +54,42 @@ Allbery & Lindsey           Standards Track                    [Page 37] - [Page
 */
 
 type ControMesasgeFunctions struct {
-	NewGroup   func(name, description string, card vcard.Card) error
-	AddPeer    func(name string) error
-	RemovePeer func(name string) error
-	Cancel     func(from, messageid, newsgroups string, cmf ControMesasgeFunctions) error
-	Sendme     func(name, list, options string) error
+	NewGroup     func(name, description string, card vcard.Card) error
+	AddPeer      func(name string) error
+	RemovePeer   func(name string) error
+	Cancel       func(from, messageid, newsgroups string, cmf ControMesasgeFunctions) error
+	Sendme       func(name, list, options string) error
+	InviteAccept func(from, newsgroups, secret string) error
+	Introduce    func(introducer, newsgroups, torId, name string, chain []string) error
+	IntroAccept  func(from, newsgroups, torId, name string) error
+	IntroConfirm func(from, newsgroups, torId, name string) error
+	Block        func(from, torId, reason string) error
+	Unblock      func(from, torId string) error
+	Newsrc       func(from, sealed string) error
+	RmGroup      func(name string) error
+	React        func(from, messageId, reaction string) error
+}
+
+// partText is a control message part's content, they're small so it's
+// always read in.
+func partText(p MimePart) string {
+	content, err := p.Bytes()
+	if err != nil {
+		slog.Info("Failed to read control message part", "error", err)
+	}
+	return string(content)
+}
+
+// SystemControl tells if a Control header is one of the group and peer
+// control messages the node acts on, rather than a react or chunk, which
+// carry content like any article.
+func SystemControl(control string) bool {
+	switch strings.Split(control, " ")[0] {
+	case "cancel", "newgroup", "rmgroup", "checkgroups", "sendme", "inviteaccept",
+		"block", "unblock", "newsrc", "introduce", "introaccept", "introconfirm":
+		return true
+	}
+	return false
 }
 
 // func CheckControl(msg *messages.MessageTool, newGroup func(name, description, flags string) error) bool {
@@ -101,12 +132,18 @@ func CheckControl(msg *MessageTool, cmf ControMesasgeFunctions, session map[stri
 				for _, h := range msg.Parts {
 					switch h.Header.Get("Content-Type") {
 					case "application/news-groupinfo;charset=UTF-8":
-						// TODO FIXME: this is going to explode when handed a dodgy message
-						data := strings.Split(strings.Split(string(h.Content), "\n")[1], " ")
+						lines := strings.Split(partText(h), "\n")
+						if len(lines) < 2 {
+							continue
+						}
+						data := strings.Split(lines[1], " ")
+						if len(data) < 2+flaglen {
+							continue
+						}
 						subslice := data[2 : len(data)-flaglen]
 						description = strings.Join(subslice, " ")
 					case "text/x-vcard;charset=UTF-8":
-						dec := vcard.NewDecoder(bytes.NewReader(h.Content))
+						dec := vcard.NewDecoder(h.Open())
 						card, _ = dec.Decode()
 						slog.Info("card: [%#v]", "card", card)
 					}
@@ -132,8 +169,26 @@ func CheckControl(msg *MessageTool, cmf ControMesasgeFunctions, session map[stri
 			}
 
 		case "rmgroup": // RFC 5537 - 5.2.2. The rmgroup Control Message
+			// like newgroup, only the owner can remove a group.
+			if len(splitCtl) != 2 || msg.Article.Header.Get("From") != strings.Split(splitCtl[1], ".")[0] {
+				return serr.Errorf("invalid rmgroup control message from %s for %s", msg.Article.Header.Get("From"), ctrl)
+			}
+			return serr.New(cmf.RmGroup(splitCtl[1]))
 
 			// custom messages
+		case "react":
+			// one reaction each, so it counts by who signed it, not From.
+			messageId, reaction, ok := ParseReaction(ctrl)
+			if !ok || len(strings.Split(msg.Article.Header.Get("Newsgroups"), ",")) != 1 || msg.Sender() == "" {
+				return serr.Errorf("invalid react control message %s", ctrl)
+			}
+			return serr.New(cmf.React(msg.Sender(), messageId, reaction))
+
+		case "chunk":
+			if _, err := ChunkContent(msg); err != nil {
+				return err
+			}
+
 		case "checkgroups": // rfc5337 5.2.3.
 			// we can probably just ignore this message as the user interfaace decideds if to add groups
 
@@ -157,14 +212,91 @@ func CheckControl(msg *MessageTool, cmf ControMesasgeFunctions, session map[stri
 			for _, h := range msg.Parts {
 				switch h.Header.Get("Content-Type") {
 				case "application/news-groupinfo;charset=UTF-8":
-					grouplist = string(h.Content)
+					grouplist = partText(h)
 				case "application/newsfeed;charset=UTF-8":
-					opts = string(h.Content)
+					opts = partText(h)
 				}
 
 			}
 			return serr.New(cmf.Sendme(msg.Article.Header.Get("From"), grouplist, opts))
 
+		case "inviteaccept":
+			from := msg.Article.Header.Get("From")
+			newsgroups := msg.Article.Header.Get("Newsgroups")
+			splitGroup := strings.Split(newsgroups, ".")
+			if len(splitCtl) != 2 || len(splitGroup) != 3 ||
+				splitGroup[0] != from || splitGroup[1] != "peers" {
+				return serr.Errorf("invalid inviteaccept control message from %s to %s", from, newsgroups)
+			}
+			return serr.New(cmf.InviteAccept(from, newsgroups, splitCtl[1]))
+
+		case "block", "unblock":
+			from := msg.Article.Header.Get("From")
+			if len(splitCtl) != 2 || msg.Article.Header.Get("Newsgroups") != BlocklistGroup(from) {
+				return serr.Errorf("invalid %s control message from %s to %s", splitCtl[0], from, msg.Article.Header.Get("Newsgroups"))
+			}
+
+			fields := map[string]string{}
+			for _, h := range msg.Parts {
+				if h.Header.Get("Content-Type") == BlockContentType {
+					fields = parseFields(partText(h))
+				}
+			}
+			if fields["Torid"] != splitCtl[1] {
+				return serr.Errorf("block torid mismatch control[%s] body[%s]", splitCtl[1], fields["Torid"])
+			}
+
+			if splitCtl[0] == "block" {
+				return serr.New(cmf.Block(from, splitCtl[1], fields["Reason"]))
+			}
+			return serr.New(cmf.Unblock(from, splitCtl[1]))
+
+		case "newsrc":
+			from := msg.Article.Header.Get("From")
+			if msg.Article.Header.Get("Newsgroups") != NewsrcGroup(from) {
+				return serr.Errorf("invalid newsrc control message from %s to %s", from, msg.Article.Header.Get("Newsgroups"))
+			}
+			for _, h := range msg.Parts {
+				if h.Header.Get("Content-Type") == NewsrcContentType {
+					return serr.New(cmf.Newsrc(from, partText(h)))
+				}
+			}
+			return serr.Errorf("newsrc control message from %s without a newsrc", from)
+
+		case "introduce", "introaccept", "introconfirm":
+			// introductions only travel over the peering group between the
+			// two nodes, <from>.peers.<to>
+			from := msg.Article.Header.Get("From")
+			newsgroups := msg.Article.Header.Get("Newsgroups")
+			splitGroup := strings.Split(newsgroups, ".")
+			if len(splitCtl) != 2 || len(splitGroup) != 3 ||
+				splitGroup[0] != from || splitGroup[1] != "peers" {
+				return serr.Errorf("invalid %s control message from %s to %s", splitCtl[0], from, newsgroups)
+			}
+
+			fields := map[string]string{}
+			for _, h := range msg.Parts {
+				if h.Header.Get("Content-Type") == IntroductionContentType {
+					fields = parseFields(partText(h))
+				}
+			}
+			if fields["Torid"] != splitCtl[1] {
+				return serr.Errorf("introduction torid mismatch control[%s] body[%s]", splitCtl[1], fields["Torid"])
+			}
+
+			switch splitCtl[0] {
+			case "introduce":
+				chain := []string{}
+				if fields["Chain"] != "" {
+					chain = strings.Split(fields["Chain"], ",")
+				}
+				return serr.New(cmf.Introduce(from, newsgroups, splitCtl[1], fields["Name"], chain))
+			case "introaccept":
+				return serr.New(cmf.IntroAccept(from, newsgroups, splitCtl[1], fields["Name"]))
+			case "introconfirm":
+				return serr.New(cmf.IntroConfirm(from, newsgroups, splitCtl[1], fields["Name"]))
+			}
+
 		default:
 			slog.Info("ERROR CONTROL MESSAGE", "msg", msg)
 		}
@@ -252,7 +384,85 @@ func CreateNewsGroupMail(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator,
 	}).Sign(myKey)
 }
 
+// CreateRmGroupMail removes one of our groups from every node carrying it.
+func CreateRmGroupMail(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, name string) (string, error) {
+	ownerID, err := myKey.TorId()
+	if err != nil {
+		return "", serr.New(err)
+	}
+	if strings.Split(name, ".")[0] != ownerID {
+		return "", serr.Errorf("can't remove %s, it's not our group", name)
+	}
+
+	parts := []MimePart{
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{"text/plain;charset=UTF-8"}},
+			Content: []byte("This is a system control message to remove the news group " + name + ".\r\n"),
+		},
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{"text/plain;charset=UTF-8"}},
+			Content: []byte("Removed by its owner.\r\n"),
+		},
+	}
+
+	return (&MessageTool{
+		Article: &nntp.Article{
+			Header: textproto.MIMEHeader{
+				"Subject":                   {"cmsg rmgroup " + name},
+				"Control":                   {"rmgroup " + name},
+				"Message-Id":                {idgen.GenID()},
+				"Date":                      {time.Now().UTC().Format(time.RFC1123Z)},
+				"Newsgroups":                {name},
+				"Content-Type":              {"multipart/mixed; boundary=\"nxtprt\""},
+				"Content-Transfer-Encoding": {"8bit"},
+			},
+		},
+		Preamble: "This is a MIME control message.",
+		Parts:    parts,
+	}).Sign(myKey)
+}
+
+// CreateCancelMail cancels one of our articles in newsgroups.
+func CreateCancelMail(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, messageId string, newsgroups []string) (string, error) {
+	parts := []MimePart{
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{"text/plain;charset=UTF-8"}},
+			Content: []byte("This is a system control message to cancel " + messageId + ".\r\n"),
+		},
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{"text/plain;charset=UTF-8"}},
+			Content: []byte("Cancelled by its author.\r\n"),
+		},
+	}
+
+	return (&MessageTool{
+		Article: &nntp.Article{
+			Header: textproto.MIMEHeader{
+				"Subject":                   {"cmsg cancel " + messageId},
+				"Control":                   {"cancel " + messageId},
+				"Message-Id":                {idgen.GenID()},
+				"Date":                      {time.Now().UTC().Format(time.RFC1123Z)},
+				"Newsgroups":                {strings.Join(newsgroups, ",")},
+				"Content-Type":              {"multipart/mixed; boundary=\"nxtprt\""},
+				"Content-Transfer-Encoding": {"8bit"},
+			},
+		},
+		Preamble: "This is a MIME control message.",
+		Parts:    parts,
+	}).Sign(myKey)
+}
+
 func CreatePeerGroup(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, lang, myname, peerId string) (string, error) {
+	return CreatePeerGroupWithParams(myKey, idgen, lang, myname, peerId, vcard.Params{
+		"read":  {"true"},
+		"reply": {"true"},
+		"post":  {"true"},
+	})
+}
+
+// CreatePeerGroupWithParams creates a peering group granting the peer the
+// permissions in params, as read, reply, post, cancel and supersede flags.
+func CreatePeerGroupWithParams(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, lang, myname, peerId string, params vcard.Params) (string, error) {
 	card := vcard.Card{}
 	card.SetValue(vcard.FieldNickname, myname)
 	card.SetValue(vcard.FieldLanguage, lang)
@@ -263,12 +473,8 @@ func CreatePeerGroup(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, lang
 	})
 
 	card.Add("X-KW-PERMS", &vcard.Field{
-		Value: peerId,
-		Params: vcard.Params{
-			"read":  {"true"},
-			"reply": {"true"},
-			"post":  {"true"},
-		},
+		Value:  peerId,
+		Params: params,
 	})
 
 	vcard.ToV4(card)
@@ -384,3 +590,103 @@ func CreateSendme(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, peerId
 		Parts:    parts,
 	}).Sign(myKey)
 }
+
+/*
+# Introductions
+
+A node recommends one of its peers to another by posting an "introduce"
+control message into the peering group it shares with the recipient. The
+article is signed by the introducer, and carries the recommended torid, a
+name and the chain of nodes that introduced the torid to the introducer.
+
+	Control: introduce <torid>
+
+	Torid: <torid>
+	Name: <name>
+	Chain: <torid>,<torid>
+
+When the recipient accepts, it peers with the torid and posts "introaccept"
+back to the introducer, with its own name. The introducer relays it as an
+"introconfirm" to the recommended node, which creates its side of the
+peering group, since it's from a peer it already trusts.
+*/
+
+const IntroductionContentType string = "application/x-kothawoc-introduction;charset=UTF-8"
+
+// parseFields reads "Key: value" lines as used in the control message parts.
+func parseFields(content string) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		kv := strings.SplitN(strings.TrimRight(line, "\r"), ": ", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	return fields
+}
+
+// fieldValue strips anything that would break the line based field format.
+func fieldValue(val string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(val)
+}
+
+func createIntroMail(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, command, peerId, torId, name string, chain []string) (string, error) {
+
+	ownerID, err := myKey.TorId()
+	if err != nil {
+		return "", serr.New(err)
+	}
+
+	checkKey := keytool.EasyEdKey{}
+	if err := checkKey.SetTorId(torId); err != nil {
+		return "", serr.New(err)
+	}
+
+	content := "Torid: " + torId + "\r\nName: " + fieldValue(name)
+	if len(chain) > 0 {
+		content += "\r\nChain: " + strings.Join(chain, ",")
+	}
+
+	parts := []MimePart{
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{IntroductionContentType}},
+			Content: []byte(content),
+		},
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{"text/plain;charset=UTF-8"}},
+			Content: []byte("This is a system control message to " + command + " " + torId + " from " + ownerID + ".\r\n"),
+		},
+	}
+
+	return (&MessageTool{
+		Article: &nntp.Article{
+			Header: textproto.MIMEHeader{
+				"Subject":                   {"cmsg " + command + " " + torId},
+				"Control":                   {command + " " + torId},
+				"Message-Id":                {idgen.GenID()},
+				"Date":                      {time.Now().UTC().Format(time.RFC1123Z)},
+				"Newsgroups":                {ownerID + ".peers." + peerId},
+				"Content-Type":              {"multipart/mixed; boundary=\"nxtprt\""},
+				"Content-Transfer-Encoding": {"8bit"},
+			},
+		},
+		Preamble: "This is a MIME control message.",
+		Parts:    parts,
+	}).Sign(myKey)
+}
+
+// CreateIntroduction recommends torId to the peer peerId.
+func CreateIntroduction(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, peerId, torId, name string, chain []string) (string, error) {
+	return createIntroMail(myKey, idgen, "introduce", peerId, torId, name, chain)
+}
+
+// CreateIntroAccept tells the introducer that we have peered with torId, name
+// is what torId should call us.
+func CreateIntroAccept(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, introducerId, torId, name string) (string, error) {
+	return createIntroMail(myKey, idgen, "introaccept", introducerId, torId, name, nil)
+}
+
+// CreateIntroConfirm relays an accepted introduction of torId to peerId.
+func CreateIntroConfirm(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, peerId, torId, name string) (string, error) {
+	return createIntroMail(myKey, idgen, "introconfirm", peerId, torId, name, nil)
+}
@@ -0,0 +1,224 @@
+package messages
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/emersion/go-vcard"
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+/*
+# Countersignatures
+
+Moderators, relays and anyone vouching for an article add their own
+signature over the author's, in a header each:
+
+	X-Kothawoc-Countersignature: v2; alg=ed25519; role=moderator; k=<hex key>; b=<base32>
+
+b signs the canonical signed headers of the author's signature, then its
+signature header whole, then this header with b empty, the same way as the
+author's, see docs/signing.md. The author's signature covers the body, so
+the countersignature does too, and adding one leaves the author's valid.
+Only v2 signed articles can be countersigned.
+
+# Moderated groups
+
+A group's card can require every article in it to be approved, signed or
+countersigned as moderator by the group's owner or one of the listed
+moderators:
+
+	X-KW-MODERATED;MODERATORS=<torid>,<torid>:true
+*/
+
+const (
+	CountersignatureHeader string = "X-Kothawoc-Countersignature"
+	ModeratedField         string = "X-KW-MODERATED"
+)
+
+// Roles of signers.
+const (
+	RoleAuthor    string = "author"
+	RoleModerator string = "moderator"
+	RoleRelay     string = "relay"
+	RoleVouch     string = "vouch"
+)
+
+var validRole = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// Signer is a key with a valid signature on an article.
+type Signer struct {
+	Key   string `json:"key"`
+	TorId string `json:"torid"`
+	Role  string `json:"role"`
+}
+
+// countersignedData is what a countersignature signs.
+func (m *MessageTool) countersignedData(unsigned string) ([]byte, error) {
+	value := m.Article.Header.Get(SignatureHeader)
+	sig, err := parseSignature(value)
+	if err != nil {
+		return nil, err
+	}
+	data := m.signedData(sig.headers, value)
+	data = append(data, "\r\n"+strings.ToLower(CountersignatureHeader)+":"+canonicalValue(unsigned)...)
+	return data, nil
+}
+
+// Countersign adds key's signature, in role, over the author's.
+func (m *MessageTool) Countersign(myKey keytool.EasyEdKey, role string) (string, error) {
+	if !validRole.MatchString(role) {
+		return "", serr.Errorf("invalid role %q", role)
+	}
+	if !strings.HasPrefix(m.Article.Header.Get(SignatureHeader), SignatureVersion+";") {
+		return "", serr.Errorf("only %s signed articles can be countersigned", SignatureVersion)
+	}
+	pubKey, err := myKey.TorPubKey()
+	if err != nil {
+		return "", serr.New(err)
+	}
+
+	unsigned := fmt.Sprintf("%s; alg=%s; role=%s; k=%s; b=", SignatureVersion, SignatureAlgorithm, role, hex.EncodeToString(pubKey))
+	data, err := m.countersignedData(unsigned)
+	if err != nil {
+		return "", err
+	}
+	msg, err := myKey.TorSign(data)
+	if err != nil {
+		return "", serr.New(err)
+	}
+	m.Article.Header.Add(CountersignatureHeader, unsigned+base32.StdEncoding.EncodeToString(msg))
+	return m.writeRaw(false), nil
+}
+
+// verifyCountersignature returns the signer of a valid countersignature.
+func (m *MessageTool) verifyCountersignature(value string) (Signer, error) {
+	signer := Signer{}
+	tags := strings.Split(value, ";")
+	if strings.TrimSpace(tags[0]) != SignatureVersion {
+		return signer, serr.Errorf("unknown countersignature version %q", tags[0])
+	}
+	var alg, b, unsigned string
+	for i, tag := range tags[1:] {
+		name, val, ok := strings.Cut(strings.TrimSpace(tag), "=")
+		if !ok {
+			return signer, serr.Errorf("invalid countersignature tag %q", tag)
+		}
+		switch name {
+		case "alg":
+			alg = val
+		case "role":
+			signer.Role = val
+		case "k":
+			signer.Key = val
+		case "b":
+			if i != len(tags)-2 {
+				return signer, serr.Errorf("countersignature b isn't the last tag")
+			}
+			b = val
+			unsigned = strings.TrimSuffix(strings.TrimSpace(value), val)
+		}
+	}
+	if alg != SignatureAlgorithm || !validRole.MatchString(signer.Role) || b == "" {
+		return signer, serr.Errorf("incomplete countersignature %q", value)
+	}
+
+	pubKey, err := hex.DecodeString(signer.Key)
+	if err != nil || len(pubKey) != ed25519.PublicKeySize {
+		return signer, serr.Errorf("invalid countersignature key %q", signer.Key)
+	}
+	signature, err := base32.StdEncoding.DecodeString(b)
+	if err != nil {
+		return signer, serr.New(err)
+	}
+	data, err := m.countersignedData(unsigned)
+	if err != nil {
+		return signer, err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pubKey), data, signature) {
+		return signer, serr.Errorf("countersignature by %s doesn't verify", signer.Key)
+	}
+	signer.TorId = torId(pubKey)
+	return signer, nil
+}
+
+func torId(pubKey []byte) string {
+	key := keytool.EasyEdKey{}
+	key.SetTorPublicKey(ed25519.PublicKey(pubKey))
+	id, _ := key.TorId()
+	return id
+}
+
+// Sender is the torid of the key the article is signed with, unlike From it
+// can't be set to someone else. It's empty if Approved isn't a key.
+func (m *MessageTool) Sender() string {
+	pubKey, err := hex.DecodeString(m.Article.Header.Get("Approved"))
+	if err != nil || len(pubKey) != ed25519.PublicKeySize {
+		return ""
+	}
+	return torId(pubKey)
+}
+
+// Signers returns the author then everyone who validly countersigned, none
+// if the author's signature doesn't verify.
+func (m *MessageTool) Signers() []Signer {
+	if !m.Verify() {
+		return nil
+	}
+	pubKey, _ := hex.DecodeString(m.Article.Header.Get("Approved"))
+	signers := []Signer{{Key: hex.EncodeToString(pubKey), TorId: torId(pubKey), Role: RoleAuthor}}
+	for _, value := range m.Article.Header.Values(CountersignatureHeader) {
+		signer, err := m.verifyCountersignature(value)
+		if err != nil {
+			slog.Info("Ignoring countersignature", "messageId", m.Article.Header.Get("Message-Id"), "error", err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+// SignedBy tells if one of torIds signed the article, as author or in role.
+func (m *MessageTool) SignedBy(role string, torIds []string) bool {
+	for _, signer := range m.Signers() {
+		if signer.Role != RoleAuthor && signer.Role != role {
+			continue
+		}
+		for _, id := range torIds {
+			if signer.TorId == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetModerated makes a group's card require moderator approval, the group's
+// owner is always a moderator.
+func SetModerated(card vcard.Card, moderators []string) {
+	card.Set(ModeratedField, &vcard.Field{
+		Value:  "true",
+		Params: vcard.Params{"MODERATORS": {strings.Join(moderators, ",")}},
+	})
+}
+
+// GetModerated returns the moderators listed in a moderated group's card.
+func GetModerated(card vcard.Card) ([]string, bool) {
+	f := card.Get(ModeratedField)
+	if f == nil || f.Value != "true" {
+		return nil, false
+	}
+	moderators := []string{}
+	for _, id := range strings.Split(f.Params.Get("MODERATORS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			moderators = append(moderators, id)
+		}
+	}
+	return moderators, true
+}
@@ -0,0 +1,109 @@
+package messages
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+)
+
+func newTestKey(t *testing.T) (keytool.EasyEdKey, string) {
+	key := keytool.EasyEdKey{}
+	if err := key.GenerateKey(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := key.TorId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, id
+}
+
+func signedArticle(t *testing.T, key keytool.EasyEdKey) *MessageTool {
+	m := NewMessageTool()
+	m.Article.Header.Set("Newsgroups", "kothawoc.test")
+	m.Article.Header.Set("Subject", "countersigned")
+	m.Article.Header.Set("Message-Id", "<countersigned@kothawoc.test>")
+	m.Article.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+	m.Preamble = "Please approve this.\r\n"
+	if _, err := m.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestCountersign(t *testing.T) {
+	author, authorId := newTestKey(t)
+	moderator, moderatorId := newTestKey(t)
+	voucher, voucherId := newTestKey(t)
+
+	m := signedArticle(t, author)
+	if _, err := m.Countersign(moderator, RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := m.Countersign(voucher, RoleVouch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as it's read by the next node.
+	read := parseVector(t, raw)
+	if !read.Verify() {
+		t.Fatal("countersigning broke the author's signature")
+	}
+	signers := read.Signers()
+	expected := []Signer{
+		{TorId: authorId, Role: RoleAuthor},
+		{TorId: moderatorId, Role: RoleModerator},
+		{TorId: voucherId, Role: RoleVouch},
+	}
+	if len(signers) != len(expected) {
+		t.Fatalf("signers %+v", signers)
+	}
+	for i, s := range signers {
+		if s.TorId != expected[i].TorId || s.Role != expected[i].Role {
+			t.Errorf("signer %d is %+v, expected %+v", i, s, expected[i])
+		}
+	}
+
+	if !read.SignedBy(RoleModerator, []string{moderatorId}) {
+		t.Error("not signed by the moderator")
+	}
+	if !read.SignedBy(RoleModerator, []string{authorId}) {
+		t.Error("the author doesn't count")
+	}
+	if read.SignedBy(RoleModerator, []string{voucherId}) {
+		t.Error("a vouch counts as a moderator")
+	}
+}
+
+func TestCountersignRejected(t *testing.T) {
+	author, _ := newTestKey(t)
+	moderator, moderatorId := newTestKey(t)
+
+	m := signedArticle(t, author)
+	if _, err := m.Countersign(moderator, "Moderator"); err == nil {
+		t.Error("invalid role accepted")
+	}
+	if _, err := parseVector(t, readVector(t, "v1.eml")).Countersign(moderator, RoleModerator); err == nil {
+		t.Error("v1 article countersigned")
+	}
+
+	raw, err := m.Countersign(moderator, RoleModerator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a countersignature moved to another role, or from a broken article,
+	// doesn't count.
+	for name, tampered := range map[string]string{
+		"role": strings.Replace(raw, "role=moderator", "role=relay", 1),
+		"body": strings.Replace(raw, "Please approve", "Please ignore", 1),
+	} {
+		if parseVector(t, tampered).SignedBy(RoleModerator, []string{moderatorId}) {
+			t.Errorf("%s: tampered countersignature counts", name)
+		}
+	}
+	if signers := parseVector(t, strings.Replace(raw, "Please approve", "Please ignore", 1)).Signers(); signers != nil {
+		t.Errorf("signers of a broken article %+v", signers)
+	}
+}
@@ -0,0 +1,75 @@
+package messages
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-vcard"
+)
+
+/*
+# Ephemeral groups
+
+Groups for chatting, their articles are only kept in RAM for a short while,
+never written to disk, and pushed to connected peers straight away. The group
+creator sets it in the newgroup vcard, so every node carrying the group
+treats it the same:
+
+	X-KW-EPHEMERAL;TTL=<seconds>;SIZE=<max articles>[;SUBJECTONLY=true]:true
+
+With SUBJECTONLY the articles can only have a subject line, an empty body.
+Every node also caps the ttl, size and total bytes it keeps itself.
+*/
+
+const EphemeralField string = "X-KW-EPHEMERAL"
+
+const (
+	DefaultEphemeralTTL  = 10 * time.Minute
+	DefaultEphemeralSize = 200
+)
+
+// SetEphemeral marks a group's card as ephemeral, zero values use the
+// defaults.
+func SetEphemeral(card vcard.Card, ttl time.Duration, size int, subjectOnly bool) {
+	if ttl <= 0 {
+		ttl = DefaultEphemeralTTL
+	}
+	if size <= 0 {
+		size = DefaultEphemeralSize
+	}
+	params := vcard.Params{
+		"TTL":  {strconv.FormatInt(int64(ttl/time.Second), 10)},
+		"SIZE": {strconv.Itoa(size)},
+	}
+	if subjectOnly {
+		params["SUBJECTONLY"] = []string{"true"}
+	}
+	card.Set(EphemeralField, &vcard.Field{
+		Value:  "true",
+		Params: params,
+	})
+}
+
+// EphemeralSubjectOnly is true if an ephemeral group's articles can only
+// have a subject.
+func EphemeralSubjectOnly(card vcard.Card) bool {
+	f := card.Get(EphemeralField)
+	return f != nil && f.Value == "true" && f.Params.Get("SUBJECTONLY") == "true"
+}
+
+// GetEphemeral returns the ttl and size of an ephemeral group's card.
+func GetEphemeral(card vcard.Card) (time.Duration, int, bool) {
+	f := card.Get(EphemeralField)
+	if f == nil || f.Value != "true" {
+		return 0, 0, false
+	}
+	ttl, err := strconv.ParseInt(f.Params.Get("TTL"), 10, 64)
+	if err != nil || ttl <= 0 {
+		ttl = int64(DefaultEphemeralTTL / time.Second)
+	}
+	size, err := strconv.Atoi(f.Params.Get("SIZE"))
+	if err != nil || size <= 0 {
+		size = DefaultEphemeralSize
+	}
+	return time.Duration(ttl) * time.Second, size, true
+}
@@ -0,0 +1,151 @@
+package messages
+
+import (
+	"encoding/base32"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kothawoc/go-nntp"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+/*
+# Invites
+
+An invite is a signed token a node hands out of band, by link or QR code, so
+the holder can peer with it without the inviter having to know their torid.
+
+The token is the uppercase unpadded base32 of the payload followed by the
+64 byte signature of the payload by the inviter's key, prefixed with
+InvitePrefix. Uppercase base32 fits the QR code alphanumeric mode.
+
+	Torid: <inviter torid>
+	Name: <inviter display name>
+	Secret: <one time secret>
+	Expires: <unix time>
+
+The holder peers with the inviter and posts "Control: inviteaccept <secret>"
+into their new peering group, on seeing it the inviter peers back. Until
+then the holder isn't a peer, so it sends "invite <secret>" as its handshake
+note, and the inviter only lets it in if that's an open invite.
+*/
+
+const InvitePrefix string = "KOTHAWOC:INVITE/"
+
+var inviteEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// InviteNote is the handshake note for redeeming the invite with secret.
+func InviteNote(secret string) string {
+	return "invite " + secret
+}
+
+// ParseInviteNote returns the secret in an invite handshake note.
+func ParseInviteNote(note string) (string, bool) {
+	secret, ok := strings.CutPrefix(note, "invite ")
+	return secret, ok && secret != ""
+}
+
+type Invite struct {
+	TorId   string
+	Name    string
+	Secret  string
+	Expires time.Time
+}
+
+func CreateInviteToken(myKey keytool.EasyEdKey, invite Invite) (string, error) {
+
+	torId, err := myKey.TorId()
+	if err != nil {
+		return "", serr.New(err)
+	}
+
+	payload := "Torid: " + torId +
+		"\r\nName: " + fieldValue(invite.Name) +
+		"\r\nSecret: " + invite.Secret +
+		"\r\nExpires: " + strconv.FormatInt(invite.Expires.Unix(), 10)
+
+	sig, err := myKey.TorSign([]byte(payload))
+	if err != nil {
+		return "", serr.New(err)
+	}
+
+	return InvitePrefix + inviteEncoding.EncodeToString(append([]byte(payload), sig...)), nil
+}
+
+// ParseInviteToken decodes a token and checks it was signed by the torid it
+// carries, it doesn't check the expiry.
+func ParseInviteToken(token string) (*Invite, error) {
+
+	token = strings.ToUpper(strings.TrimSpace(token))
+	token = strings.TrimPrefix(token, InvitePrefix)
+
+	data, err := inviteEncoding.DecodeString(token)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	if len(data) <= 64 {
+		return nil, serr.Errorf("invite token too short")
+	}
+
+	payload := data[:len(data)-64]
+	sig := data[len(data)-64:]
+
+	fields := parseFields(string(payload))
+
+	inviterKey := keytool.EasyEdKey{}
+	if err := inviterKey.SetTorId(fields["Torid"]); err != nil {
+		return nil, serr.New(err)
+	}
+
+	verified, err := inviterKey.TorVerify(sig, payload)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	if !verified {
+		return nil, serr.Errorf("invite signature doesn't match torid %s", fields["Torid"])
+	}
+
+	expires, err := strconv.ParseInt(fields["Expires"], 10, 64)
+	if err != nil {
+		return nil, serr.New(err)
+	}
+
+	invite := &Invite{
+		TorId:   fields["Torid"],
+		Name:    fields["Name"],
+		Secret:  fields["Secret"],
+		Expires: time.Unix(expires, 0),
+	}
+	if invite.Secret == "" {
+		return nil, serr.Errorf("invite has no secret")
+	}
+
+	return invite, nil
+}
+
+// CreateInviteAccept redeems the invite secret with the inviter peerId.
+func CreateInviteAccept(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, peerId, secret string) (string, error) {
+
+	ownerID, err := myKey.TorId()
+	if err != nil {
+		return "", serr.New(err)
+	}
+
+	return (&MessageTool{
+		Article: &nntp.Article{
+			Header: textproto.MIMEHeader{
+				"Subject":    {"cmsg inviteaccept " + peerId},
+				"Control":    {"inviteaccept " + secret},
+				"Message-Id": {idgen.GenID()},
+				"Date":       {time.Now().UTC().Format(time.RFC1123Z)},
+				"Newsgroups": {ownerID + ".peers." + peerId},
+			},
+		},
+		Preamble: "This is a system control message to accept an invite from " + peerId + " by " + ownerID + ".\r\n",
+		Parts:    []MimePart{},
+	}).Sign(myKey)
+}
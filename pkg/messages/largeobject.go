@@ -0,0 +1,256 @@
+package messages
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kothawoc/go-nntp"
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+/*
+# Large objects
+
+Files too big for one article, such as videos, are split into chunks of
+ChunkSize bytes. Each chunk is a signed control message of its own, named by
+the SHA-256 of its content, so the same chunk is only ever stored once and
+can be checked by anyone holding it:
+
+	Control: chunk <sha256>
+	Message-Id: <<sha256>@chunk.kothawoc>
+
+Chunks are never listed in a group, nor pushed to peers, nodes fetch them
+from their peers when the object is read. The object is posted as a manifest
+part in an ordinary article, after the chunks:
+
+	Content-Type: application/x-kothawoc-object; name="film.mp4"
+	Content-Disposition: inline; filename="film.mp4"
+
+	Name: film.mp4
+	Type: video/mp4
+	Size: <bytes>
+	Chunk-Size: <bytes>
+	Sha256: <sha256 of the whole file>
+
+	<sha256 of the first chunk>
+	<sha256 of the next chunk>
+	...
+*/
+
+const ObjectContentType string = "application/x-kothawoc-object"
+
+// ChunkSize is how much of an object goes in each chunk article.
+const ChunkSize = 256 << 10
+
+// MaxAttachmentSize is the biggest file worth attaching whole, bigger ones
+// are better sent as large objects.
+const MaxAttachmentSize = 4 * ChunkSize
+
+// Manifest describes a large object, Part is its index in Parts.
+type Manifest struct {
+	Part      int      `json:"part"`
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunksize"`
+	Sha256    string   `json:"sha256"`
+	Chunks    []string `json:"chunks"`
+}
+
+// ChunkMessageId is the message id of the chunk with the given hash.
+func ChunkMessageId(hash string) string {
+	return "<" + hash + "@chunk.kothawoc>"
+}
+
+// ParseChunkControl returns the hash of a chunk control message, ok is false
+// for any other.
+func ParseChunkControl(control string) (hash string, ok bool) {
+	fields := strings.Fields(control)
+	if len(fields) != 2 || fields[0] != "chunk" || !validHash(fields[1]) {
+		return "", false
+	}
+	return fields[1], true
+}
+
+func validHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size && hash == strings.ToLower(hash)
+}
+
+// CreateChunk makes the signed article holding a chunk of an object.
+func CreateChunk(myKey keytool.EasyEdKey, newsgroups []string, chunk []byte) (string, string, error) {
+	sum := sha256.Sum256(chunk)
+	hash := hex.EncodeToString(sum[:])
+	messageId := ChunkMessageId(hash)
+
+	parts := []MimePart{
+		{
+			Header: textproto.MIMEHeader{
+				"Content-Type":              {"application/octet-stream"},
+				"Content-Transfer-Encoding": {"base64"},
+			},
+			Content: chunk,
+		},
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{"text/plain;charset=UTF-8"}},
+			Content: []byte("This is a chunk of a large object, " + hash + ".\r\n"),
+		},
+	}
+
+	mail, err := (&MessageTool{
+		Article: &nntp.Article{
+			Header: textproto.MIMEHeader{
+				"Subject":                   {"cmsg chunk " + hash},
+				"Control":                   {"chunk " + hash},
+				"Message-Id":                {messageId},
+				"Date":                      {time.Now().UTC().Format(time.RFC1123Z)},
+				"Newsgroups":                {strings.Join(newsgroups, ",")},
+				"Content-Type":              {"multipart/mixed; boundary=\"nxtprt\""},
+				"Content-Transfer-Encoding": {"8bit"},
+			},
+		},
+		Preamble: "This is a MIME control message.",
+		Parts:    parts,
+	}).Sign(myKey)
+	return mail, messageId, err
+}
+
+// ChunkContent returns the content of a chunk article, checking it matches
+// the hash it's named by.
+func ChunkContent(m *MessageTool) ([]byte, error) {
+	hash, ok := ParseChunkControl(m.Article.Header.Get("Control"))
+	if !ok || len(m.Parts) == 0 {
+		return nil, serr.Errorf("not a chunk %s", m.Article.Header.Get("Message-Id"))
+	}
+	if m.Article.Header.Get("Message-Id") != ChunkMessageId(hash) {
+		return nil, serr.Errorf("chunk %s has the wrong message id %s", hash, m.Article.Header.Get("Message-Id"))
+	}
+	content, err := m.Parts[0].Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != hash {
+		return nil, serr.Errorf("chunk %s doesn't match its hash", hash)
+	}
+	return content, nil
+}
+
+// SplitObject reads an object chunk by chunk, handing each to post, and
+// returns its manifest.
+func SplitObject(name, mimeType string, r io.Reader, post func(chunk []byte) error) (Manifest, error) {
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	manifest := Manifest{Name: name, Type: mimeType, ChunkSize: ChunkSize, Chunks: []string{}}
+	whole := sha256.New()
+	buf := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			whole.Write(buf[:n])
+			sum := sha256.Sum256(buf[:n])
+			if err := post(buf[:n]); err != nil {
+				return manifest, err
+			}
+			manifest.Chunks = append(manifest.Chunks, hex.EncodeToString(sum[:]))
+			manifest.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return manifest, serr.New(err)
+		}
+	}
+	manifest.Sha256 = hex.EncodeToString(whole.Sum(nil))
+	return manifest, nil
+}
+
+// AddObject adds the manifest of a large object, its chunks need posting
+// first.
+func (m *MessageTool) AddObject(manifest Manifest) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Name: %s\r\nType: %s\r\nSize: %d\r\nChunk-Size: %d\r\nSha256: %s\r\n\r\n",
+		manifest.Name, manifest.Type, manifest.Size, manifest.ChunkSize, manifest.Sha256)
+	for _, hash := range manifest.Chunks {
+		buf.WriteString(hash + "\r\n")
+	}
+
+	m.makeMultipart()
+	m.Parts = append(m.Parts, MimePart{
+		Header: textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(ObjectContentType, map[string]string{"name": manifest.Name})},
+			"Content-Disposition":       {mime.FormatMediaType("inline", map[string]string{"filename": manifest.Name})},
+			"Content-Transfer-Encoding": {"8bit"},
+		},
+		Content: buf.Bytes(),
+	})
+}
+
+// parseManifest reads a manifest part.
+func parseManifest(content []byte) (Manifest, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(content)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return Manifest{}, serr.New(err)
+	}
+	manifest := Manifest{
+		Name:   header.Get("Name"),
+		Type:   header.Get("Type"),
+		Sha256: header.Get("Sha256"),
+		Chunks: []string{},
+	}
+	if manifest.Size, err = strconv.ParseInt(header.Get("Size"), 10, 64); err != nil {
+		return manifest, serr.New(err)
+	}
+	if manifest.ChunkSize, err = strconv.ParseInt(header.Get("Chunk-Size"), 10, 64); err != nil || manifest.ChunkSize <= 0 {
+		return manifest, serr.Errorf("invalid chunk size %s", header.Get("Chunk-Size"))
+	}
+	for {
+		line, err := r.ReadLine()
+		if line = strings.TrimSpace(line); line != "" {
+			if !validHash(line) {
+				return manifest, serr.Errorf("invalid chunk %s", line)
+			}
+			manifest.Chunks = append(manifest.Chunks, line)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if chunks := (manifest.Size + manifest.ChunkSize - 1) / manifest.ChunkSize; chunks != int64(len(manifest.Chunks)) {
+		return manifest, serr.Errorf("%d chunks for %d bytes", len(manifest.Chunks), manifest.Size)
+	}
+	return manifest, nil
+}
+
+// Objects lists the large objects in a parsed article.
+func (m *MessageTool) Objects() []Manifest {
+	ret := []Manifest{}
+	for i, p := range m.Parts {
+		if mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type")); mediaType != ObjectContentType {
+			continue
+		}
+		content, err := p.Bytes()
+		if err != nil {
+			continue
+		}
+		manifest, err := parseManifest(content)
+		if err != nil {
+			continue
+		}
+		manifest.Part = i
+		ret = append(ret, manifest)
+	}
+	return ret
+}
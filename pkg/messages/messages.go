@@ -4,14 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/base32"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"mime"
 	"mime/multipart"
 	"net/textproto"
-	"os"
 	"slices"
 	"strings"
 	"time"
@@ -70,15 +71,23 @@ var SignatureFields []string = []string{
 	"Content-Transfer-Encoding",
 }
 
+// MimePart is a part of an article, its content decoded. Parts read bigger
+// than spillSize are kept in a temporary file instead of Content, read them
+// with Open or Bytes.
 type MimePart struct {
 	Header  textproto.MIMEHeader
 	Content []byte
+
+	spill *spillFile
 }
 
 type MessageTool struct {
 	Parts    []MimePart
 	Preamble string
 	Article  *nntp.Article
+
+	// bodyHash is the canonical hash of the body as it was read.
+	bodyHash []byte
 }
 
 func (m *MessageTool) Sign(myKey keytool.EasyEdKey) (string, error) {
@@ -93,16 +102,29 @@ func (m *MessageTool) Sign(myKey keytool.EasyEdKey) (string, error) {
 	//myKey.SetTorPrivateKey(privateKey)
 	torId, _ := myKey.TorId()
 	(*m).Article.Header.Set("From", torId)
-	data := m.writeRaw(true)
-	msg, err := myKey.TorSign([]byte(data))
+
+	// it's signed as it will be written, not as it was read.
+	bodyHash, err := m.writtenBodyHash()
+	if err != nil {
+		return "", err
+	}
+	m.bodyHash = nil
+
+	headers := make([]string, len(SignatureFields))
+	for i, field := range SignatureFields {
+		headers[i] = strings.ToLower(field)
+	}
+	unsigned := fmt.Sprintf("%s; alg=%s; h=%s; bh=%s; b=", SignatureVersion, SignatureAlgorithm,
+		strings.Join(headers, ":"), base64.StdEncoding.EncodeToString(bodyHash))
+
+	msg, err := myKey.TorSign(m.signedData(headers, unsigned))
 	if err != nil {
 		return string(msg), serr.New(err)
 	}
 	signature := base32.StdEncoding.EncodeToString(msg)
 
-	os.WriteFile("sign.txt", []byte(data), 0600)
-	slog.Info("Signing message", "data", string(data), "signature", signature)
-	(*m).Article.Header.Set(SignatureHeader, signature)
+	slog.Debug("Signed message", "messageId", m.Article.Header.Get("Message-Id"), "signature", signature)
+	(*m).Article.Header.Set(SignatureHeader, unsigned+signature)
 	return m.writeRaw(false), nil
 }
 
@@ -111,51 +133,53 @@ func (m *MessageTool) RawMail() string {
 }
 
 func (m *MessageTool) Verify() bool {
-	//sigPart := m.Parts[len(m.Parts)-1]
-	slog.Info("verify", "message", m.writeRaw(true))
-
-	b32Signature := []byte(m.Article.Header.Get(SignatureHeader))
+	pubKey, err := hex.DecodeString(m.Article.Header.Get("Approved"))
+	if err != nil || len(pubKey) != ed25519.PublicKeySize {
+		slog.Info("Failed to decode pubkey.")
+		return false
+	}
+	if strings.HasPrefix(m.Article.Header.Get(SignatureHeader), SignatureVersion+";") {
+		return m.verifyV2(pubKey)
+	}
+	return m.verifyV1(pubKey)
+}
 
-	dst := make([]byte, 256)
-	n, err := base32.StdEncoding.Decode(dst, b32Signature)
+// verifyV1 checks a version 1 signature, of the article as WriteTo writes it
+// when signing.
+func (m *MessageTool) verifyV1(pubKey []byte) bool {
+	signature, err := base32.StdEncoding.DecodeString(m.Article.Header.Get(SignatureHeader))
 	if err != nil {
 		slog.Info("Failed to decode b32 signature.")
 		return false
 	}
-	signature := dst[:n]
 
-	pubKey, err := hex.DecodeString(m.Article.Header.Get("Approved"))
-	if err != nil {
-		slog.Info("Failed to decode pubkey.")
+	// ed25519 needs the whole signed form at once, it's written just once.
+	var data bytes.Buffer
+	if err := m.WriteTo(&data, true); err != nil {
+		slog.Info("Failed to write message to verify", "error", err)
 		return false
 	}
-	slog.Info("Checking Approved", "pubKey", pubKey, "b32Signature", b32Signature)
-	os.WriteFile("verify.txt", []byte(m.writeRaw(true)), 0600)
-	verified := ed25519.Verify(ed25519.PublicKey(pubKey), []byte(m.writeRaw(true)), signature)
-	//verified = true
-	return verified
+	return ed25519.Verify(ed25519.PublicKey(pubKey), data.Bytes(), signature)
 }
 
 func (m *MessageTool) writeRaw(signing bool) string {
-	slog.Info("Write raw start and preamble", "signing", signing, "preamble", m.Preamble)
-	// Buffer to store the email
-	var buf bytes.Buffer
-
-	// Create a multipart writer
-	var writer *multipart.Writer
-	//writer := buf
-	_, params, err := mime.ParseMediaType(m.Article.Header.Get("Content-Type"))
-	if err != nil {
-		slog.Info("Errored in parsing media type for stuff", "error", err, "header", m.Article.Header.Get("Content-Type"))
-		//		return ""
-	} else {
-		writer = multipart.NewWriter(&buf)
-		writer.SetBoundary(params["boundary"])
+	var buf strings.Builder
+	if err := m.WriteTo(&buf, signing); err != nil {
+		slog.Info("ERROR: writeRaw error", "error", err)
+		return ""
 	}
+	return buf.String()
+}
+
+// WriteTo writes the article to w as it's sent, or only the signed fields
+// as version 1 signed them when signing, encoding each part as it goes
+// rather than building it all first.
+func (m *MessageTool) WriteTo(w io.Writer, signing bool) error {
+	bw := bufio.NewWriter(w)
 
 	for _, headerName := range SignatureFields {
 		for _, value := range m.Article.Header.Values(headerName) {
-			fmt.Fprintf(&buf, "%s: %s\r\n", headerName, value)
+			fmt.Fprintf(bw, "%s: %s\r\n", headerName, value)
 		}
 	}
 
@@ -169,40 +193,85 @@ func (m *MessageTool) writeRaw(signing bool) string {
 			sigFields[i] = strings.ToLower(s)
 		}
 
-		for key, values := range m.Article.Header {
-			for _, value := range values {
+		keys := make([]string, 0, len(m.Article.Header))
+		for key := range m.Article.Header {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			for _, value := range m.Article.Header[key] {
 				if !slices.Contains(sigFields, strings.ToLower(key)) {
-					fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+					fmt.Fprintf(bw, "%s: %s\r\n", key, value)
 				}
 			}
 		}
 	}
-	fmt.Fprintf(&buf, "\r\n")
-	m.Preamble = strings.Replace(string(m.Preamble), "\r", "", -1)
-	m.Preamble = strings.Replace(string(m.Preamble), "\n", "\r\n", -1)
-	fmt.Fprintf(&buf, m.Preamble)
-	if len(m.Parts) > 1 {
-		fmt.Fprintf(&buf, "\r\n")
+	fmt.Fprintf(bw, "\r\n")
+	if err := m.writeBody(bw, signing); err != nil {
+		return err
+	}
+	return serr.New(bw.Flush())
+}
+
+// writeBody writes the preamble then the parts. Version 1 signed only the
+// preamble of an article with a single part.
+func (m *MessageTool) writeBody(w io.Writer, signing bool) error {
+	bw := bufio.NewWriter(w)
+
+	var writer *multipart.Writer
+	_, params, err := mime.ParseMediaType(m.Article.Header.Get("Content-Type"))
+	if err != nil {
+		slog.Debug("Errored in parsing media type for stuff", "error", err, "header", m.Article.Header.Get("Content-Type"))
+	} else {
+		writer = multipart.NewWriter(bw)
+		writer.SetBoundary(params["boundary"])
+	}
+
+	preamble := strings.Replace(m.Preamble, "\r", "", -1)
+	bw.WriteString(strings.Replace(preamble, "\n", "\r\n", -1))
+	if len(m.Parts) > 1 || (!signing && len(m.Parts) > 0) {
+		if writer == nil {
+			return serr.Errorf("MIME parts without a multipart Content-Type")
+		}
+		fmt.Fprintf(bw, "\r\n")
 
 		for _, part := range m.Parts {
 			partWriter, err := writer.CreatePart(part.Header)
 			if err != nil {
-				//	log.Fatal(err)
-				slog.Info("ERROR: writeRaw partWriter error", "error", err)
-				return ""
+				return serr.New(err)
+			}
+			if err := part.encodeTo(partWriter); err != nil {
+				return err
 			}
-			part.Content = []byte(strings.Replace(string(part.Content), "\r", "", -1))
-			partWriter.Write([]byte(strings.Replace(string(part.Content), "\n", "\r\n", -1)))
 		}
 
 		// Close the writer to finalize the email
 		writer.Close()
 	}
 
-	return buf.String()
+	return serr.New(bw.Flush())
 }
 
-func (m *MessageTool) ParseBody() {
+// ParseBody reads the preamble and parts of the article's body, decoding
+// each part as it's read. Any error reading the body is returned, what was
+// read before it is kept.
+func (m *MessageTool) ParseBody() error {
+	h, w := newBodyHash()
+	body := io.TeeReader(m.Article.Body, w)
+	m.Article.Body = body
+
+	if err := m.parseBody(); err != nil {
+		return err
+	}
+	// the hash covers anything after the last part too.
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return serr.New(err)
+	}
+	m.bodyHash = h.Sum(nil)
+	return nil
+}
+
+func (m *MessageTool) parseBody() error {
 
 	hasMime := false
 	_, params, err := mime.ParseMediaType(m.Article.Header.Get("Content-Type"))
@@ -238,14 +307,14 @@ func (m *MessageTool) ParseBody() {
 			//	fmt.Println("READ 1 Preamble:")
 			//	fmt.Println(preamble.String())
 			(*m).Preamble = preamble.String()
-			return
+			return nil
 		}
 		if err != nil {
 			preamble.WriteString(line)
 			//	fmt.Println("READ 2 Preamble:")
 			//	fmt.Println(preamble.String())
 			m.Preamble = preamble.String()
-			return
+			return serr.New(err)
 		}
 		if hasMime && strings.HasPrefix(line, "--"+params["boundary"]) {
 			reader = bufio.NewReader(io.MultiReader(strings.NewReader(line), reader))
@@ -253,7 +322,8 @@ func (m *MessageTool) ParseBody() {
 			//	fmt.Println("PREAD 3 reamble:")
 			//	fmt.Println(preamble.String())
 			m.Preamble = preamble.String()
-			if m.Preamble[len(m.Preamble)-1] == '\n' {
+			// the body may start with the boundary, with no preamble at all.
+			if strings.HasSuffix(m.Preamble, "\n") {
 				m.Preamble = m.Preamble[:len(m.Preamble)-1]
 				//		fmt.Printf("LOLZ 3 READ 2 Preamble: [%s] ||lolz", m.Preamble)
 			}
@@ -265,29 +335,33 @@ func (m *MessageTool) ParseBody() {
 			//mr.
 
 			for {
-				part, err := mr.NextPart()
+				// raw, so quoted-printable parts keep their header for the
+				// signature, the content is decoded below.
+				part, err := mr.NextRawPart()
 				if err == io.EOF {
 
 					//	fmt.Printf("PREAD 4 parts reamble: [%#v][%s]", parts, parts)
 					m.Parts = parts
-					return
+					return nil
 				}
 				if err != nil {
 					//	fmt.Printf("PREAD 5 parts reamble: [%v]", parts)
 
 					m.Parts = parts
-					return
+					return serr.New(err)
 				}
 
 				//	fmt.Printf("Part Content-Type: %s\n", part.Header.Get("Content-Type"))
 				//	if part.FileName() != "" {
 				//		fmt.Printf("Attachment Filename: %s\n", part.FileName())
 				//	}
-				buf := new(bytes.Buffer)
-				buf.ReadFrom(part)
-				//	fmt.Printf("Part Content:\n%s\n\n", buf.String())
-
-				parts = append(parts, MimePart{Header: part.Header, Content: buf.Bytes()})
+				mp := MimePart{Header: part.Header}
+				if err := mp.decodeFrom(part); err != nil {
+					slog.Info("Failed to decode MIME part", "error", err)
+					m.Parts = parts
+					return err
+				}
+				parts = append(parts, mp)
 
 			}
 
@@ -319,6 +393,54 @@ func NewMessageToolFromArticle(article *nntp.Article) *MessageTool {
 	return mt
 }
 
+// ErrArticleTooLarge is returned reading a body bigger than allowed.
+var ErrArticleTooLarge error = errors.New("article too large")
+
+// DefaultMaxArticleSize is the biggest article taken when the node's
+// MaxArticleSize config isn't set.
+const DefaultMaxArticleSize int64 = 16 << 20
+
+// ReadMessageTool parses an article as it's read, failing once the body is
+// more than maxSize bytes, 0 is no limit.
+func ReadMessageTool(article *nntp.Article, maxSize int64) (*MessageTool, error) {
+	if maxSize > 0 {
+		article.Body = &limitReader{r: article.Body, n: maxSize}
+	}
+	mt := &MessageTool{
+		Article:  article,
+		Preamble: "",
+		Parts:    []MimePart{},
+	}
+	if err := mt.ParseBody(); err != nil {
+		if errors.Is(err, ErrArticleTooLarge) {
+			return mt, ErrArticleTooLarge
+		}
+		return mt, err
+	}
+	return mt, nil
+}
+
+// limitReader is io.LimitReader, but errors rather than ending early.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrArticleTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrArticleTooLarge
+	}
+	return n, err
+}
+
 func (m *MessageTool) ExampleMessageTemplate() *MessageTool {
 	return &MessageTool{
 		Article: &nntp.Article{
@@ -0,0 +1,85 @@
+package messages
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/kothawoc/go-nntp"
+
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+)
+
+// A body starting with the boundary has no preamble, it used to panic.
+func TestReadMessageToolNoPreamble(t *testing.T) {
+	body := "--nxtprt\r\nContent-Type: text/plain\r\n\r\nhello\r\n--nxtprt--\r\n"
+	article := &nntp.Article{
+		Header: textproto.MIMEHeader{"Content-Type": {"multipart/mixed; boundary=\"nxtprt\""}},
+		Body:   strings.NewReader(body),
+	}
+
+	m, err := ReadMessageTool(article, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Preamble != "" {
+		t.Errorf("preamble %q", m.Preamble)
+	}
+	if len(m.Parts) != 1 || string(m.Parts[0].Content) != "hello" {
+		t.Errorf("parts %+v", m.Parts)
+	}
+}
+
+// A part bigger than spillSize is read into a temporary file, and still
+// encodes the same so the signature verifies.
+func TestReadMessageToolSpill(t *testing.T) {
+	SpillDir = t.TempDir()
+	key := keytool.EasyEdKey{}
+	if err := key.GenerateKey(); err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, spillSize*3)
+	rand.Read(content)
+
+	m := NewMessageTool()
+	m.Article.Header.Set("Newsgroups", "test.group")
+	m.Article.Header.Set("Subject", "big")
+	m.Preamble = "see attached\r\n"
+	if err := m.AddAttachment("big.bin", "application/octet-stream", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := m.Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, body, _ := strings.Cut(raw, "\r\n\r\n")
+	article := &nntp.Article{Header: textproto.MIMEHeader{}, Body: strings.NewReader(body)}
+	for _, line := range strings.Split(header, "\r\n") {
+		k, v, _ := strings.Cut(line, ": ")
+		article.Header.Add(k, v)
+	}
+	read, err := ReadMessageTool(article, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := read.Parts[len(read.Parts)-1]
+	if part.spill == nil || part.Content != nil {
+		t.Fatalf("part wasn't spilled: %+v", part.Header)
+	}
+	if part.Size() != int64(len(content)) {
+		t.Errorf("size %d, expected %d", part.Size(), len(content))
+	}
+	got, err := part.Bytes()
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("content doesn't match, %v", err)
+	}
+	if !read.Verify() {
+		t.Error("spilled article doesn't verify")
+	}
+	if _, err := ReadMessageTool(&nntp.Article{Header: article.Header, Body: strings.NewReader(body)}, spillSize); err == nil {
+		t.Error("article over the limit was read")
+	}
+}
@@ -0,0 +1,373 @@
+package messages
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/kothawoc/go-nntp"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+/*
+# Read state
+
+A user's read marks are kept in .newsrc format, one line per group, ":" for
+subscribed and "!" for unsubscribed, followed by the read article ranges.
+
+	<torid>.general: 1-20,22,25-30
+	<torid>.chat! 1-3
+
+Newsreaders get and set it over NNTP through a virtual article, which is
+never stored or distributed:
+
+	ARTICLE <newsrc@kothawoc>     returns the logged in user's newsrc
+	POST with "Control: newsrc"   replaces the listed groups read state
+
+Between a user's own devices, the newsrc is synced in the private group
+<userid>.newsrc, which only the devices listed at its creation can read. The
+"application/x-kothawoc-newsrc" part is encrypted with a key derived from the
+user's identity key, so only nodes holding the same account key can use it.
+
+Each node numbers a group's articles in the order it got them, so the synced
+state lists the Message-Ids read instead of numbers. Read marks for articles
+a device hasn't got yet are dropped.
+
+Every sync has all the read state, so a node keeps only the latest by its
+Date in the group, and drops the one it supersedes.
+
+	Control: newsrc
+
+	<torid>.general: <id1@example> <id2@example>
+	<torid>.chat!
+*/
+
+const (
+	NewsrcMessageId   string = "<newsrc@kothawoc>"
+	NewsrcContentType string = "application/x-kothawoc-newsrc"
+	newsrcKeyInfo     string = "kothawoc newsrc v1"
+)
+
+var ErrNewsrcMalformed error = errors.New("malformed newsrc")
+
+// NewsrcGroup is the private group a user's read state is synced in.
+func NewsrcGroup(userId string) string {
+	return userId + ".newsrc"
+}
+
+// ArticleRange is an inclusive range of article numbers.
+type ArticleRange struct {
+	From, To int64
+}
+
+type NewsrcLine struct {
+	Group      string
+	Subscribed bool
+	Read       []ArticleRange
+}
+
+// NumbersToRanges folds article numbers into ranges.
+func NumbersToRanges(numbers []int64) []ArticleRange {
+	sorted := append([]int64{}, numbers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	ret := []ArticleRange{}
+	for _, n := range sorted {
+		if l := len(ret); l > 0 && n <= ret[l-1].To+1 {
+			if n > ret[l-1].To {
+				ret[l-1].To = n
+			}
+			continue
+		}
+		ret = append(ret, ArticleRange{From: n, To: n})
+	}
+	return ret
+}
+
+func FormatRanges(ranges []ArticleRange) string {
+	parts := []string{}
+	for _, r := range ranges {
+		if r.From == r.To {
+			parts = append(parts, strconv.FormatInt(r.From, 10))
+		} else {
+			parts = append(parts, strconv.FormatInt(r.From, 10)+"-"+strconv.FormatInt(r.To, 10))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func ParseRanges(s string) ([]ArticleRange, error) {
+	ret := []ArticleRange{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		r := ArticleRange{}
+		var err error
+		if r.From, err = strconv.ParseInt(from, 10, 64); err != nil {
+			return nil, serr.New(ErrNewsrcMalformed)
+		}
+		r.To = r.From
+		if isRange {
+			if r.To, err = strconv.ParseInt(to, 10, 64); err != nil {
+				return nil, serr.New(ErrNewsrcMalformed)
+			}
+		}
+		if r.From < 1 || r.To < r.From {
+			return nil, serr.New(ErrNewsrcMalformed)
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+func FormatNewsrc(lines []NewsrcLine) string {
+	buf := strings.Builder{}
+	for _, l := range lines {
+		buf.WriteString(l.Group)
+		if l.Subscribed {
+			buf.WriteString(":")
+		} else {
+			buf.WriteString("!")
+		}
+		if len(l.Read) > 0 {
+			buf.WriteString(" " + FormatRanges(l.Read))
+		}
+		buf.WriteString("\r\n")
+	}
+	return buf.String()
+}
+
+func ParseNewsrc(text string) ([]NewsrcLine, error) {
+	ret := []NewsrcLine{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.IndexAny(line, ":!")
+		if i < 1 {
+			return nil, serr.New(ErrNewsrcMalformed)
+		}
+		read, err := ParseRanges(line[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, NewsrcLine{
+			Group:      line[:i],
+			Subscribed: line[i] == ':',
+			Read:       read,
+		})
+	}
+	return ret, nil
+}
+
+// NewsrcSyncLine is a group's read state as synced between devices.
+type NewsrcSyncLine struct {
+	Group      string
+	Subscribed bool
+	Read       []string
+}
+
+func FormatNewsrcSync(lines []NewsrcSyncLine) string {
+	buf := strings.Builder{}
+	for _, l := range lines {
+		buf.WriteString(l.Group)
+		if l.Subscribed {
+			buf.WriteString(":")
+		} else {
+			buf.WriteString("!")
+		}
+		for _, id := range l.Read {
+			buf.WriteString(" " + id)
+		}
+		buf.WriteString("\r\n")
+	}
+	return buf.String()
+}
+
+func ParseNewsrcSync(text string) ([]NewsrcSyncLine, error) {
+	ret := []NewsrcSyncLine{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.IndexAny(line, ":!")
+		if i < 1 {
+			return nil, serr.New(ErrNewsrcMalformed)
+		}
+		read := strings.Fields(line[i+1:])
+		for _, id := range read {
+			if len(id) < 3 || id[0] != '<' || id[len(id)-1] != '>' {
+				return nil, serr.New(ErrNewsrcMalformed)
+			}
+		}
+		ret = append(ret, NewsrcSyncLine{
+			Group:      line[:i],
+			Subscribed: line[i] == ':',
+			Read:       read,
+		})
+	}
+	return ret, nil
+}
+
+func newsrcAEAD(userKey keytool.EasyEdKey) (cipherKey []byte, err error) {
+	privKey, err := userKey.TorPrivKey()
+	if err != nil {
+		return nil, serr.New(err)
+	}
+	cipherKey = make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, privKey, nil, []byte(newsrcKeyInfo)), cipherKey); err != nil {
+		return nil, serr.New(err)
+	}
+	return cipherKey, nil
+}
+
+// SealNewsrc encrypts a newsrc for the user's other devices.
+func SealNewsrc(userKey keytool.EasyEdKey, newsrc string) (string, error) {
+	cipherKey, err := newsrcAEAD(userKey)
+	if err != nil {
+		return "", err
+	}
+	aead, err := chacha20poly1305.NewX(cipherKey)
+	if err != nil {
+		return "", serr.New(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", serr.New(err)
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(newsrc), nil)), nil
+}
+
+// OpenNewsrc decrypts a newsrc sealed with SealNewsrc.
+func OpenNewsrc(userKey keytool.EasyEdKey, sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sealed))
+	if err != nil {
+		return "", serr.New(ErrNewsrcMalformed)
+	}
+	cipherKey, err := newsrcAEAD(userKey)
+	if err != nil {
+		return "", err
+	}
+	aead, err := chacha20poly1305.NewX(cipherKey)
+	if err != nil {
+		return "", serr.New(err)
+	}
+	if len(data) < aead.NonceSize() {
+		return "", serr.New(ErrNewsrcMalformed)
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", serr.New(ErrNewsrcMalformed)
+	}
+	return string(plain), nil
+}
+
+// NewsrcArticle is the virtual article newsreaders fetch their read state
+// from.
+func NewsrcArticle(newsrc string) *nntp.Article {
+	return &nntp.Article{
+		Header: textproto.MIMEHeader{
+			"Message-Id":   {NewsrcMessageId},
+			"Subject":      {"newsrc"},
+			"Date":         {time.Now().UTC().Format(time.RFC1123Z)},
+			"Content-Type": {"text/plain;charset=UTF-8"},
+		},
+		Body:  strings.NewReader(newsrc),
+		Bytes: len(newsrc),
+		Lines: strings.Count(newsrc, "\n"),
+	}
+}
+
+// CreateNewsrcGroup creates the user's private sync group, readable by their
+// own devices only.
+func CreateNewsrcGroup(userKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, devices []string) (string, error) {
+	userId, err := userKey.TorId()
+	if err != nil {
+		return "", serr.New(err)
+	}
+
+	card := vcard.Card{}
+	card.Add("X-KW-PERMS", &vcard.Field{
+		Value:  "group",
+		Params: vcard.Params{},
+	})
+	for _, device := range devices {
+		card.Add("X-KW-PERMS", &vcard.Field{
+			Value: device,
+			Params: vcard.Params{
+				"read": {"true"},
+				"post": {"true"},
+			},
+		})
+	}
+	vcard.ToV4(card)
+
+	return CreateNewsGroupMail(userKey, idgen, NewsrcGroup(userId), "read state sync", card, nntp.PostingPermitted)
+}
+
+// CreateNewsrcSync posts the user's encrypted read state to their sync group.
+func CreateNewsrcSync(userKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, lines []NewsrcSyncLine) (string, error) {
+	userId, err := userKey.TorId()
+	if err != nil {
+		return "", serr.New(err)
+	}
+	sealed, err := SealNewsrc(userKey, FormatNewsrcSync(lines))
+	if err != nil {
+		return "", err
+	}
+
+	parts := []MimePart{
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{NewsrcContentType}},
+			Content: []byte(sealed),
+		},
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{"text/plain;charset=UTF-8"}},
+			Content: []byte("This is a system control message to sync the read state of " + userId + ".\r\n"),
+		},
+	}
+
+	return (&MessageTool{
+		Article: &nntp.Article{
+			Header: textproto.MIMEHeader{
+				"Subject":                   {"cmsg newsrc"},
+				"Control":                   {"newsrc"},
+				"Message-Id":                {idgen.GenID()},
+				"Date":                      {time.Now().UTC().Format(time.RFC1123Z)},
+				"Newsgroups":                {NewsrcGroup(userId)},
+				"Content-Type":              {"multipart/mixed; boundary=\"nxtprt\""},
+				"Content-Transfer-Encoding": {"8bit"},
+			},
+		},
+		Preamble: "This is a MIME control message.",
+		Parts:    parts,
+	}).Sign(userKey)
+}
+
+// NewsrcFromArticle returns the plain newsrc posted by a newsreader.
+func NewsrcFromArticle(article *nntp.Article) (string, error) {
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, article.Body); err != nil {
+		return "", serr.New(err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,42 @@
+package messages
+
+import (
+	"strings"
+)
+
+// NewTextPost creates a plain text article, it still needs a Message-Id and
+// signing before it's posted.
+func NewTextPost(newsgroups []string, subject, body string, references []string) *MessageTool {
+	m := NewMessageTool()
+	m.Article.Header.Set("Newsgroups", strings.Join(newsgroups, ","))
+	m.Article.Header.Set("Subject", subject)
+	m.Article.Header.Set("Content-Type", "text/plain;charset=UTF-8")
+	m.Article.Header.Set("Content-Transfer-Encoding", "8bit")
+	if len(references) > 0 {
+		m.Article.Header.Set("References", strings.Join(references, " "))
+	}
+	m.Preamble = body
+	return m
+}
+
+// Text returns the readable text of a parsed article, the text/plain parts
+// of a MIME message that aren't attached files, or the whole body of a plain
+// one.
+func (m *MessageTool) Text() string {
+	if len(m.Parts) == 0 {
+		return m.Preamble
+	}
+	text := []string{}
+	for _, p := range m.Parts {
+		if strings.HasPrefix(p.Header.Get("Content-Type"), "text/plain") && attachmentName(p) == "" {
+			content, _ := p.Bytes()
+			text = append(text, string(content))
+		}
+	}
+	return strings.Join(text, "\n")
+}
+
+// References returns the message ids an article replies to, oldest first.
+func (m *MessageTool) References() []string {
+	return strings.Fields(m.Article.Header.Get("References"))
+}
@@ -0,0 +1,86 @@
+package messages
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kothawoc/go-nntp"
+	nntpserver "github.com/kothawoc/go-nntp/server"
+	"github.com/kothawoc/kothawoc/pkg/keytool"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+/*
+# Reactions
+
+Likes, emoji and votes are small signed control messages, posted to one of
+the groups of the article they react to. They're counted per article and
+never listed in the group, each torid counts once per reaction.
+
+	Control: react <message-id> <reaction>
+	References: <message-id>
+
+A reaction is a single word of at most MaxReactionLength bytes, such as an
+emoji, "+1" or "-1" for votes. It's taken back by cancelling the reaction.
+*/
+
+const MaxReactionLength = 32
+
+var ErrInvalidReaction error = errors.New("invalid reaction")
+
+// ValidReaction checks a reaction is one short word.
+func ValidReaction(reaction string) bool {
+	return reaction != "" && len(reaction) <= MaxReactionLength &&
+		utf8.ValidString(reaction) && !strings.ContainsAny(reaction, " \t\r\n")
+}
+
+// ParseReaction splits a react control message, ok is false for any other.
+func ParseReaction(control string) (messageId, reaction string, ok bool) {
+	fields := strings.Fields(control)
+	if len(fields) != 3 || fields[0] != "react" || !ValidReaction(fields[2]) {
+		return "", "", false
+	}
+	return fields[1], fields[2], true
+}
+
+// CreateReaction reacts to the article messageId in newsgroup.
+func CreateReaction(myKey keytool.EasyEdKey, idgen nntpserver.IdGenerator, newsgroup, messageId, reaction string) (string, error) {
+	if !ValidReaction(reaction) || strings.ContainsAny(messageId, " \t\r\n") {
+		return "", serr.New(ErrInvalidReaction)
+	}
+	ownerID, err := myKey.TorId()
+	if err != nil {
+		return "", serr.New(err)
+	}
+
+	parts := []MimePart{
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{"text/plain;charset=UTF-8"}},
+			Content: []byte(reaction + "\r\n"),
+		},
+		{
+			Header:  textproto.MIMEHeader{"Content-Type": []string{"text/plain;charset=UTF-8"}},
+			Content: []byte("This is a system control message from " + ownerID + " reacting to " + messageId + ".\r\n"),
+		},
+	}
+
+	return (&MessageTool{
+		Article: &nntp.Article{
+			Header: textproto.MIMEHeader{
+				"Subject":                   {"cmsg react " + messageId + " " + reaction},
+				"Control":                   {"react " + messageId + " " + reaction},
+				"Message-Id":                {idgen.GenID()},
+				"Date":                      {time.Now().UTC().Format(time.RFC1123Z)},
+				"Newsgroups":                {newsgroup},
+				"References":                {messageId},
+				"Content-Type":              {"multipart/mixed; boundary=\"nxtprt\""},
+				"Content-Transfer-Encoding": {"8bit"},
+			},
+		},
+		Preamble: "This is a MIME control message.",
+		Parts:    parts,
+	}).Sign(myKey)
+}
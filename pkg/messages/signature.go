@@ -0,0 +1,176 @@
+package messages
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"hash"
+	"io"
+	"log/slog"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+/*
+# Signatures
+
+Articles are signed by the key in their Approved header, the signature is in
+the X-Kothawoc-Signature header. Version 2 is specified in docs/signing.md,
+so any implementation can sign and check articles:
+
+	X-Kothawoc-Signature: v2; alg=ed25519; h=from:newsgroups:...; bh=<base64>; b=<base32>
+
+h lists the signed headers, bh is the SHA-256 of the canonical body, and b is
+the ed25519 signature of the canonical signed headers followed by the
+signature header itself with b left empty. The body is hashed as it's read,
+so it's never held whole to be checked.
+
+Version 1, a bare base32 signature of the article as this package writes it,
+is still checked but no longer made.
+*/
+
+const (
+	SignatureVersion   string = "v2"
+	SignatureAlgorithm string = "ed25519"
+)
+
+// Signature returns the signature itself from an article's header, it names
+// the article in the store.
+func Signature(header textproto.MIMEHeader) string {
+	value := header.Get(SignatureHeader)
+	if !strings.HasPrefix(value, SignatureVersion+";") {
+		return value
+	}
+	sig, err := parseSignature(value)
+	if err != nil {
+		return ""
+	}
+	return sig.b
+}
+
+type signature struct {
+	alg      string
+	headers  []string
+	bodyHash string
+	b        string
+	// unsigned is the header value with b empty, as it's signed.
+	unsigned string
+}
+
+// parseSignature reads a v2 signature header, b must be the last tag.
+func parseSignature(value string) (signature, error) {
+	sig := signature{}
+	tags := strings.Split(value, ";")
+	if strings.TrimSpace(tags[0]) != SignatureVersion {
+		return sig, serr.Errorf("unknown signature version %q", tags[0])
+	}
+	for i, tag := range tags[1:] {
+		name, val, ok := strings.Cut(strings.TrimSpace(tag), "=")
+		if !ok {
+			return sig, serr.Errorf("invalid signature tag %q", tag)
+		}
+		switch name {
+		case "alg":
+			sig.alg = val
+		case "h":
+			sig.headers = strings.Split(strings.ToLower(val), ":")
+		case "bh":
+			sig.bodyHash = val
+		case "b":
+			if i != len(tags)-2 {
+				return sig, serr.Errorf("signature b isn't the last tag")
+			}
+			sig.b = val
+			sig.unsigned = strings.TrimSuffix(strings.TrimSpace(value), val)
+		}
+	}
+	if sig.alg != SignatureAlgorithm || sig.bodyHash == "" || sig.b == "" {
+		return sig, serr.Errorf("incomplete signature %q", value)
+	}
+	for _, field := range SignatureFields {
+		if !slices.Contains(sig.headers, strings.ToLower(field)) {
+			return sig, serr.Errorf("signature doesn't cover %s", field)
+		}
+	}
+	return sig, nil
+}
+
+// canonicalValue unfolds a header value, makes each run of spaces and tabs a
+// single space and trims it.
+func canonicalValue(value string) string {
+	value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+	return strings.Join(strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == '\t' }), " ")
+}
+
+// signedData is what's signed, the canonical signed headers then the
+// signature header with b empty.
+func (m *MessageTool) signedData(headers []string, unsigned string) []byte {
+	var data strings.Builder
+	for _, name := range headers {
+		for _, value := range m.Article.Header.Values(name) {
+			data.WriteString(name + ":" + canonicalValue(value) + "\r\n")
+		}
+	}
+	data.WriteString(strings.ToLower(SignatureHeader) + ":" + canonicalValue(unsigned))
+	return []byte(data.String())
+}
+
+// newBodyHash hashes a body in its canonical form, with every line ending
+// CRLF.
+func newBodyHash() (hash.Hash, io.Writer) {
+	h := sha256.New()
+	return h, &crlfWriter{w: h}
+}
+
+// writtenBodyHash hashes the body as WriteTo writes it.
+func (m *MessageTool) writtenBodyHash() ([]byte, error) {
+	h, w := newBodyHash()
+	if err := m.writeBody(w, false); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// bodyHashOf is the hash of the body as it was read, or as it's written for
+// an article made here.
+func (m *MessageTool) bodyHashOf() ([]byte, error) {
+	if m.bodyHash != nil {
+		return m.bodyHash, nil
+	}
+	return m.writtenBodyHash()
+}
+
+// Reproducible tells if the body, as it's written, is the body that was
+// read, so it still verifies once stored and sent on. Version 1 signs the
+// body as it's written, so always is.
+func (m *MessageTool) Reproducible() bool {
+	if m.bodyHash == nil || !strings.HasPrefix(m.Article.Header.Get(SignatureHeader), SignatureVersion+";") {
+		return true
+	}
+	written, err := m.writtenBodyHash()
+	return err == nil && string(written) == string(m.bodyHash)
+}
+
+// verifyV2 checks a v2 signature by the Approved key.
+func (m *MessageTool) verifyV2(pubKey []byte) bool {
+	sig, err := parseSignature(m.Article.Header.Get(SignatureHeader))
+	if err != nil {
+		slog.Info("Failed to parse signature", "error", err)
+		return false
+	}
+	bodyHash, err := m.bodyHashOf()
+	if err != nil || base64.StdEncoding.EncodeToString(bodyHash) != sig.bodyHash {
+		slog.Info("Body hash doesn't match signature", "messageId", m.Article.Header.Get("Message-Id"))
+		return false
+	}
+	b, err := base32.StdEncoding.DecodeString(sig.b)
+	if err != nil {
+		slog.Info("Failed to decode b32 signature.")
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(pubKey), m.signedData(sig.headers, sig.unsigned), b)
+}
@@ -0,0 +1,400 @@
+package kothawoc
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kothawoc/go-nntp"
+	"github.com/kothawoc/kothawoc/internal/databases"
+	"github.com/kothawoc/kothawoc/pkg/messages"
+	serr "github.com/kothawoc/kothawoc/pkg/serror"
+)
+
+// The web UI is served on "HTTPAddress" next to the API, as plain HTML
+// forms, so it works without any scripts. Open /login?token=<APIToken> once
+// to get a cookie for it.
+
+//go:embed web
+var webFiles embed.FS
+
+var webTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"date":  func(t time.Time) string { return t.Local().Format("2 Jan 2006 15:04") },
+	"join":  strings.Join,
+	"size":  webSize,
+	"media": webMediaKind,
+	"reply": replyTo,
+	"reactions": func() []string {
+		return webReactions
+	},
+	"dict": func(kv ...interface{}) map[string]interface{} {
+		m := map[string]interface{}{}
+		for i := 0; i+1 < len(kv); i += 2 {
+			m[kv[i].(string)] = kv[i+1]
+		}
+		return m
+	},
+}).ParseFS(webFiles, "web/templates/*.html"))
+
+const webTimelineSize = 100
+
+// webReactions are offered under every article, others still show up.
+var webReactions = []string{"👍", "❤️", "😂", "😮", "😢"}
+
+// webSize shows a file size.
+func webSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// webMediaKind is "image", "video" or "audio" for media the UI plays.
+func webMediaKind(mediaType string) string {
+	if !slices.Contains(webMedia, mediaType) {
+		return ""
+	}
+	kind, _, _ := strings.Cut(mediaType, "/")
+	return kind
+}
+
+// replyTo fills the composer to reply to an article, in the same groups.
+func replyTo(a Article) map[string]interface{} {
+	groups := []string{}
+	for _, g := range a.Newsgroups {
+		groups = append(groups, strings.TrimSpace(g))
+	}
+	subject := a.Subject
+	if !strings.HasPrefix(subject, "Re: ") {
+		subject = "Re: " + subject
+	}
+	return map[string]interface{}{
+		"Newsgroups": groups,
+		"References": append(append([]string{}, a.References...), a.MessageId),
+		"Subject":    subject,
+	}
+}
+
+func (c *Client) render(w http.ResponseWriter, page string, data map[string]interface{}) {
+	data["Me"] = c.deviceId
+	data["Name"] = c.displayName()
+	w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	if err := webTemplates.ExecuteTemplate(w, page, data); err != nil {
+		slog.Info("web UI template error", "page", page, "error", err)
+	}
+}
+
+func (c *Client) renderError(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	c.render(w, "error.html", map[string]interface{}{"Title": "Error", "Error": err.Error()})
+}
+
+// feedGroups lists the groups shown in the timeline and composer.
+func (c *Client) feedGroups() ([]*nntp.Group, error) {
+	groups, err := c.Groups()
+	if err != nil {
+		return nil, err
+	}
+	ret := []*nntp.Group{}
+	for _, g := range groups {
+		if feedGroup(g.Name) {
+			ret = append(ret, g)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+// webLogin swaps the API token for a cookie, so a browser can use the UI.
+func webLogin(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validToken(r.URL.Query().Get("token"), token) {
+			writeError(w, http.StatusUnauthorized, serr.Errorf("invalid token"))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     tokenCookie,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+}
+
+// sameOrigin refuses forms posted from other sites.
+func sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); r.Method == http.MethodPost && origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				writeError(w, http.StatusForbidden, serr.Errorf("cross origin request"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// webHandler serves the pages and the forms they post, each form redirects
+// back to a page when it's done.
+func (c *Client) webHandler() http.Handler {
+	mux := http.NewServeMux()
+	static, _ := fs.Sub(webFiles, "web/static")
+	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(static)))
+
+	back := func(w http.ResponseWriter, r *http.Request, to string, err error) {
+		if err != nil {
+			c.renderError(w, err)
+			return
+		}
+		http.Redirect(w, r, to, http.StatusSeeOther)
+	}
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		groups, err := c.feedGroups()
+		if err != nil {
+			c.renderError(w, err)
+			return
+		}
+		since := time.Time{}
+		if before, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64); err == nil {
+			since = time.Unix(before, 0)
+		}
+		sinceId, _ := strconv.ParseInt(r.URL.Query().Get("beforeid"), 10, 64)
+		timeline, err := c.Timeline(since, sinceId, webTimelineSize)
+		if err != nil {
+			c.renderError(w, err)
+			return
+		}
+		older, olderId := int64(0), int64(0)
+		if len(timeline) == webTimelineSize {
+			older = timeline[len(timeline)-1].Date.Unix()
+			olderId = timeline[len(timeline)-1].Number
+		}
+		c.render(w, "timeline.html", map[string]interface{}{
+			"Title":    "Timeline",
+			"Groups":   groups,
+			"Articles": timeline,
+			"Older":    older,
+			"OlderId":  olderId,
+		})
+	})
+
+	mux.HandleFunc("GET /thread", func(w http.ResponseWriter, r *http.Request) {
+		thread, err := c.Thread(r.URL.Query().Get("id"))
+		if err != nil {
+			c.renderError(w, err)
+			return
+		}
+		c.render(w, "thread.html", map[string]interface{}{
+			"Title":  thread.Subject,
+			"Thread": thread,
+		})
+	})
+
+	mux.HandleFunc("GET /group", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		threads, err := c.GroupThreads(name, page)
+		if err != nil {
+			c.renderError(w, err)
+			return
+		}
+		next := 0
+		if len(threads) == databases.ThreadsPerPage {
+			next = page + 1
+		}
+		c.render(w, "group.html", map[string]interface{}{
+			"Title":   name,
+			"Group":   name,
+			"Groups":  []*nntp.Group{{Name: name}},
+			"Threads": threads,
+			"Next":    next,
+		})
+	})
+
+	mux.HandleFunc("POST /post", func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxObjectUpload)
+		if err := r.ParseMultipartForm(maxUpload); err != nil && err != http.ErrNotMultipart {
+			c.renderError(w, err)
+			return
+		}
+		groups := r.PostForm["newsgroups"]
+		if len(groups) == 0 {
+			c.renderError(w, serr.Errorf("pick a group to post to"))
+			return
+		}
+		refs := strings.Fields(r.PostFormValue("references"))
+		uploads := []*multipart.FileHeader{}
+		if r.MultipartForm != nil {
+			uploads = r.MultipartForm.File["files"]
+		}
+		files, objects := []File{}, []messages.Manifest{}
+		for _, fh := range uploads {
+			f, err := fh.Open()
+			if err != nil {
+				c.renderError(w, err)
+				return
+			}
+			// big files are streamed into chunks, rather than read whole.
+			if fh.Size > messages.MaxAttachmentSize {
+				manifest, err := c.UploadObject(groups, fh.Filename, fh.Header.Get("Content-Type"), f)
+				f.Close()
+				if err != nil {
+					c.renderError(w, err)
+					return
+				}
+				objects = append(objects, manifest)
+				continue
+			}
+			content, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				c.renderError(w, err)
+				return
+			}
+			files = append(files, File{Name: fh.Filename, Type: fh.Header.Get("Content-Type"), Content: content})
+		}
+		_, err := c.PostFiles(groups, r.PostFormValue("subject"), r.PostFormValue("text"), refs, files, objects)
+		to := "/"
+		if len(refs) > 0 {
+			to = "/thread?id=" + url.QueryEscape(refs[0])
+		}
+		back(w, r, to, err)
+	})
+
+	mux.HandleFunc("GET /attachment", func(w http.ResponseWriter, r *http.Request) {
+		c.serveAttachment(w, r.URL.Query().Get("id"), r.URL.Query().Get("part"))
+	})
+	mux.HandleFunc("GET /object", func(w http.ResponseWriter, r *http.Request) {
+		c.serveObject(w, r, r.URL.Query().Get("id"), r.URL.Query().Get("part"))
+	})
+
+	// react toggles our reaction to an article.
+	mux.HandleFunc("POST /react", func(w http.ResponseWriter, r *http.Request) {
+		id, reaction := r.PostFormValue("id"), r.PostFormValue("reaction")
+		to := "/thread?id=" + url.QueryEscape(id)
+		if c.be.DBs.HasReaction(c.deviceId, id, reaction) {
+			back(w, r, to, c.Unreact(id, reaction))
+			return
+		}
+		back(w, r, to, c.React(id, reaction))
+	})
+
+	mux.HandleFunc("GET /discover", func(w http.ResponseWriter, r *http.Request) {
+		groups, err := c.feedGroups()
+		if err != nil {
+			c.renderError(w, err)
+			return
+		}
+		suggestions, _ := c.Suggestions()
+		c.render(w, "discover.html", map[string]interface{}{
+			"Title":       "Discover",
+			"Groups":      groups,
+			"Suggestions": suggestions,
+		})
+	})
+
+	mux.HandleFunc("POST /groups", func(w http.ResponseWriter, r *http.Request) {
+		name, description := r.PostFormValue("name"), r.PostFormValue("description")
+		if name == "" {
+			c.renderError(w, serr.Errorf("a group needs a name"))
+			return
+		}
+		if r.PostFormValue("ephemeral") != "" {
+			back(w, r, "/discover", c.CreateEphemeralGroup(name, description, 0, 0, false))
+			return
+		}
+		if types, maxSize := r.PostFormValue("types"), r.PostFormValue("maxsize"); types != "" || maxSize != "" {
+			kb, _ := strconv.ParseInt(maxSize, 10, 64)
+			policy := messages.ContentPolicy{Types: strings.FieldsFunc(types, func(r rune) bool { return r == ',' || r == ' ' }), MaxSize: kb << 10}
+			back(w, r, "/discover", c.CreateGroupWithPolicy(name, description, policy))
+			return
+		}
+		back(w, r, "/discover", c.CreateNewGroup(name, description, nntp.PostingPermitted))
+	})
+
+	mux.HandleFunc("POST /suggestions/{torid}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		switch r.PathValue("action") {
+		case "accept":
+			back(w, r, "/discover", c.AcceptSuggestion(r.PathValue("torid")))
+		case "reject":
+			back(w, r, "/discover", c.RejectSuggestion(r.PathValue("torid")))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	friends := func(w http.ResponseWriter, invite string) {
+		status, err := c.PeerStatus()
+		if err != nil {
+			c.renderError(w, err)
+			return
+		}
+		requests, _ := c.PeerRequests()
+		pending := []databases.PeerRequest{}
+		for _, req := range requests {
+			if req.Status == databases.PeerRequestPending {
+				pending = append(pending, req)
+			}
+		}
+		c.render(w, "friends.html", map[string]interface{}{
+			"Title":    "Friends",
+			"Peers":    status,
+			"Requests": pending,
+			"Invite":   invite,
+		})
+	}
+	mux.HandleFunc("GET /friends", func(w http.ResponseWriter, r *http.Request) {
+		friends(w, "")
+	})
+	mux.HandleFunc("POST /friends", func(w http.ResponseWriter, r *http.Request) {
+		back(w, r, "/friends", c.RequestPeer(r.PostFormValue("torid"), c.displayName(), r.PostFormValue("note")))
+	})
+	mux.HandleFunc("POST /friends/{torid}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		torId := r.PathValue("torid")
+		switch r.PathValue("action") {
+		case "accept":
+			back(w, r, "/friends", c.AcceptPeerRequest(torId, c.displayName()))
+		case "reject":
+			back(w, r, "/friends", c.RejectPeerRequest(torId))
+		case "block":
+			back(w, r, "/friends", c.BlockPeerRequest(torId))
+		case "remove":
+			back(w, r, "/friends", c.RemovePeer(torId))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("POST /invites", func(w http.ResponseWriter, r *http.Request) {
+		invite, err := c.CreateInvite(7*24*time.Hour, databases.PermissionsGroupT{Read: true, Reply: true})
+		if err != nil {
+			c.renderError(w, err)
+			return
+		}
+		friends(w, invite)
+	})
+	mux.HandleFunc("POST /invites/accept", func(w http.ResponseWriter, r *http.Request) {
+		_, err := c.AcceptInvite(strings.TrimSpace(r.PostFormValue("token")))
+		back(w, r, "/friends", err)
+	})
+
+	return sameOrigin(mux)
+}